@@ -0,0 +1,190 @@
+// Package archive allows the contents of archive files to be used as
+// read-only CP/M drives.
+//
+// Archives are described by a string with a prefix giving their type:
+//
+//	zip:/path/to/games.zip  - A ZIP archive.
+//	tar:/path/to/games.tar  - A TAR archive, which may be gzip-compressed.
+//	tgz:/path/to/games.tgz  - A gzip-compressed TAR archive.
+//	lbr:/path/to/games.lbr  - A CP/M LBR library.
+//
+// Archives are read into memory when they are opened, and presented as a
+// filesystem containing a single directory.  Any directory structure
+// within the archive is flattened, and the names of the files are
+// converted to the CP/M 8.3 format via the same aliasing we use for the
+// files upon the host.
+//
+// Files within an archive which were squeezed, or crunched, may be
+// expanded as the archive is opened.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/skx/cpmulator/fcb"
+)
+
+// openers contains the functions which read each type of archive,
+// returning the names and contents of the files within.
+var openers = map[string]func(string) ([]string, map[string][]byte, error){
+	"zip": readZip,
+	"tar": readTar,
+	"tgz": readTar,
+	"lbr": readLbr,
+}
+
+// IsArchive returns true if the given string describes an archive which
+// we can open.
+func IsArchive(spec string) bool {
+	kind, _, found := strings.Cut(spec, ":")
+	if !found {
+		return false
+	}
+	_, ok := openers[kind]
+	return ok
+}
+
+// Open reads the archive described by the given string, and returns a
+// filesystem containing its files.
+//
+// If decompress is true then squeezed and crunched files are expanded,
+// and appear under their original names.
+func Open(spec string, decompress bool) (fs.FS, error) {
+	kind, file, found := strings.Cut(spec, ":")
+	opener, ok := openers[kind]
+	if !found || !ok {
+		return nil, fmt.Errorf("unknown archive type '%s'", spec)
+	}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive %s: %s", file, err)
+	}
+
+	names, contents, err := opener(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive %s: %s", file, err)
+	}
+
+	// Expand any compressed files, leaving those we can't alone.
+	if decompress {
+		var expanded []string
+		data := make(map[string][]byte)
+		for _, name := range names {
+			if orig, out, ok := expand(contents[name]); ok {
+				expanded = add(expanded, data, orig, out)
+			} else {
+				expanded = add(expanded, data, name, contents[name])
+			}
+		}
+		names, contents = expanded, data
+	}
+
+	// Give each file a name CP/M can use.
+	m := &memFS{files: make(map[string][]byte), modTime: fi.ModTime()}
+	for alias, name := range fcb.Aliases(names) {
+		m.files[alias] = contents[name]
+	}
+	return m, nil
+}
+
+// add records the contents of a file found within an archive, ignoring
+// any directory it was within.
+//
+// If there are several files with the same name the first is used.
+func add(names []string, contents map[string][]byte, name string, data []byte) []string {
+	name = path.Base(name)
+	if _, ok := contents[name]; ok {
+		return names
+	}
+	contents[name] = data
+	return append(names, name)
+}
+
+// readZip returns the files within a ZIP archive.
+func readZip(file string) ([]string, map[string][]byte, error) {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	var names []string
+	contents := make(map[string][]byte)
+
+	for _, f := range r.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		in, err := f.Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(in)
+		in.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %s", f.Name, err)
+		}
+
+		names = add(names, contents, f.Name, data)
+	}
+	return names, contents, nil
+}
+
+// readTar returns the files within a TAR archive, which may be compressed
+// with gzip.
+func readTar(file string) ([]string, map[string][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	// Decompress, if the archive has the gzip magic number.
+	in := bufio.NewReader(f)
+	var r io.Reader = in
+	magic, err := in.Peek(2)
+	if err == nil && magic[0] == 0x1F && magic[1] == 0x8B {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var names []string
+	contents := make(map[string][]byte)
+
+	t := tar.NewReader(r)
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := io.ReadAll(t)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %s", hdr.Name, err)
+		}
+
+		names = add(names, contents, hdr.Name, data)
+	}
+	return names, contents, nil
+}
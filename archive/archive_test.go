@@ -0,0 +1,361 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// files contains the members of the archives we create for testing.
+var files = map[string]string{
+	"games/ZORK1.COM":        "zork",
+	"games/readme.txt":       "hello",
+	"other/readme.txt":       "duplicate",
+	"docs/instructions.text": "long",
+}
+
+// writeZip creates a ZIP archive containing our test files.
+func writeZip(t *testing.T, path string) {
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create archive: %s", err)
+	}
+	defer out.Close()
+
+	w := zip.NewWriter(out)
+	for _, name := range []string{"games/ZORK1.COM", "games/readme.txt", "other/readme.txt", "docs/instructions.text"} {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatalf("failed to add file: %s", err)
+		}
+		_, err = f.Write([]byte(files[name]))
+		if err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+}
+
+// writeTar creates a TAR archive containing our test files, which is
+// compressed if gz is true.
+func writeTar(t *testing.T, path string, gz bool) {
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create archive: %s", err)
+	}
+	defer out.Close()
+
+	var dst io.Writer = out
+	if gz {
+		z := gzip.NewWriter(out)
+		defer z.Close()
+		dst = z
+	}
+
+	w := tar.NewWriter(dst)
+	err = w.WriteHeader(&tar.Header{Name: "games/", Typeflag: tar.TypeDir, Mode: 0755})
+	if err != nil {
+		t.Fatalf("failed to add directory: %s", err)
+	}
+	for _, name := range []string{"games/ZORK1.COM", "games/readme.txt", "other/readme.txt", "docs/instructions.text"} {
+		err = w.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[name]))})
+		if err != nil {
+			t.Fatalf("failed to add file: %s", err)
+		}
+		_, err = w.Write([]byte(files[name]))
+		if err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+}
+
+func TestIsArchive(t *testing.T) {
+	for spec, expected := range map[string]bool{
+		"zip:games.zip": true,
+		"tar:games.tar": true,
+		"tgz:games.tgz": true,
+		"games.zip":     false,
+		"/tmp/C":        false,
+		"rar:games.rar": false,
+	} {
+		if IsArchive(spec) != expected {
+			t.Fatalf("unexpected result for %s", spec)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+
+	writeZip(t, filepath.Join(dir, "games.zip"))
+	writeTar(t, filepath.Join(dir, "games.tar"), false)
+	writeTar(t, filepath.Join(dir, "games.tgz"), true)
+
+	for _, spec := range []string{"zip:", "tar:", "tgz:"} {
+		name := filepath.Join(dir, "games.zip")
+		switch spec {
+		case "tar:":
+			name = filepath.Join(dir, "games.tar")
+		case "tgz:":
+			name = filepath.Join(dir, "games.tgz")
+		}
+
+		fsys, err := Open(spec+name, false)
+		if err != nil {
+			t.Fatalf("failed to open %s: %s", name, err)
+		}
+
+		// The directories are flattened, the first of the
+		// duplicates is kept, and long names are aliased.
+		expected := map[string]string{
+			"ZORK1.COM":    "zork",
+			"README.TXT":   "hello",
+			"IN4C32~1.TEX": "long",
+		}
+
+		entries, err := fs.ReadDir(fsys, ".")
+		if err != nil {
+			t.Fatalf("failed to read directory: %s", err)
+		}
+		if len(entries) != len(expected) {
+			t.Fatalf("%s: wrong number of files %d", spec, len(entries))
+		}
+		for _, ent := range entries {
+			want, ok := expected[ent.Name()]
+			if !ok {
+				t.Fatalf("%s: unexpected file %s", spec, ent.Name())
+			}
+			data, err := fs.ReadFile(fsys, ent.Name())
+			if err != nil {
+				t.Fatalf("failed to read %s: %s", ent.Name(), err)
+			}
+			if string(data) != want {
+				t.Fatalf("%s: wrong contents for %s", spec, ent.Name())
+			}
+			info, err := ent.Info()
+			if err != nil || info.Size() != int64(len(want)) {
+				t.Fatalf("%s: wrong size for %s", spec, ent.Name())
+			}
+		}
+
+		_, err = fsys.Open("MISSING.COM")
+		if err == nil {
+			t.Fatalf("opened a file which doesn't exist")
+		}
+	}
+
+	_, err := Open("zip:"+filepath.Join(dir, "missing.zip"), false)
+	if err == nil {
+		t.Fatalf("opened an archive which doesn't exist")
+	}
+	_, err = Open("zip:"+filepath.Join(dir, "games.tar"), false)
+	if err == nil {
+		t.Fatalf("opened an archive of the wrong type")
+	}
+}
+
+// squeezed is "AB.TXT", containing "AB", squeezed.
+var squeezed = []byte{
+	0x76, 0xFF, 0x83, 0x00, 'A', 'B', '.', 'T', 'X', 'T', 0x00,
+	0x02, 0x00,
+	0xBE, 0xFF, 0x01, 0x00, // 'A', node 1
+	0xBD, 0xFF, 0xFF, 0xFE, // 'B', EOF
+	0x1A, // 0, 10, 11
+}
+
+// crunch returns the given data crunched, as a file with the given name.
+func crunch(name string, data []byte) []byte {
+	out := append([]byte{0x76, 0xFE}, name...)
+	out = append(out, 0x00, 0x20, 0x20, 0x00, 0x00)
+
+	var acc uint32
+	var n int
+	bits := 9
+	emit := func(code int) {
+		acc = acc<<bits | uint32(code)
+		n += bits
+		for n >= 8 {
+			out = append(out, byte(acc>>(n-8)))
+			n -= 8
+		}
+	}
+
+	table := make(map[[2]int]int)
+	next := crunchFirst
+	prev := int(data[0])
+	for _, c := range data[1:] {
+		if code, ok := table[[2]int{prev, int(c)}]; ok {
+			prev = code
+			continue
+		}
+		emit(prev)
+		if next < 1<<crunchMaxBits {
+			table[[2]int{prev, int(c)}] = next
+			next++
+		}
+		if next >= 1<<bits && bits < crunchMaxBits {
+			bits++
+		}
+		prev = int(c)
+	}
+	emit(prev)
+	emit(crunchEOF)
+	if n > 0 {
+		out = append(out, byte(acc<<(8-n)))
+	}
+
+	sum := checksum(data)
+	return append(out, byte(sum), byte(sum>>8))
+}
+
+// lbr returns a library containing the given members.
+func lbr(names []string, members [][]byte) []byte {
+	dir := make([]byte, 256)
+	for i := range dir {
+		dir[i] = 0xFF
+	}
+	copy(dir, []byte{0x00, ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', 0, 0, 2, 0})
+
+	out := append([]byte{}, dir...)
+	for i, name := range names {
+		sectors := (len(members[i]) + 127) / 128
+		ent := out[32*(i+1):]
+		for j := range ent[:32] {
+			ent[j] = 0
+		}
+		copy(ent[1:12], name)
+		ent[12] = byte(len(out) / 128)
+		ent[14] = byte(sectors)
+		ent[26] = byte(sectors*128 - len(members[i]))
+
+		data := make([]byte, sectors*128)
+		copy(data, members[i])
+		out = append(out, data...)
+	}
+	return out
+}
+
+func TestLbr(t *testing.T) {
+
+	// A file large enough to use the longer codes.
+	var text []byte
+	for i := 0; i < 2000; i++ {
+		text = append(text, []byte(fmt.Sprintf("Line %d of the crunched file.\r\n", i%250))...)
+	}
+
+	plain := []byte("plain text")
+	bad := append([]byte{}, squeezed...)
+	bad[2] = 0x00
+
+	path := filepath.Join(t.TempDir(), "test.lbr")
+	err := os.WriteFile(path, lbr(
+		[]string{"PLAIN   TXT", "AB      TQT", "BIG     TZT", "BAD     TQT"},
+		[][]byte{plain, squeezed, crunch("BIG.TXT [from test]", text), bad}), 0644)
+	if err != nil {
+		t.Fatalf("failed to write library: %s", err)
+	}
+
+	// Without expansion the members are as they are stored.
+	fsys, err := Open("lbr:"+path, false)
+	if err != nil {
+		t.Fatalf("failed to open library: %s", err)
+	}
+	data, err := fs.ReadFile(fsys, "PLAIN.TXT")
+	if err != nil || string(data) != "plain text" {
+		t.Fatalf("failed to read plain member")
+	}
+	data, err = fs.ReadFile(fsys, "AB.TQT")
+	if err != nil || !bytes.Equal(data, squeezed) {
+		t.Fatalf("failed to read squeezed member")
+	}
+
+	// With expansion they have their original names and contents,
+	// unless they are corrupt.
+	fsys, err = Open("lbr:"+path, true)
+	if err != nil {
+		t.Fatalf("failed to open library: %s", err)
+	}
+	expected := map[string][]byte{
+		"PLAIN.TXT": plain,
+		"AB.TXT":    []byte("AB"),
+		"BIG.TXT":   text,
+		"BAD.TQT":   bad,
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil || len(entries) != len(expected) {
+		t.Fatalf("wrong files in library: %v", entries)
+	}
+	for name, want := range expected {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", name, err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Fatalf("wrong contents for %s", name)
+		}
+	}
+
+	// A file which isn't a library.
+	err = os.WriteFile(path, []byte("not a library"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	_, err = Open("lbr:"+path, false)
+	if err == nil {
+		t.Fatalf("opened something which isn't a library")
+	}
+}
+
+// TestRealFiles expands the files in testdata/ which were compressed by
+// the real CRUNCH and SQ utilities, and compares them with the originals.
+func TestRealFiles(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.?[QZ]?"))
+	if err != nil {
+		t.Fatalf("failed to find files: %s", err)
+	}
+	if len(files) == 0 {
+		t.Skip("no files from the real CRUNCH or SQ, see testdata/README.md")
+	}
+
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", path, err)
+		}
+		name, out, ok := expand(data)
+		if !ok {
+			t.Fatalf("failed to expand %s", path)
+		}
+		want, err := os.ReadFile(filepath.Join("testdata", "original", name))
+		if err != nil {
+			t.Fatalf("failed to read the original of %s: %s", path, err)
+		}
+
+		// The original was padded to a whole number of records.
+		if len(out) < len(want) || !bytes.Equal(out[:len(want)], want) {
+			t.Fatalf("%s expanded to the wrong contents", path)
+		}
+	}
+}
+
+func TestUnrle(t *testing.T) {
+	in := []byte{'A', dle, 4, 'B', dle, 0, 'C', dle, 0, dle, 3}
+	out := []byte{'A', 'A', 'A', 'A', 'B', dle, 'C', dle, dle, dle}
+	if !bytes.Equal(unrle(in), out) {
+		t.Fatalf("unexpected result %v", unrle(in))
+	}
+}
@@ -0,0 +1,104 @@
+package archive
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Software was often distributed with the files squeezed, or crunched,
+// to save space.  Such files keep their original name within them, and
+// their names have a 'Q' or 'Z' as the middle character of the suffix.
+//
+// Both formats run-length encode the data before compressing it, and
+// include a checksum of the original data.
+
+// dle is the byte which introduces a repeated sequence, in the
+// run-length encoding.
+const dle = 0x90
+
+// expand returns the name and contents of the original file, if the
+// given file is squeezed or crunched.
+//
+// If the file isn't compressed, or it cannot be decompressed, false is
+// returned and the file should be used as-is.
+func expand(data []byte) (string, []byte, bool) {
+	if len(data) < 2 || data[0] != 0x76 {
+		return "", nil, false
+	}
+
+	var name string
+	var out []byte
+	var err error
+
+	switch data[1] {
+	case 0xFF:
+		name, out, err = unsqueeze(data)
+	case 0xFE:
+		name, out, err = uncrunch(data)
+	default:
+		return "", nil, false
+	}
+	if err != nil || name == "" {
+		return "", nil, false
+	}
+	return name, out, true
+}
+
+// originalName returns the name of the original file, which is stored
+// as a NUL-terminated string, along with the offset following it.
+//
+// Crunched files may have a comment following the name, in brackets,
+// which is removed.
+func originalName(data []byte, offset int) (string, int, bool) {
+	end := bytes.IndexByte(data[offset:], 0x00)
+	if end < 0 {
+		return "", 0, false
+	}
+
+	name := string(data[offset : offset+end])
+	if i := strings.IndexAny(name, "[ "); i >= 0 {
+		name = name[:i]
+	}
+	return strings.TrimSpace(name), offset + end + 1, true
+}
+
+// unrle reverses the run-length encoding of the given data.
+//
+// A repeated byte is followed by DLE and the number of times it is
+// present in total, while DLE itself is encoded as DLE followed by zero.
+func unrle(data []byte) []byte {
+	var out []byte
+	var last byte
+	repeat := false
+
+	for _, c := range data {
+		switch {
+		case repeat:
+			repeat = false
+			if c == 0 {
+				out = append(out, dle)
+				last = dle
+				continue
+			}
+			for i := 1; i < int(c); i++ {
+				out = append(out, last)
+			}
+		case c == dle:
+			repeat = true
+		default:
+			out = append(out, c)
+			last = c
+		}
+	}
+	return out
+}
+
+// checksum returns the sum of the given bytes, as stored within both
+// squeezed and crunched files.
+func checksum(data []byte) uint16 {
+	var sum uint16
+	for _, c := range data {
+		sum += uint16(c)
+	}
+	return sum
+}
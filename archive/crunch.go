@@ -0,0 +1,142 @@
+package archive
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// A crunched file begins with a header containing the name of the
+// original file, and the revision of CRUNCH which created it.  The data
+// follows, compressed with LZW using codes of between 9 and 12 bits which
+// are read from the most-significant end of each byte, and the checksum
+// of the original data follows the end of the compressed data.
+//
+// We only support the format used by CRUNCH 2.x, older files are left
+// alone.
+
+const (
+	// crunchEOF marks the end of the compressed data.
+	crunchEOF = 0x100
+
+	// crunchReset means the table should be emptied.
+	crunchReset = 0x101
+
+	// crunchNull means the next code doesn't add a table entry.
+	crunchNull = 0x102
+
+	// crunchSpare is unused.
+	crunchSpare = 0x103
+
+	// crunchFirst is the first code which refers to a table entry.
+	crunchFirst = 0x104
+
+	// crunchMaxBits is the size of the largest code.
+	crunchMaxBits = 12
+
+	// crunchRevision is the first revision of the format we support.
+	crunchRevision = 0x20
+)
+
+// uncrunch returns the original name and contents of a crunched file.
+func uncrunch(data []byte) (string, []byte, error) {
+	name, offset, ok := originalName(data, 2)
+	if !ok || offset+4 > len(data) {
+		return "", nil, fmt.Errorf("crunched file is truncated")
+	}
+
+	// Skip the revision, checksum-type, and spare bytes.
+	if data[offset+1] < crunchRevision {
+		return "", nil, fmt.Errorf("unsupported crunch revision %02X", data[offset+1])
+	}
+	offset += 4
+
+	// The string each code refers to is found by following the
+	// prefixes back to a single byte.
+	prefix := make([]int, 1<<crunchMaxBits)
+	suffix := make([]byte, 1<<crunchMaxBits)
+
+	// expand returns the string the given code refers to.
+	expand := func(code int) []byte {
+		var str []byte
+		for code >= crunchFirst {
+			str = append([]byte{suffix[code]}, str...)
+			code = prefix[code]
+		}
+		return append([]byte{byte(code)}, str...)
+	}
+
+	var out []byte
+	bits := 9
+	next := crunchFirst
+	prev := -1
+	pos := offset * 8
+
+	for {
+		if pos+bits > len(data)*8 {
+			return "", nil, fmt.Errorf("crunched data is truncated")
+		}
+
+		// Read the next code.
+		code := 0
+		for i := 0; i < bits; i++ {
+			code = code<<1 | int(data[pos/8]>>(7-pos%8))&1
+			pos++
+		}
+
+		if code == crunchEOF {
+			break
+		}
+
+		switch code {
+		case crunchReset:
+			bits = 9
+			next = crunchFirst
+			prev = -1
+			continue
+		case crunchNull:
+			prev = -1
+			continue
+		case crunchSpare:
+			continue
+		}
+
+		var str []byte
+		switch {
+		case code < 0x100 || code < next:
+			str = expand(code)
+		case code == next && prev >= 0:
+			str = expand(prev)
+			str = append(str, str[0])
+		default:
+			return "", nil, fmt.Errorf("invalid code %03X", code)
+		}
+		out = append(out, str...)
+
+		// Add the new table entry, which is the previous string
+		// followed by the first byte of this one.
+		if prev >= 0 && next < len(prefix) {
+			prefix[next] = prev
+			suffix[next] = str[0]
+			next++
+		}
+
+		// The compressor is always one entry ahead of us, so we
+		// need to use longer codes just before our table fills.
+		if next+1 >= 1<<bits && bits < crunchMaxBits {
+			bits++
+		}
+		prev = code
+	}
+
+	// The checksum starts at the next byte.
+	offset = (pos + 7) / 8
+	if offset+2 > len(data) {
+		return "", nil, fmt.Errorf("crunched file has no checksum")
+	}
+
+	out = unrle(out)
+	if checksum(out) != binary.LittleEndian.Uint16(data[offset:]) {
+		return "", nil, fmt.Errorf("checksum mismatch")
+	}
+	return name, out, nil
+}
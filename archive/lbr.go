@@ -0,0 +1,67 @@
+package archive
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// An LBR library is made up of 128-byte sectors, the first of which
+// begin with the directory of the library.
+//
+// The directory is made up of 32-byte entries, and the first entry
+// describes the directory itself.
+const lbrSector = 128
+
+// readLbr returns the files within an LU-format LBR library.
+func readLbr(file string) ([]string, map[string][]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(data) < 32 || data[0] != 0x00 || strings.TrimSpace(string(data[1:12])) != "" {
+		return nil, nil, fmt.Errorf("not an LBR library")
+	}
+
+	// The size of the directory, in sectors.
+	sectors := int(binary.LittleEndian.Uint16(data[14:]))
+	if sectors < 1 || sectors*lbrSector > len(data) {
+		return nil, nil, fmt.Errorf("invalid directory size %d", sectors)
+	}
+
+	var names []string
+	contents := make(map[string][]byte)
+
+	for off := 32; off < sectors*lbrSector; off += 32 {
+		ent := data[off : off+32]
+
+		// Only active entries are interesting, others are
+		// deleted or unused.
+		if ent[0] != 0x00 {
+			continue
+		}
+
+		name := strings.TrimSpace(string(ent[1:9]))
+		ext := strings.TrimSpace(string(ent[9:12]))
+		if ext != "" {
+			name += "." + ext
+		}
+
+		start := int(binary.LittleEndian.Uint16(ent[12:])) * lbrSector
+		end := start + int(binary.LittleEndian.Uint16(ent[14:]))*lbrSector
+		if start > len(data) || end > len(data) {
+			return nil, nil, fmt.Errorf("member %s is outside the library", name)
+		}
+
+		// The number of unused bytes in the last sector, which
+		// isn't always present.
+		if pad := int(ent[26]); pad < lbrSector && end-pad >= start {
+			end -= pad
+		}
+
+		names = add(names, contents, name, data[start:end])
+	}
+	return names, contents, nil
+}
@@ -0,0 +1,103 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+// memFS is a read-only filesystem, held in memory, which contains a
+// single directory of files.
+type memFS struct {
+
+	// files contains the contents of each file, keyed by name.
+	files map[string][]byte
+
+	// modTime is the modification time we report for all files.
+	modTime time.Time
+}
+
+// Open opens the named file, which is part of the fs.FS interface.
+func (m *memFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		var entries []fs.DirEntry
+		for n, data := range m.files {
+			entries = append(entries, fs.FileInfoToDirEntry(&memInfo{name: n, size: int64(len(data)), modTime: m.modTime}))
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name() < entries[j].Name()
+		})
+		return &memDir{info: &memInfo{name: ".", dir: true, modTime: m.modTime}, entries: entries}, nil
+	}
+
+	data, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFile{info: &memInfo{name: name, size: int64(len(data)), modTime: m.modTime}, Reader: bytes.NewReader(data)}, nil
+}
+
+// memInfo describes a file, or our directory, and implements fs.FileInfo.
+type memInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.dir }
+func (i *memInfo) Sys() any           { return nil }
+func (i *memInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// memFile is an open file, which implements fs.File.
+type memFile struct {
+	*bytes.Reader
+	info *memInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+// memDir is our open directory, which implements fs.ReadDirFile.
+type memDir struct {
+	info    *memInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *memDir) Close() error               { return nil }
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+// ReadDir returns the entries of the directory, as per fs.ReadDirFile.
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
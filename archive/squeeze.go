@@ -0,0 +1,82 @@
+package archive
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// A squeezed file begins with a header containing the checksum and name
+// of the original file, followed by a Huffman tree.  The data follows,
+// with bits being read from the least-significant end of each byte.
+//
+// Each node of the tree contains two children, and children which are
+// negative are leaves holding the complement of a byte - or of 256 to
+// mark the end of the data.
+
+// squeezeEOF is the value of the leaf which marks the end of the data.
+const squeezeEOF = 256
+
+// unsqueeze returns the original name and contents of a squeezed file.
+func unsqueeze(data []byte) (string, []byte, error) {
+	if len(data) < 4 {
+		return "", nil, fmt.Errorf("squeezed file is truncated")
+	}
+	sum := binary.LittleEndian.Uint16(data[2:])
+
+	name, offset, ok := originalName(data, 4)
+	if !ok || offset+2 > len(data) {
+		return "", nil, fmt.Errorf("squeezed file is truncated")
+	}
+
+	count := int(binary.LittleEndian.Uint16(data[offset:]))
+	offset += 2
+	if count > squeezeEOF || offset+count*4 > len(data) {
+		return "", nil, fmt.Errorf("invalid tree with %d nodes", count)
+	}
+
+	tree := make([][2]int16, count)
+	for i := range tree {
+		tree[i][0] = int16(binary.LittleEndian.Uint16(data[offset:]))
+		tree[i][1] = int16(binary.LittleEndian.Uint16(data[offset+2:]))
+		offset += 4
+	}
+
+	// Decode the data, which is an empty file if there is no tree.
+	var out []byte
+	if count > 0 {
+		node := int16(0)
+		bit := 0
+		for {
+			if offset >= len(data) {
+				return "", nil, fmt.Errorf("squeezed data is truncated")
+			}
+			if node < 0 || int(node) >= count {
+				return "", nil, fmt.Errorf("invalid tree node %d", node)
+			}
+
+			node = tree[node][(data[offset]>>bit)&1]
+			bit++
+			if bit == 8 {
+				bit = 0
+				offset++
+			}
+
+			if node >= 0 {
+				continue
+			}
+
+			value := -(int(node) + 1)
+			if value == squeezeEOF {
+				break
+			}
+			out = append(out, byte(value))
+			node = 0
+		}
+	}
+
+	out = unrle(out)
+	if checksum(out) != sum {
+		return "", nil, fmt.Errorf("checksum mismatch")
+	}
+	return name, out, nil
+}
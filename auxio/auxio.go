@@ -0,0 +1,372 @@
+// Package auxio contains the auxiliary devices which are used for the
+// CP/M reader (input) and punch (output) devices.
+//
+// Traditionally these were paper-tape readers and punches, but later
+// they were more often serial ports used for file-transfer tools and
+// the like.  We allow them to be connected to files, named pipes, TCP
+// sockets, or a pseudo-terminal on the host.
+//
+// Endpoints are described by a string, with an optional prefix:
+//
+//	file:/path/to/file    - A file, which is read from or appended to.
+//	pipe:/path/to/fifo    - A named pipe, which is created if necessary.
+//	tcp:host:port         - A TCP connection to the given host.
+//	tcp-listen:port       - A TCP port which accepts one connection at a time.
+//	pty                   - A newly allocated pseudo-terminal.
+//
+// A string with no prefix is assumed to be the name of a file.
+package auxio
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Mode is used to specify how a device will be used.
+type Mode int
+
+var (
+	// Input means the device will be read from.
+	Input Mode = 1
+
+	// Output means the device will be written to.
+	Output Mode = 2
+
+	// Both means the device will be read from, and written to.
+	Both Mode = Input | Output
+)
+
+// eof is the character returned when reading past the end of input.
+const eof = 0x1A
+
+// Device holds the state of a single auxiliary endpoint.
+type Device struct {
+
+	// name is a human-readable description of the endpoint.
+	name string
+
+	// mode records how we're going to use the device.
+	mode Mode
+
+	// mu protects the fields which are set when we connect.
+	mu sync.Mutex
+
+	// rw is the connection to the endpoint, once we have one.
+	rw io.ReadWriteCloser
+
+	// listener is used to accept connections for "tcp-listen:".
+	listener net.Listener
+
+	// ready is closed once rw has been set.  For "tcp-listen:" it is
+	// replaced when the connection drops, and we wait for another.
+	ready chan struct{}
+
+	// dropped tells the accepting goroutine that our connection has gone.
+	dropped chan struct{}
+
+	// closed is set once the device has been closed.
+	closed bool
+
+	// input is populated with bytes read from the endpoint, by a
+	// goroutine, so that we can test for pending input without blocking.
+	input chan byte
+
+	// pump is used to ensure the reading goroutine is only launched once.
+	pump sync.Once
+
+	// eof is set when there is no more input to read.
+	eof bool
+
+	// err contains the last error we encountered writing, if any.
+	err error
+}
+
+// New opens the endpoint described by the given string.
+func New(spec string, mode Mode) (*Device, error) {
+
+	d := &Device{
+		name:    spec,
+		mode:    mode,
+		ready:   make(chan struct{}),
+		dropped: make(chan struct{}, 1),
+		input:   make(chan byte, 4096),
+	}
+
+	kind, target, found := strings.Cut(spec, ":")
+	if !found && kind != "pty" {
+		kind = "file"
+		target = spec
+	}
+
+	switch kind {
+	case "file":
+		var f *os.File
+		var err error
+		switch mode {
+		case Input:
+			f, err = os.Open(target)
+		case Output:
+			f, err = os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		default:
+			f, err = os.OpenFile(target, os.O_CREATE|os.O_RDWR, 0644)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %s", target, err)
+		}
+		d.connect(f)
+
+	case "pipe":
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			err = unix.Mkfifo(target, 0644)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create named pipe %s: %s", target, err)
+			}
+		}
+
+		// Opening read-write means we don't block waiting for
+		// the other end of the pipe to be opened.
+		f, err := os.OpenFile(target, os.O_RDWR, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open named pipe %s: %s", target, err)
+		}
+		d.connect(f)
+
+	case "tcp":
+		conn, err := net.Dial("tcp", target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %s", target, err)
+		}
+		d.connect(conn)
+
+	case "tcp-listen":
+		if !strings.Contains(target, ":") {
+			target = ":" + target
+		}
+		l, err := net.Listen("tcp", target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %s", target, err)
+		}
+		d.listener = l
+		d.name = "tcp-listen:" + l.Addr().String()
+
+		// Accept connections in the background, so that we don't
+		// block until the guest actually uses the device.
+		go d.accept()
+
+	case "pty":
+		f, name, err := openPTY()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open pseudo-terminal: %s", err)
+		}
+		d.name = "pty:" + name
+		d.connect(f)
+
+	default:
+		return nil, fmt.Errorf("unknown auxiliary device type '%s'", kind)
+	}
+
+	return d, nil
+}
+
+// accept waits for connections to our listener, one at a time.
+//
+// Once a connection drops we accept another, so the endpoint remains
+// usable after a client disconnects.
+func (d *Device) accept() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		d.connect(conn)
+		<-d.dropped
+	}
+}
+
+// connect records the connection to our endpoint.
+func (d *Device) connect(rw io.ReadWriteCloser) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.rw = rw
+	d.err = nil
+	close(d.ready)
+}
+
+// disconnect forgets the given connection, if it is still our current
+// one, so that our listener can accept another.
+//
+// It returns false if the device has been closed, and no further
+// connection will arrive.
+func (d *Device) disconnect(rw io.ReadWriteCloser) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return false
+	}
+	if d.rw == rw {
+		rw.Close()
+		d.rw = nil
+		d.ready = make(chan struct{})
+		d.dropped <- struct{}{}
+	}
+	return true
+}
+
+// wait blocks until we have a connection, and returns it.
+func (d *Device) wait() io.ReadWriteCloser {
+	for {
+		d.mu.Lock()
+		rw := d.rw
+		ready := d.ready
+		d.mu.Unlock()
+
+		if rw != nil {
+			return rw
+		}
+		<-ready
+	}
+}
+
+// String returns a description of the endpoint.
+//
+// For a pseudo-terminal this will include the path the user should
+// connect to, and for a TCP listener the port in use.
+func (d *Device) String() string {
+	return d.name
+}
+
+// startPump launches the goroutine which reads from our endpoint.
+func (d *Device) startPump() {
+	d.pump.Do(func() {
+		go func() {
+			buf := make([]byte, 512)
+			for {
+				rw := d.wait()
+				for {
+					n, err := rw.Read(buf)
+					for _, c := range buf[:n] {
+						d.input <- c
+					}
+					if err != nil {
+						break
+					}
+				}
+
+				// A listener will accept another connection,
+				// anything else has reached the end of input.
+				if d.listener == nil || !d.disconnect(rw) {
+					d.mu.Lock()
+					d.eof = true
+					d.mu.Unlock()
+					close(d.input)
+					return
+				}
+			}
+		}()
+	})
+}
+
+// InputReady returns true if a character may be read without blocking.
+//
+// This is also true at the end of input, where reading will return ^Z.
+func (d *Device) InputReady() bool {
+	if d.mode&Input == 0 {
+		return false
+	}
+	d.startPump()
+
+	if len(d.input) > 0 {
+		return true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.eof
+}
+
+// ReadByte returns the next character from the device, blocking until
+// one is available.
+//
+// At the end of input ^Z is returned, as CP/M expects.
+func (d *Device) ReadByte() (byte, error) {
+	if d.mode&Input == 0 {
+		return 0, fmt.Errorf("device %s is not open for input", d.name)
+	}
+	d.startPump()
+
+	c, ok := <-d.input
+	if !ok {
+		return eof, nil
+	}
+	return c, nil
+}
+
+// OutputReady returns true if the device is able to accept output.
+func (d *Device) OutputReady() bool {
+	if d.mode&Output == 0 {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.rw != nil && d.err == nil
+}
+
+// WriteByte sends a character to the device.
+//
+// If nobody is connected to our "tcp-listen:" port the character is
+// discarded, rather than blocking the emulator; programs which care
+// should test OutputReady, via AUXOST, first.  Similarly if the client
+// goes away we drop the character and wait for another connection.
+func (d *Device) WriteByte(c byte) error {
+	if d.mode&Output == 0 {
+		return fmt.Errorf("device %s is not open for output", d.name)
+	}
+
+	d.mu.Lock()
+	rw := d.rw
+	d.mu.Unlock()
+
+	if rw == nil {
+		return nil
+	}
+
+	_, err := rw.Write([]byte{c})
+	if err != nil && d.listener != nil {
+		d.disconnect(rw)
+		return nil
+	}
+
+	d.mu.Lock()
+	d.err = err
+	d.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to write to %s: %s", d.name, err)
+	}
+	return nil
+}
+
+// Close closes the device.
+func (d *Device) Close() error {
+	if d.listener != nil {
+		d.listener.Close()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+	if d.rw != nil {
+		return d.rw.Close()
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package auxio
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestFile ensures we can read from, and write to, files.
+func TestFile(t *testing.T) {
+
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.txt")
+	out := filepath.Join(dir, "out.txt")
+
+	err := os.WriteFile(in, []byte("CP/M"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write input: %s", err)
+	}
+
+	r, err := New(in, Input)
+	if err != nil {
+		t.Fatalf("failed to open input: %s", err)
+	}
+	defer r.Close()
+
+	w, err := New("file:"+out, Output)
+	if err != nil {
+		t.Fatalf("failed to open output: %s", err)
+	}
+
+	if !w.OutputReady() {
+		t.Fatalf("output should be ready")
+	}
+	if w.InputReady() {
+		t.Fatalf("output-only device should not have input")
+	}
+
+	// Copy the input to the output, including the trailing ^Z.
+	for i := 0; i < 5; i++ {
+		c, er := r.ReadByte()
+		if er != nil {
+			t.Fatalf("failed to read: %s", er)
+		}
+		er = w.WriteByte(c)
+		if er != nil {
+			t.Fatalf("failed to write: %s", er)
+		}
+	}
+	w.Close()
+
+	// At EOF we should always be ready, with ^Z.
+	if !r.InputReady() {
+		t.Fatalf("input should be ready at EOF")
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("failed to read output: %s", err)
+	}
+	if string(data) != "CP/M\x1a" {
+		t.Fatalf("unexpected output %q", data)
+	}
+
+	// Missing input
+	_, err = New(filepath.Join(dir, "missing"), Input)
+	if err == nil {
+		t.Fatalf("expected error opening missing file")
+	}
+}
+
+// TestTCP ensures that we can listen for a connection.
+func TestTCP(t *testing.T) {
+
+	d, err := New("tcp-listen:127.0.0.1:0", Both)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer d.Close()
+
+	// Not connected yet
+	if d.OutputReady() || d.InputReady() {
+		t.Fatalf("device should not be ready before a connection")
+	}
+
+	addr := d.String()[len("tcp-listen:"):]
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("x"))
+	if err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	// Wait for the input to arrive
+	for i := 0; i < 100 && !d.InputReady(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c, err := d.ReadByte()
+	if err != nil || c != 'x' {
+		t.Fatalf("failed to read expected byte: %c %v", c, err)
+	}
+
+	if !d.OutputReady() {
+		t.Fatalf("output should be ready once connected")
+	}
+	err = d.WriteByte('y')
+	if err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	buf := make([]byte, 1)
+	_, err = conn.Read(buf)
+	if err != nil || buf[0] != 'y' {
+		t.Fatalf("failed to receive expected byte")
+	}
+}
+
+// TestTCPReconnect ensures that output to a listener doesn't block
+// before a client connects, and that a second client may connect once
+// the first has gone away.
+func TestTCPReconnect(t *testing.T) {
+
+	d, err := New("tcp-listen:127.0.0.1:0", Both)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer d.Close()
+
+	// With nobody connected output is discarded.
+	done := make(chan error)
+	go func() {
+		done <- d.WriteByte('!')
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("unexpected error writing: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("writing blocked without a connection")
+	}
+
+	addr := d.String()[len("tcp-listen:"):]
+	for i, msg := range []string{"one", "two"} {
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect: %s", err)
+		}
+
+		// Wait for the connection to be accepted
+		for j := 0; j < 100 && !d.OutputReady(); j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !d.OutputReady() {
+			t.Fatalf("connection %d was not accepted", i)
+		}
+
+		for _, c := range []byte(msg) {
+			err = d.WriteByte(c)
+			if err != nil {
+				t.Fatalf("failed to write: %s", err)
+			}
+		}
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, buf)
+		if err != nil || string(buf) != msg {
+			t.Fatalf("failed to receive %q: %q %v", msg, buf, err)
+		}
+
+		// Hang up, and wait for the device to notice.
+		conn.Close()
+		for j := 0; j < 100 && d.OutputReady(); j++ {
+			d.InputReady()
+			time.Sleep(10 * time.Millisecond)
+		}
+		if d.OutputReady() {
+			t.Fatalf("disconnection %d was not noticed", i)
+		}
+		if d.InputReady() {
+			t.Fatalf("input should not be ready without a connection")
+		}
+	}
+}
+
+// TestBogus ensures that unknown endpoints are rejected.
+func TestBogus(t *testing.T) {
+	_, err := New("steve:kemp", Input)
+	if err == nil {
+		t.Fatalf("expected error with bogus endpoint")
+	}
+}
@@ -0,0 +1,36 @@
+//go:build linux
+
+package auxio
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY contains a platform-specific implementation of code to allocate
+// a new pseudo-terminal, returning the master side and the path of the slave.
+func openPTY() (*os.File, string, error) {
+
+	f, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Unlock the slave side, so it may be opened.
+	err = unix.IoctlSetPointerInt(int(f.Fd()), unix.TIOCSPTLCK, 0)
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+
+	// Find the number of the slave.
+	n, err := unix.IoctlGetInt(int(f.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+
+	return f, fmt.Sprintf("/dev/pts/%d", n), nil
+}
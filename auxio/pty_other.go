@@ -0,0 +1,14 @@
+//go:build !linux
+
+package auxio
+
+import (
+	"fmt"
+	"os"
+)
+
+// openPTY contains a platform-specific implementation of code to allocate
+// a new pseudo-terminal, which isn't supported upon this platform.
+func openPTY() (*os.File, string, error) {
+	return nil, "", fmt.Errorf("pseudo-terminals are only supported on Linux")
+}
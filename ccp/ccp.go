@@ -5,6 +5,10 @@
 // means it's easy to add a new CCP driver - however we must also
 // ensure there is a matching name-entry added to the code, so it isn't
 // 100% automatic.
+//
+// Each CCP is assembled twice, one page apart, and the bytes which differ
+// between the two binaries are those which must be adjusted to run it at
+// a different address, in the same way as the MOVCPM utility of CP/M.
 package ccp
 
 import (
@@ -27,8 +31,12 @@ type Flavour struct {
 	// Bytes contains the raw binary content.
 	Bytes []uint8
 
-	// Origin contains the start/load location of the CCP.
+	// Start contains the address the CCP was assembled for.
 	Start uint16
+
+	// relocations contains the offsets of the bytes in the binary
+	// which hold the high byte of an address within the CCP.
+	relocations []int
 }
 
 var (
@@ -45,23 +53,56 @@ func init() {
 
 	// Load the CCP from DR
 	ccp, _ := ccpFiles.ReadFile("DR.BIN")
+	moved, _ := ccpFiles.ReadFile("DR-DF00.BIN")
 	ccps = append(ccps, Flavour{
 		Name:        "ccp",
 		Description: "CP/M v2.2skx",
 		Start:       0xDE00,
 		Bytes:       ccp,
+		relocations: relocations(ccp, moved),
 	})
 
 	// Load the alternative CCP
 	ccpz, _ := ccpFiles.ReadFile("CCPZ.BIN")
+	moved, _ = ccpFiles.ReadFile("CCPZ-DF00.BIN")
 	ccps = append(ccps, Flavour{
 		Name:        "ccpz",
 		Description: "CCPZ v4.1skx",
 		Start:       0xDE00,
 		Bytes:       ccpz,
+		relocations: relocations(ccpz, moved),
 	})
 }
 
+// relocations returns the offsets at which a CCP differs from the same
+// CCP assembled one page higher.
+func relocations(ccp []uint8, moved []uint8) []int {
+	var offsets []int
+	for i := range ccp {
+		if i < len(moved) && ccp[i] != moved[i] {
+			offsets = append(offsets, i)
+		}
+	}
+	return offsets
+}
+
+// Relocate returns a copy of the CCP binary, adjusted to run at the given
+// address, which must be at the start of a page.
+func (f Flavour) Relocate(start uint16) ([]uint8, error) {
+	if start&0xFF != 0 {
+		return nil, fmt.Errorf("ccp %s can't be relocated to 0x%04X, which isn't the start of a page", f.Name, start)
+	}
+
+	out := make([]uint8, len(f.Bytes))
+	copy(out, f.Bytes)
+
+	delta := uint8((start - f.Start) >> 8)
+	for _, offset := range f.relocations {
+		out[offset] += delta
+	}
+	return out, nil
+}
+
 // GetAll returns the details of all known CCPs we have embedded.
 func GetAll() []Flavour {
 	return ccps
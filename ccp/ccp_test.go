@@ -1,6 +1,7 @@
 package ccp
 
 import (
+	"bytes"
 	"strings"
 	"testing"
 )
@@ -62,3 +63,48 @@ func TestRetrieveAll(t *testing.T) {
 		}
 	}
 }
+
+// TestRelocate tests that our CCPs can be moved to a different page.
+func TestRelocate(t *testing.T) {
+
+	for _, n := range ccps {
+
+		if len(n.relocations) == 0 {
+			t.Fatalf("CCP %s has no relocations", n.Name)
+		}
+
+		// Relocating to the assembled address changes nothing.
+		out, err := n.Relocate(n.Start)
+		if err != nil {
+			t.Fatalf("failed to relocate %s: %s", n.Name, err)
+		}
+		if !bytes.Equal(out, n.Bytes) {
+			t.Fatalf("CCP %s changed when relocated to its own address", n.Name)
+		}
+
+		// Moving down and back again restores the original.
+		out, err = n.Relocate(0xA700)
+		if err != nil {
+			t.Fatalf("failed to relocate %s: %s", n.Name, err)
+		}
+		if bytes.Equal(out, n.Bytes) {
+			t.Fatalf("CCP %s didn't change when relocated", n.Name)
+		}
+		moved := n
+		moved.Bytes = out
+		moved.Start = 0xA700
+		out, err = moved.Relocate(n.Start)
+		if err != nil {
+			t.Fatalf("failed to relocate %s: %s", n.Name, err)
+		}
+		if !bytes.Equal(out, n.Bytes) {
+			t.Fatalf("CCP %s wasn't restored", n.Name)
+		}
+
+		// Only whole pages may be moved.
+		_, err = n.Relocate(0xA780)
+		if err == nil {
+			t.Fatalf("expected an error relocating %s to the middle of a page", n.Name)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Package config handles the loading of configuration files, which allow
+// the emulator to be setup without a long list of command-line flags.
+//
+// The configuration file is a JSON document, for example:
+//
+//	{
+//	  "ccp": "ccpz",
+//	  "console": "ansi",
+//	  "drives": {
+//	    "A": { "path": "." },
+//	    "B": { "path": "docs", "mode": "text" },
+//	    "C": { "path": "zip:games.zip" }
+//	  },
+//	  "printer": { "path": "print.log" },
+//	  "autoexec": [ "C:", "DIR" ],
+//	  "keymap": { "\u001b[A": "\u0005" }
+//	}
+//
+// Most settings correspond to a command-line flag, and flags which are
+// given upon the command-line override the values in the file.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultName is the name of the configuration file we look for, if one
+// wasn't specified.
+const DefaultName = "cpmulator.json"
+
+// Drive describes a single CP/M drive.
+type Drive struct {
+	// Path is the directory, or archive, which holds the contents
+	// of the drive.
+	Path string `json:"path"`
+
+	// Mode is either "binary", the default, or "text" for files to be
+	// opened in text mode.
+	Mode string `json:"mode"`
+}
+
+// Printer describes where printer output is sent.
+type Printer struct {
+	// Path is the file to write printer output to.
+	Path string `json:"path"`
+
+	// Command is a command to pipe printer output to.
+	Command string `json:"command"`
+
+	// Split is true if each page should be written separately.
+	Split bool `json:"split"`
+}
+
+// Aux describes the endpoints used for the auxiliary devices.
+type Aux struct {
+	// In is the endpoint used for auxiliary input.
+	In string `json:"in"`
+
+	// Out is the endpoint used for auxiliary output.
+	Out string `json:"out"`
+}
+
+// Config holds the contents of a configuration file.
+type Config struct {
+	// CCP is the name of the CCP to run.
+	CCP string `json:"ccp"`
+
+	// CPU is the processor to emulate.
+	CPU string `json:"cpu"`
+
+	// ContinueUnimplemented is true if programs calling unimplemented
+	// functions should continue, rather than being stopped.
+	ContinueUnimplemented bool `json:"continue-unimplemented"`
+
+	// Console is the name of the console output driver.
+	Console string `json:"console"`
+
+	// Charset is the translation applied to output characters with
+	// bit 7 set.
+	Charset string `json:"charset"`
+
+	// Directories is true if subdirectories are used for drives.
+	Directories bool `json:"directories"`
+
+	// Drives describes the drives, keyed by letter.
+	Drives map[string]Drive `json:"drives"`
+
+	// Expand is true if squeezed and crunched files within archives
+	// should be expanded.
+	Expand bool `json:"expand"`
+
+	// TextExtensions contains the extensions of files which are opened
+	// in text mode, upon any drive.
+	TextExtensions []string `json:"text-extensions"`
+
+	// MaxOpenFiles is the number of host files which may be open.
+	MaxOpenFiles int `json:"max-open-files"`
+
+	// MHz is the clock rate to limit our speed to.
+	MHz float64 `json:"mhz"`
+
+	// InterruptHz is the rate at which to raise timer interrupts.
+	InterruptHz float64 `json:"interrupt-hz"`
+
+	// BDOS is the address of the BDOS, such as "0xF000".
+	BDOS string `json:"bdos"`
+
+	// BIOS is the address of the BIOS, such as "0xFE00".
+	BIOS string `json:"bios"`
+
+	// Banks is the number of memory banks.
+	Banks int `json:"banks"`
+
+	// Common is the address at which the memory common to all banks
+	// starts, such as "0xC000".
+	Common string `json:"common"`
+
+	// Ports contains the devices to attach to I/O ports, as name@port.
+	Ports []string `json:"ports"`
+
+	// Printer describes where printer output is sent.
+	Printer Printer `json:"printer"`
+
+	// Aux describes the auxiliary devices.
+	Aux Aux `json:"aux"`
+
+	// Autoexec contains commands to run when the CCP starts.
+	Autoexec []string `json:"autoexec"`
+
+	// Keymap contains translations of console input, from the sequence
+	// a key sends to the characters CP/M should see.
+	Keymap map[string]string `json:"keymap"`
+}
+
+// Find returns the path to the configuration file within the given
+// directory, or the empty string if there isn't one.
+func Find(dir string) string {
+	path := filepath.Join(dir, DefaultName)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	return ""
+}
+
+// Load reads the given configuration file.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+
+	// Normalize the drives, and ensure they're valid.
+	drives := make(map[string]Drive)
+	for letter, d := range c.Drives {
+		letter = strings.ToUpper(strings.TrimSuffix(letter, ":"))
+		if len(letter) != 1 || letter[0] < 'A' || letter[0] > 'P' {
+			return nil, fmt.Errorf("invalid drive '%s' in %s", letter, path)
+		}
+		d.Mode = strings.ToLower(d.Mode)
+		if d.Mode != "" && d.Mode != "binary" && d.Mode != "text" {
+			return nil, fmt.Errorf("invalid mode '%s' for drive %s in %s", d.Mode, letter, path)
+		}
+		drives[letter] = d
+	}
+	c.Drives = drives
+
+	return c, nil
+}
+
+// Apply updates the given flags with the values from the configuration,
+// except for those flags which were given upon the command-line.
+func (c *Config) Apply(flags *flag.FlagSet) error {
+
+	// The values for each flag, empty values are ignored.
+	values := map[string]string{
+		"ccp":         c.CCP,
+		"cpu":         c.CPU,
+		"console":     c.Console,
+		"charset":     c.Charset,
+		"text-ext":    strings.Join(c.TextExtensions, ","),
+		"ports":       strings.Join(c.Ports, ","),
+		"common":      c.Common,
+		"bdos":        c.BDOS,
+		"bios":        c.BIOS,
+		"prn-path":    c.Printer.Path,
+		"prn-command": c.Printer.Command,
+		"aux-in":      c.Aux.In,
+		"aux-out":     c.Aux.Out,
+	}
+	if c.Directories {
+		values["directories"] = "true"
+	}
+	if c.ContinueUnimplemented {
+		values["continue-unimplemented"] = "true"
+	}
+	if c.Expand {
+		values["expand"] = "true"
+	}
+	if c.Printer.Split {
+		values["prn-split"] = "true"
+	}
+	if c.MaxOpenFiles != 0 {
+		values["max-open-files"] = strconv.Itoa(c.MaxOpenFiles)
+	}
+	if c.MHz != 0 {
+		values["mhz"] = strconv.FormatFloat(c.MHz, 'g', -1, 64)
+	}
+	if c.Banks != 0 {
+		values["banks"] = strconv.Itoa(c.Banks)
+	}
+	if c.InterruptHz != 0 {
+		values["interrupt-hz"] = strconv.FormatFloat(c.InterruptHz, 'g', -1, 64)
+	}
+
+	var text []string
+	for letter, d := range c.Drives {
+		values["drive-"+strings.ToLower(letter)] = d.Path
+		if d.Mode == "text" {
+			text = append(text, letter)
+		}
+	}
+	values["text-drives"] = strings.Join(text, ",")
+
+	// Find the flags which were given.
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	for name, value := range values {
+		if value == "" || given[name] {
+			continue
+		}
+		err := flags.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("invalid value '%s' for %s: %s", value, name, err)
+		}
+	}
+	return nil
+}
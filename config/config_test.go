@@ -0,0 +1,113 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	if Find(dir) != "" {
+		t.Fatalf("found a configuration file which doesn't exist")
+	}
+
+	path := filepath.Join(dir, DefaultName)
+	err := os.WriteFile(path, []byte(`{
+  "ccp": "ccpz",
+  "console": "ansi",
+  "drives": {
+    "a:": { "path": "." },
+    "B": { "path": "docs", "mode": "TEXT" },
+    "C": { "path": "zip:games.zip" }
+  },
+  "text-extensions": [ "TXT", "ASM" ],
+  "printer": { "path": "print.log", "split": true },
+  "aux": { "in": "tcp:localhost:2000" },
+  "autoexec": [ "C:", "DIR" ],
+  "keymap": { "\u001b[A": "\u0005" }
+}`), 0644)
+	if err != nil {
+		t.Fatalf("failed to write configuration: %s", err)
+	}
+
+	if Find(dir) != path {
+		t.Fatalf("failed to find configuration file")
+	}
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("failed to load configuration: %s", err)
+	}
+	if c.Drives["A"].Path != "." || c.Drives["B"].Mode != "text" {
+		t.Fatalf("drives were not normalized: %v", c.Drives)
+	}
+	if len(c.Autoexec) != 2 || c.Keymap["\x1b[A"] != "\x05" {
+		t.Fatalf("wrong autoexec/keymap")
+	}
+
+	// Setup flags, as our driver does.
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	ccp := flags.String("ccp", "ccp", "")
+	console := flags.String("console", "adm-3a", "")
+	flags.String("charset", "none", "")
+	textExt := flags.String("text-ext", "", "")
+	textDrives := flags.String("text-drives", "", "")
+	prnPath := flags.String("prn-path", "", "")
+	flags.String("prn-command", "", "")
+	prnSplit := flags.Bool("prn-split", false, "")
+	auxIn := flags.String("aux-in", "", "")
+	flags.String("aux-out", "", "")
+	drives := make(map[string]*string)
+	for _, d := range []string{"a", "b", "c"} {
+		drives[d] = flags.String("drive-"+d, "", "")
+	}
+
+	err = flags.Parse([]string{"-ccp", "ccp"})
+	if err != nil {
+		t.Fatalf("failed to parse flags: %s", err)
+	}
+	err = c.Apply(flags)
+	if err != nil {
+		t.Fatalf("failed to apply configuration: %s", err)
+	}
+
+	// The command-line wins.
+	if *ccp != "ccp" {
+		t.Fatalf("configuration overrode the command-line")
+	}
+
+	if *console != "ansi" || *textExt != "TXT,ASM" || *textDrives != "B" ||
+		*prnPath != "print.log" || !*prnSplit || *auxIn != "tcp:localhost:2000" ||
+		*drives["a"] != "." || *drives["b"] != "docs" || *drives["c"] != "zip:games.zip" {
+		t.Fatalf("configuration wasn't applied")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, content := range []string{
+		`not json`,
+		`{ "unknown": true }`,
+		`{ "drives": { "Q": { "path": "." } } }`,
+		`{ "drives": { "A": { "path": ".", "mode": "fast" } } }`,
+	} {
+		path := filepath.Join(dir, DefaultName)
+		err := os.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("failed to write configuration: %s", err)
+		}
+		_, err = Load(path)
+		if err == nil {
+			t.Fatalf("expected error loading %s", content)
+		}
+	}
+
+	_, err := Load(filepath.Join(dir, "missing.json"))
+	if err == nil {
+		t.Fatalf("loaded a missing file")
+	}
+}
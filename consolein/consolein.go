@@ -14,6 +14,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 	"unicode"
 
 	"golang.org/x/term"
@@ -46,8 +47,20 @@ type ConsoleIn struct {
 	InterruptCount int
 
 	// stuffed holds fake input which has been forced into the buffer used
-	// by ReadLine
-	stuffed string
+	// by ReadLine, one entry for each line.
+	stuffed []string
+
+	// keymap contains sequences of input characters, and the characters
+	// they should be replaced with.
+	keymap map[string]string
+
+	// pending holds characters which have been read, and translated via
+	// the keymap, but not yet returned.
+	pending []byte
+
+	// hotkeys contains functions to invoke when the given characters
+	// are read, rather than returning them.
+	hotkeys map[byte]func()
 
 	// history holds previous (line) input.
 	history []string
@@ -63,9 +76,96 @@ func New() *ConsoleIn {
 }
 
 // StuffInput forces input into the buffer which our ReadLine function will
-// return.  It is used solely for the AUTOEXEC.SUB behaviour by our driver.
+// return.  It is used for the AUTOEXEC.SUB behaviour by our driver, and for
+// any commands it is configured to run at startup.
+//
+// Each call adds a line, which will be returned once.
 func (ci *ConsoleIn) StuffInput(text string) {
-	ci.stuffed = text
+	ci.stuffed = append(ci.stuffed, text)
+}
+
+// SetKeymap sets the translations which are applied to input characters.
+//
+// Each key is a sequence of characters, such as the escape sequence sent
+// by a cursor key, which is replaced by the value when it is read.
+func (ci *ConsoleIn) SetKeymap(keymap map[string]string) {
+	ci.keymap = keymap
+}
+
+// SetHotkey causes the given function to be invoked when the given
+// character is read, which is then discarded.
+//
+// Hotkeys are matched after the keymap has been applied.
+func (ci *ConsoleIn) SetHotkey(key byte, fn func()) {
+	if ci.hotkeys == nil {
+		ci.hotkeys = make(map[byte]func())
+	}
+	ci.hotkeys[key] = fn
+}
+
+// fill reads the next key from STDIN, blocking until one is available,
+// and adds the characters it produces to our pending input.
+//
+// The terminal must be in raw mode.
+func (ci *ConsoleIn) fill() error {
+	b := make([]byte, 1)
+	_, err := os.Stdin.Read(b)
+	if err != nil {
+		return err
+	}
+	seq := string(b)
+
+	// Keep reading while we have the start of a sequence in
+	// the keymap, and the rest of it is waiting for us.
+	for ci.isPrefix(seq) && canSelect() {
+		_, err = os.Stdin.Read(b)
+		if err != nil {
+			return err
+		}
+		seq += string(b)
+	}
+
+	if out, ok := ci.keymap[seq]; ok {
+		seq = out
+	}
+
+	for _, c := range []byte(seq) {
+		if fn, ok := ci.hotkeys[c]; ok {
+			fn()
+			continue
+		}
+		ci.pending = append(ci.pending, c)
+	}
+	return nil
+}
+
+// readByte returns the next character of input, after applying the
+// keymap and any hotkeys.
+//
+// The terminal must be in raw mode.
+func (ci *ConsoleIn) readByte() (byte, error) {
+
+	for len(ci.pending) == 0 {
+		err := ci.fill()
+		if err != nil {
+			return 0x00, err
+		}
+	}
+
+	c := ci.pending[0]
+	ci.pending = ci.pending[1:]
+	return c, nil
+}
+
+// isPrefix returns true if the given characters are the start of a longer
+// sequence in our keymap.
+func (ci *ConsoleIn) isPrefix(seq string) bool {
+	for key := range ci.keymap {
+		if len(key) > len(seq) && strings.HasPrefix(key, seq) {
+			return true
+		}
+	}
+	return false
 }
 
 // SetInterruptCount updates the number of consecutive Ctrl-Cs which are necessary
@@ -81,10 +181,24 @@ func (ci *ConsoleIn) GetInterruptCount() int {
 }
 
 // PendingInput returns true if there is pending input from STDIN..
+func (ci *ConsoleIn) PendingInput() bool {
+	return ci.WaitForInput(0)
+}
+
+// WaitForInput returns true if there is pending input from STDIN, waiting
+// for up to the given time for some to arrive.
+//
+// We return as soon as input is available, so this can be used to avoid
+// polling for input in a tight loop.
 //
 // Note that we have to set RAW mode, without this input is laggy
 // and zork doesn't run.
-func (ci *ConsoleIn) PendingInput() bool {
+func (ci *ConsoleIn) WaitForInput(timeout time.Duration) bool {
+
+	// Characters left over from the keymap are ready immediately.
+	if len(ci.pending) > 0 {
+		return true
+	}
 
 	// switch stdin into 'raw' mode
 	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
@@ -94,6 +208,15 @@ func (ci *ConsoleIn) PendingInput() bool {
 
 	// Platform-specific code in select_XXXX.go
 	res := canSelect()
+	if !res && timeout > 0 {
+		res = waitSelect(timeout)
+	}
+
+	// If we have hotkeys then the input might be one, which shouldn't
+	// be reported, so read it now.
+	if res && len(ci.hotkeys) > 0 {
+		res = ci.fill() == nil && len(ci.pending) > 0
+	}
 
 	// restore the state of the terminal to avoid mixing RAW/Cooked
 	err = term.Restore(int(os.Stdin.Fd()), oldState)
@@ -123,8 +246,7 @@ func (ci *ConsoleIn) BlockForCharacterNoEcho() (byte, error) {
 	}
 
 	// read only a single byte
-	b := make([]byte, 1)
-	_, err = os.Stdin.Read(b)
+	b, err := ci.readByte()
 	if err != nil {
 		return 0x00, fmt.Errorf("error reading a byte from stdin %s", err)
 	}
@@ -136,7 +258,7 @@ func (ci *ConsoleIn) BlockForCharacterNoEcho() (byte, error) {
 	}
 
 	// Return the character we read
-	return b[0], nil
+	return b, nil
 }
 
 // BlockForCharacterWithEcho returns the next character from the console,
@@ -157,8 +279,7 @@ func (ci *ConsoleIn) BlockForCharacterWithEcho() (byte, error) {
 	}
 
 	// read only a single byte
-	b := make([]byte, 1)
-	_, err = os.Stdin.Read(b)
+	b, err := ci.readByte()
 	if err != nil {
 		return 0x00, fmt.Errorf("error reading a byte from stdin %s", err)
 	}
@@ -169,8 +290,8 @@ func (ci *ConsoleIn) BlockForCharacterWithEcho() (byte, error) {
 		return 0x00, fmt.Errorf("error restoring terminal state %s", err)
 	}
 
-	fmt.Printf("%c", b[0])
-	return b[0], nil
+	fmt.Printf("%c", b)
+	return b, nil
 }
 
 // ReadLine reads a line of input from the console, truncating to the
@@ -191,8 +312,8 @@ func (ci *ConsoleIn) ReadLine(max uint8) (string, error) {
 
 		// If so return that fake output, and remove it
 		// to ensure it is only processed once.
-		text := ci.stuffed
-		ci.stuffed = ""
+		text := ci.stuffed[0]
+		ci.stuffed = ci.stuffed[1:]
 		return text, nil
 	}
 
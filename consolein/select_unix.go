@@ -4,6 +4,7 @@ package consolein
 
 import (
 	"os"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -11,12 +12,18 @@ import (
 // canSelect contains a platform-specific implementation of code that tries to use
 // SELECT to read from STDIN.
 func canSelect() bool {
+	return waitSelect(200 * time.Microsecond)
+}
+
+// waitSelect uses SELECT to wait for input upon STDIN, for up to the given
+// time, returning true if there is some.
+func waitSelect(timeout time.Duration) bool {
 
 	fds := &unix.FdSet{}
 	fds.Set(int(os.Stdin.Fd()))
 
 	// See if input is pending, for a while.
-	tv := unix.Timeval{Usec: 200}
+	tv := unix.NsecToTimeval(timeout.Nanoseconds())
 
 	// via select with timeout
 	nRead, err := unix.Select(1, fds, nil, nil, &tv)
@@ -0,0 +1,133 @@
+package consoleout
+
+import (
+	"sort"
+	"unicode/utf8"
+)
+
+// Charset describes how characters with bit 7 set should be translated
+// before they are sent to the console.
+//
+// Several CP/M programs set the high bit of characters to request inverse
+// video, or to display graphical glyphs.  Sending those bytes to a modern
+// terminal, untranslated, results in garbage, so we allow the user to pick
+// a translation which matches the machine the software was written for.
+type Charset struct {
+	// Name has the name of the translation.
+	//
+	// NOTE: This name is visible to end-users, and will be used in the
+	// "-charset" command-line flag.
+	Name string
+
+	// Description has a human-readable description of the translation.
+	Description string
+
+	// Translate converts the given character, which will have bit 7
+	// set, into the bytes which should be sent to the console driver.
+	Translate func(c uint8) []uint8
+}
+
+// charsets contains the translations we know about, indexed by name.
+var charsets = map[string]Charset{
+	"none": {
+		Name:        "none",
+		Description: "Output characters with bit 7 set unchanged",
+		Translate: func(c uint8) []uint8 {
+			return []uint8{c}
+		},
+	},
+	"strip": {
+		Name:        "strip",
+		Description: "Remove bit 7, showing the plain ASCII character",
+		Translate: func(c uint8) []uint8 {
+			return []uint8{c & 0x7F}
+		},
+	},
+	"reverse": {
+		Name:        "reverse",
+		Description: "Remove bit 7, showing the ASCII character in reverse video",
+		Translate: func(c uint8) []uint8 {
+			return []uint8{0x1B, '[', '7', 'm', c & 0x7F, 0x1B, '[', '2', '7', 'm'}
+		},
+	},
+	"cp437": {
+		Name:        "cp437",
+		Description: "IBM PC code page 437, with box-drawing characters",
+		Translate: func(c uint8) []uint8 {
+			return utf8.AppendRune(nil, cp437[c&0x7F])
+		},
+	},
+	"kaypro": {
+		Name:        "kaypro",
+		Description: "Kaypro 2x3 block graphics, from the low six bits",
+		Translate: func(c uint8) []uint8 {
+			return utf8.AppendRune(nil, sextant(c&0x3F))
+		},
+	},
+}
+
+// cp437 contains the upper half of the IBM PC character set.
+var cp437 = [128]rune{
+	0x00C7, 0x00FC, 0x00E9, 0x00E2, 0x00E4, 0x00E0, 0x00E5, 0x00E7,
+	0x00EA, 0x00EB, 0x00E8, 0x00EF, 0x00EE, 0x00EC, 0x00C4, 0x00C5,
+	0x00C9, 0x00E6, 0x00C6, 0x00F4, 0x00F6, 0x00F2, 0x00FB, 0x00F9,
+	0x00FF, 0x00D6, 0x00DC, 0x00A2, 0x00A3, 0x00A5, 0x20A7, 0x0192,
+	0x00E1, 0x00ED, 0x00F3, 0x00FA, 0x00F1, 0x00D1, 0x00AA, 0x00BA,
+	0x00BF, 0x2310, 0x00AC, 0x00BD, 0x00BC, 0x00A1, 0x00AB, 0x00BB,
+	0x2591, 0x2592, 0x2593, 0x2502, 0x2524, 0x2561, 0x2562, 0x2556,
+	0x2555, 0x2563, 0x2551, 0x2557, 0x255D, 0x255C, 0x255B, 0x2510,
+	0x2514, 0x2534, 0x252C, 0x251C, 0x2500, 0x253C, 0x255E, 0x255F,
+	0x255A, 0x2554, 0x2569, 0x2566, 0x2560, 0x2550, 0x256C, 0x2567,
+	0x2568, 0x2564, 0x2565, 0x2559, 0x2558, 0x2552, 0x2553, 0x256B,
+	0x256A, 0x2518, 0x250C, 0x2588, 0x2584, 0x258C, 0x2590, 0x2580,
+	0x03B1, 0x00DF, 0x0393, 0x03C0, 0x03A3, 0x03C3, 0x00B5, 0x03C4,
+	0x03A6, 0x0398, 0x03A9, 0x03B4, 0x221E, 0x03C6, 0x03B5, 0x2229,
+	0x2261, 0x00B1, 0x2265, 0x2264, 0x2320, 0x2321, 0x00F7, 0x2248,
+	0x00B0, 0x2219, 0x00B7, 0x221A, 0x207F, 0x00B2, 0x25A0, 0x00A0,
+}
+
+// sextant returns the Unicode block graphic for a 2x3 grid of pixels.
+//
+// Bit 0 is the top-left pixel, bit 1 the top-right, and so on down to
+// bit 5 which is the bottom-right pixel.  Unicode has a block of "sextant"
+// characters for most patterns, but the empty, full, and half-filled
+// patterns already existed and so were left out of it.
+func sextant(bits uint8) rune {
+	switch bits {
+	case 0x00:
+		return ' '
+	case 0x15:
+		return 0x258C /* left half block */
+	case 0x2A:
+		return 0x2590 /* right half block */
+	case 0x3F:
+		return 0x2588 /* full block */
+	}
+
+	// Skip the three patterns which are missing from the range.
+	offset := rune(bits) - 1
+	if bits > 0x15 {
+		offset--
+	}
+	if bits > 0x2A {
+		offset--
+	}
+	return 0x1FB00 + offset
+}
+
+// GetCharsets returns the names of all available translations, sorted.
+func GetCharsets() []string {
+	valid := []string{}
+
+	for x := range charsets {
+		valid = append(valid, x)
+	}
+	sort.Strings(valid)
+	return valid
+}
+
+// GetCharset returns the translation with the given name, if it exists.
+func GetCharset(name string) (Charset, bool) {
+	cs, ok := charsets[name]
+	return cs, ok
+}
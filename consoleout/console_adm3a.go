@@ -60,7 +60,9 @@ func (a3a *Adm3AOutputDriver) PutCharacter(c uint8) {
 		case 0x12, 0x13:
 			// nop
 		default:
-			fmt.Fprintf(a3a.writer, "%c", c)
+			// Written as a byte, so that UTF-8 from our
+			// charset translation is passed through intact.
+			_, _ = a3a.writer.Write([]byte{c})
 		}
 	case 1: /* we had an esc-prefix */
 		switch c {
@@ -1,7 +1,6 @@
 package consoleout
 
 import (
-	"fmt"
 	"io"
 	"os"
 )
@@ -23,7 +22,7 @@ func (ad *AnsiOutputDriver) GetName() string {
 //
 // This is part of the OutputDriver interface.
 func (ad *AnsiOutputDriver) PutCharacter(c uint8) {
-	fmt.Fprintf(ad.writer, "%c", c)
+	_, _ = ad.writer.Write([]byte{c})
 }
 
 // SetWriter will update the writer.
@@ -0,0 +1,120 @@
+package consoleout
+
+import (
+	"io"
+)
+
+// TeeOutputDriver is a wrapper which passes each character to another
+// driver, while also writing a transcript of the output to a second
+// writer.
+//
+// The transcript may either be the raw bytes the CP/M program produced,
+// or plain text with the terminal escape-sequences and control-characters
+// stripped out.
+type TeeOutputDriver struct {
+
+	// driver is the real driver which produces our console output.
+	driver ConsoleDriver
+
+	// transcript is where we write our copy of the output.
+	transcript io.Writer
+
+	// plain is true if we should strip escape-sequences from the transcript.
+	plain bool
+
+	// status contains our state, in the escape-stripping state-machine
+	status int
+
+	// skip is the number of argument bytes of an escape-sequence which
+	// remain to be dropped.
+	skip int
+}
+
+// NewTee returns a driver which will send output to the given driver,
+// and also write a transcript to the specified writer.
+func NewTee(driver ConsoleDriver, transcript io.Writer, plain bool) *TeeOutputDriver {
+	return &TeeOutputDriver{
+		driver:     driver,
+		transcript: transcript,
+		plain:      plain,
+	}
+}
+
+// GetName returns the name of this driver, which is the name of the
+// driver we're wrapping.
+//
+// This is part of the OutputDriver interface.
+func (t *TeeOutputDriver) GetName() string {
+	return t.driver.GetName()
+}
+
+// PutCharacter writes the character to the wrapped driver, and to
+// our transcript.
+//
+// This is part of the OutputDriver interface.
+func (t *TeeOutputDriver) PutCharacter(c uint8) {
+	t.driver.PutCharacter(c)
+	t.record(c)
+}
+
+// record writes the character to our transcript, stripping
+// escape-sequences if we're producing a plain transcript.
+func (t *TeeOutputDriver) record(c uint8) {
+
+	if !t.plain {
+		_, _ = t.transcript.Write([]byte{c})
+		return
+	}
+
+	// Skip the arguments of an escape-sequence.
+	if t.skip > 0 {
+		t.skip--
+		return
+	}
+
+	switch t.status {
+	case 0:
+		switch c {
+		case 0x1B: /* esc-prefix */
+			t.status = 1
+		case 0x01: /* adm-3a cursor motion: row & column follow */
+			t.skip = 2
+		case '\t', '\n':
+			_, _ = t.transcript.Write([]byte{c})
+		default:
+			// Drop control-characters, and DEL.
+			//
+			// Characters with bit 7 set are kept, as they
+			// will be UTF-8 from our charset translation.
+			if c >= ' ' && c != 0x7F {
+				_, _ = t.transcript.Write([]byte{c})
+			}
+		}
+	case 1: /* we had an esc-prefix */
+		t.status = 0
+		switch c {
+		case 0x1B: /* escaped esc, another sequence follows */
+			t.status = 1
+		case '[': /* ANSI CSI sequence */
+			t.status = 2
+		case '=', 'Y': /* cursor motion: row & column follow */
+			t.skip = 2
+		case 'B', 'C': /* attribute on/off: attribute follows */
+			t.skip = 1
+		case 'L', 'D': /* set/clear line: two coordinates follow */
+			t.skip = 4
+		case '*', ' ': /* set/clear pixel: a coordinate follows */
+			t.skip = 2
+		}
+	case 2:
+		// CSI sequences end with a byte in the range 0x40-0x7E
+		if c >= 0x40 && c <= 0x7E {
+			t.status = 0
+		}
+	}
+}
+
+// SetWriter will update the writer of the wrapped driver.
+func (t *TeeOutputDriver) SetWriter(w io.Writer) {
+	t.driver.SetWriter(w)
+}
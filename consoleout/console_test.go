@@ -119,3 +119,221 @@ func TestList(t *testing.T) {
 		t.Fatalf("unexpected number of console drivers")
 	}
 }
+
+// TestTee ensures that a transcript is written, in both raw and plain modes.
+func TestTee(t *testing.T) {
+
+	type testcase struct {
+		input string
+		plain bool
+		want  string
+	}
+
+	tests := []testcase{
+		{input: "Steve Kemp", plain: false, want: "Steve Kemp"},
+		{input: "\x1b[7mZork\x1b[0m\r\n", plain: false, want: "\x1b[7mZork\x1b[0m\r\n"},
+		{input: "\x1b[7mZork\x1b[0m\r\n", plain: true, want: "Zork\n"},
+		{input: "\x1b=  >\x1a\x1bB0Zork\x1bC0", plain: true, want: ">Zork"},
+	}
+
+	for _, test := range tests {
+
+		d, err := New("ansi")
+		if err != nil {
+			t.Fatalf("failed to load starting driver %s", err)
+		}
+
+		// ensure we redirect the output
+		screen := &bytes.Buffer{}
+		d.driver.SetWriter(screen)
+
+		// setup the transcript
+		transcript := &bytes.Buffer{}
+		d.SetTranscript(transcript, test.plain)
+
+		// The name should be unchanged
+		if d.GetName() != "ansi" {
+			t.Fatalf("tee driver changed the name to %s", d.GetName())
+		}
+
+		for _, c := range test.input {
+			d.PutCharacter(byte(c))
+		}
+
+		if screen.String() != test.input {
+			t.Fatalf("screen output was '%s'", screen.String())
+		}
+		if transcript.String() != test.want {
+			t.Fatalf("transcript was %q, expected %q", transcript.String(), test.want)
+		}
+
+		// Changing the driver should keep the transcript.
+		err = d.ChangeDriver("null")
+		if err != nil {
+			t.Fatalf("failed to change driver %s", err)
+		}
+		d.PutCharacter('!')
+		if transcript.String() != test.want+"!" {
+			t.Fatalf("transcript was lost after changing driver")
+		}
+	}
+}
+
+// TestTeeADM3A ensures that the arguments of the ADM-3A escape-sequences
+// don't appear within a plain transcript.
+func TestTeeADM3A(t *testing.T) {
+
+	type testcase struct {
+		input string
+		want  string
+	}
+
+	tests := []testcase{
+		// cursor motion, via ^A, ESC = and ESC Y
+		{input: "\x01  A\x1b=!!B\x1bY\"\"C", want: "ABC"},
+		// attributes on and off
+		{input: "\x1bB0Zork\x1bC0\x1bB4!", want: "Zork!"},
+		// insert and delete line
+		{input: "\x1bEone\x1bRtwo", want: "onetwo"},
+		// set and clear line
+		{input: "\x1bL    a\x1bD!!!!b", want: "ab"},
+		// set and clear pixel
+		{input: "\x1b*  c\x1b !!d", want: "cd"},
+		// escaped escape
+		{input: "\x1b\x1b=  e", want: "e"},
+	}
+
+	for _, test := range tests {
+
+		d, err := New("adm-3a")
+		if err != nil {
+			t.Fatalf("failed to load starting driver %s", err)
+		}
+		d.driver.SetWriter(&bytes.Buffer{})
+
+		transcript := &bytes.Buffer{}
+		d.SetTranscript(transcript, true)
+
+		for _, c := range []byte(test.input) {
+			d.PutCharacter(c)
+		}
+
+		if transcript.String() != test.want {
+			t.Fatalf("transcript was %q, expected %q", transcript.String(), test.want)
+		}
+	}
+}
+
+// TestTeeCharset ensures that a raw transcript contains the bytes the
+// program produced, while a plain one contains the translated text.
+func TestTeeCharset(t *testing.T) {
+
+	type testcase struct {
+		plain bool
+		want  string
+	}
+
+	tests := []testcase{
+		{plain: false, want: "A\xC9\xCD\xBB"},
+		{plain: true, want: "A╔═╗"},
+	}
+
+	for _, test := range tests {
+
+		d, err := New("ansi")
+		if err != nil {
+			t.Fatalf("failed to load starting driver %s", err)
+		}
+		err = d.SetCharset("cp437")
+		if err != nil {
+			t.Fatalf("failed to set charset %s", err)
+		}
+
+		screen := &bytes.Buffer{}
+		d.driver.SetWriter(screen)
+
+		transcript := &bytes.Buffer{}
+		d.SetTranscript(transcript, test.plain)
+
+		for _, c := range []byte{'A', 0xC9, 0xCD, 0xBB} {
+			d.PutCharacter(c)
+		}
+
+		if screen.String() != "A╔═╗" {
+			t.Fatalf("screen output was %q", screen.String())
+		}
+		if transcript.String() != test.want {
+			t.Fatalf("transcript was %q, expected %q", transcript.String(), test.want)
+		}
+	}
+}
+
+// TestCharset ensures that characters with bit 7 set are translated.
+func TestCharset(t *testing.T) {
+
+	type testcase struct {
+		charset string
+		input   []byte
+		want    string
+	}
+
+	tests := []testcase{
+		{charset: "none", input: []byte{'A', 0xC1}, want: "A\xC1"},
+		{charset: "strip", input: []byte{'A', 0xC1}, want: "AA"},
+		{charset: "reverse", input: []byte{'A', 0xC1}, want: "A\x1b[7mA\x1b[27m"},
+		{charset: "cp437", input: []byte{0xC9, 0xCD, 0xBB}, want: "╔═╗"},
+		{charset: "kaypro", input: []byte{0x80, 0x81, 0x95, 0xAA, 0xBF}, want: " 🬀▌▐█"},
+	}
+
+	for _, test := range tests {
+
+		for _, driver := range []string{"ansi", "adm-3a"} {
+			d, err := New(driver)
+			if err != nil {
+				t.Fatalf("failed to load driver %s", err)
+			}
+
+			tmp := &bytes.Buffer{}
+			d.driver.SetWriter(tmp)
+
+			err = d.SetCharset(test.charset)
+			if err != nil {
+				t.Fatalf("failed to set charset %s: %s", test.charset, err)
+			}
+			if d.GetCharset() != test.charset {
+				t.Fatalf("charset name mismatch %s != %s", d.GetCharset(), test.charset)
+			}
+
+			for _, c := range test.input {
+				d.PutCharacter(c)
+			}
+
+			if tmp.String() != test.want {
+				t.Fatalf("%s/%s: got %q, expected %q", driver, test.charset, tmp.String(), test.want)
+			}
+		}
+	}
+
+	// A bogus charset should fail
+	d, _ := New("ansi")
+	err := d.SetCharset("steve")
+	if err == nil {
+		t.Fatalf("expected error setting bogus charset")
+	}
+	if d.GetCharset() != "none" {
+		t.Fatalf("charset changed unexpectedly")
+	}
+
+	// Every sextant should be distinct
+	seen := make(map[rune]bool)
+	for i := 0; i < 64; i++ {
+		r := sextant(uint8(i))
+		if seen[r] {
+			t.Fatalf("duplicate sextant for %02X", i)
+		}
+		seen[r] = true
+	}
+	if sextant(0x3E) != 0x1FB3B {
+		t.Fatalf("last sextant is wrong: %X", sextant(0x3E))
+	}
+}
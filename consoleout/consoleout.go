@@ -50,6 +50,9 @@ type ConsoleOut struct {
 
 	// driver is the thing that actually writes our output.
 	driver ConsoleDriver
+
+	// charset is used to translate characters which have bit 7 set.
+	charset Charset
 }
 
 // New is our constructore, it creates an output device which uses
@@ -64,7 +67,8 @@ func New(name string) (*ConsoleOut, error) {
 
 	// OK we do, return ourselves with that driver.
 	return &ConsoleOut{
-		driver: ctor(),
+		driver:  ctor(),
+		charset: charsets["none"],
 	}, nil
 }
 
@@ -77,11 +81,33 @@ func (co *ConsoleOut) ChangeDriver(name string) error {
 		return fmt.Errorf("failed to lookup driver by name '%s'", name)
 	}
 
+	// If we're writing a transcript then keep doing so, by
+	// changing the driver we wrap, rather than replacing ourselves.
+	if tee, ok := co.driver.(*TeeOutputDriver); ok {
+		tee.driver = ctor()
+		return nil
+	}
+
 	// change the driver by creating a new object
 	co.driver = ctor()
 	return nil
 }
 
+// SetTranscript causes a copy of all future output to be written to the
+// given writer, in addition to being displayed by our selected driver.
+//
+// If plain is true then escape-sequences and control-characters are
+// removed from the transcript, otherwise the raw bytes are written.
+func (co *ConsoleOut) SetTranscript(w io.Writer, plain bool) {
+
+	// Replace any existing transcript.
+	if tee, ok := co.driver.(*TeeOutputDriver); ok {
+		co.driver = tee.driver
+	}
+
+	co.driver = NewTee(co.driver, w, plain)
+}
+
 // GetName returns the name of our selected driver.
 func (co *ConsoleOut) GetName() string {
 	return co.driver.GetName()
@@ -101,7 +127,42 @@ func (co *ConsoleOut) GetDrivers() []string {
 	return valid
 }
 
+// SetCharset changes the translation which is applied to characters
+// which have bit 7 set.
+func (co *ConsoleOut) SetCharset(name string) error {
+
+	cs, ok := GetCharset(name)
+	if !ok {
+		return fmt.Errorf("failed to lookup charset by name '%s'", name)
+	}
+
+	co.charset = cs
+	return nil
+}
+
+// GetCharset returns the name of the translation applied to characters
+// which have bit 7 set.
+func (co *ConsoleOut) GetCharset() string {
+	return co.charset.Name
+}
+
 // PutCharacter outputs a character, using our selected driver.
+//
+// Characters with bit 7 set are translated via our charset first,
+// though a raw transcript records the byte the program produced.
 func (co *ConsoleOut) PutCharacter(c byte) {
-	co.driver.PutCharacter(c)
+	if c < 0x80 {
+		co.driver.PutCharacter(c)
+		return
+	}
+
+	driver := co.driver
+	if tee, ok := driver.(*TeeOutputDriver); ok && !tee.plain {
+		tee.record(c)
+		driver = tee.driver
+	}
+
+	for _, x := range co.charset.Translate(c) {
+		driver.PutCharacter(x)
+	}
 }
@@ -0,0 +1,35 @@
+package cpm
+
+import "fmt"
+
+// auxRead reads a single character from the auxiliary input device,
+// blocking until one is available.
+//
+// If no auxiliary input device has been configured we read from the
+// console instead, as we've always done.
+func (cpm *CPM) auxRead() (uint8, error) {
+
+	if cpm.auxIn != nil {
+		return cpm.auxIn.ReadByte()
+	}
+
+	c, err := cpm.input.BlockForCharacterNoEcho()
+	if err != nil {
+		return 0x00, fmt.Errorf("error in call to BlockForCharacterNoEcho: %s", err)
+	}
+	return c, nil
+}
+
+// auxWrite writes a single character to the auxiliary output device.
+//
+// If no auxiliary output device has been configured we write to the
+// console instead, as we've always done.
+func (cpm *CPM) auxWrite(c uint8) error {
+
+	if cpm.auxOut != nil {
+		return cpm.auxOut.WriteByte(c)
+	}
+
+	cpm.output.PutCharacter(c)
+	return nil
+}
@@ -11,17 +11,21 @@ import (
 	"embed"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/koron-go/z80"
+	"github.com/skx/cpmulator/auxio"
 	"github.com/skx/cpmulator/ccp"
 	"github.com/skx/cpmulator/consolein"
 	"github.com/skx/cpmulator/consoleout"
 	"github.com/skx/cpmulator/fcb"
 	"github.com/skx/cpmulator/memory"
+	"github.com/skx/cpmulator/ports"
+	"github.com/skx/cpmulator/printer"
 )
 
 var (
@@ -86,17 +90,6 @@ type CPMHandler struct {
 	Noisy bool
 }
 
-// FileCache is used to cache filehandles on the host-side of the system,
-// which have been opened by the CP/M binary/CCP.
-type FileCache struct {
-	// name holds the name of the file, when it was opened/created,
-	// on the host-side.
-	name string
-
-	// handle has the file handle of the opened file.
-	handle *os.File
-}
-
 // CPM is the object that holds our emulator state.
 type CPM struct {
 
@@ -111,12 +104,100 @@ type CPM struct {
 	ccp string
 
 	// files is the cache we use for File handles.
-	files map[uint16]FileCache
+	files map[fileKey]*FileCache
+
+	// lastFileID is the id most recently given to an open file.
+	lastFileID uint16
+
+	// maxOpenFiles is the number of host files which may be open at
+	// the same time.
+	maxOpenFiles int
 
 	// virtual contains a reference to a static filesystem which
 	// is embedded within our binary, if any.
 	static embed.FS
 
+	// mounts contains the archives which are mounted as read-only
+	// drives, keyed by drive letter.
+	mounts map[string]fs.FS
+
+	// idle is used to detect programs which are polling for input.
+	idle idle
+
+	// clock is used to limit the speed at which we run, if configured.
+	clock throttle
+
+	// cpu8080 is true if we should behave as an 8080, rather than a Z80.
+	cpu8080 bool
+
+	// bdosAddr is the address of our fake BDOS.
+	bdosAddr uint16
+
+	// biosAddr is the address of our fake BIOS.
+	biosAddr uint16
+
+	// banks is the number of memory banks we have.
+	banks int
+
+	// common is the address at which memory common to all banks starts.
+	common uint16
+
+	// xmove holds the banks which the next BIOS MOVE copies between.
+	xmove struct {
+		set bool
+		src int
+		dst int
+	}
+
+	// protectMemory is true if programs should be stopped when they
+	// write to the memory reserved for our BIOS and BDOS.
+	protectMemory bool
+
+	// running is true while a program is being executed.
+	running bool
+
+	// instructionPC is the address of the instruction being executed.
+	instructionPC uint16
+
+	// program is the name of the program we're running, for crash
+	// reports.
+	program string
+
+	// recent contains the most recent syscalls, for crash reports,
+	// and recentNext is the number which have been made.
+	recent     [recentSyscalls]syscallRecord
+	recentNext int
+
+	// crashPath is the file to write crash reports to, if any.
+	crashPath string
+
+	// crashMemory is true if crash reports should contain the
+	// contents of memory.
+	crashMemory bool
+
+	// continueUnimplemented is true if programs calling unimplemented
+	// syscalls should continue, with unimplementedValue returned to them,
+	// rather than being stopped.
+	continueUnimplemented bool
+	unimplementedValue    uint8
+
+	// missing records the unimplemented syscalls which were called, and
+	// where from.
+	missing map[missingCall]missingCallers
+
+	// irq holds the state of our interrupt sources.
+	irq interrupts
+
+	// ports holds the devices attached to our I/O ports.
+	ports ports.Bus
+
+	// autoExec contains the commands to run when the CCP starts.
+	autoExec []string
+
+	// expandArchives is true if squeezed and crunched files within
+	// mounted archives should be expanded.
+	expandArchives bool
+
 	// input is our interface for reading from the console.
 	//
 	// This needs to take account of echo/no-echo status.
@@ -125,6 +206,25 @@ type CPM struct {
 	// output is used for writing characters to the console.
 	output *consoleout.ConsoleOut
 
+	// charset contains the name of the translation to apply to
+	// characters output with bit 7 set.
+	charset string
+
+	// transcriptPath contains the filename to write a transcript of
+	// all console output to, if any.
+	transcriptPath string
+
+	// transcriptPlain is true if the transcript should have escape
+	// sequences removed, rather than containing the raw output.
+	transcriptPlain bool
+
+	// transcript holds the handle to our transcript file, if any.
+	transcript *os.File
+
+	// ioByte contains the value of the IOBYTE, which is stored in RAM
+	// at 0x0003.  We keep a copy so that it survives a warm boot.
+	ioByte uint8
+
 	// dma contains the address of the DMA area in RAM.
 	//
 	// The DMA area is used for all file I/O, and is 128 bytes in length.
@@ -133,6 +233,30 @@ type CPM struct {
 	// prnPath contains the filename to write all printer-output to.
 	prnPath string
 
+	// prnCommand contains a command to pipe printer-output to, if any.
+	prnCommand string
+
+	// prnSplit is true if printer-output should be split into a
+	// distinct file for each page.
+	prnSplit bool
+
+	// printer is the device which receives our printer-output.
+	printer *printer.Printer
+
+	// auxInSpec describes the endpoint to use for auxiliary input,
+	// if this is empty the console is used instead.
+	auxInSpec string
+
+	// auxOutSpec describes the endpoint to use for auxiliary output,
+	// if this is empty the console is used instead.
+	auxOutSpec string
+
+	// auxIn is the device used for auxiliary (reader) input, if any.
+	auxIn *auxio.Device
+
+	// auxOut is the device used for auxiliary (punch) output, if any.
+	auxOut *auxio.Device
+
 	// start contains the location to which we load our binaries,
 	// and execute them from.  This is specifically a variable because
 	// while all CP/M binaries are loaded at 0x0100 the CCP we can
@@ -171,16 +295,27 @@ type CPM struct {
 	// Valid values are 0-15.
 	userNumber uint8
 
-	// findFirstResults is a sneaky cache of files that match a glob.
+	// textDrives contains the letters of the drives upon which files are
+	// opened in text mode.
+	textDrives string
+
+	// textExtensions contains the (upper-cased) file extensions of the
+	// files which are opened in text mode.
+	textExtensions []string
+
+	// findEntries is a sneaky cache of the directory entries that match a glob.
 	//
 	// For finding files CP/M uses "find first" to find the first result
 	// then allows the programmer to call "find next", to continue the searching.
 	//
 	// This means we need to track state, the way we do this is to store the
 	// results here, and bump the findOffset each time find-next is called.
-	findFirstResults []fcb.FCBFind
+	//
+	// Each entry is a 32-byte directory entry, and files larger than 16K
+	// will have one entry for each extent.
+	findEntries []fcb.FCB
 
-	// findOffset contains the index into findFirstResults which is
+	// findOffset contains the index into findEntries which is
 	// to be read next.
 	findOffset int
 
@@ -213,6 +348,283 @@ func WithPrinterPath(path string) cpmoption {
 	}
 }
 
+// WithPrinterCommand allows printer output to be piped to the given
+// command, rather than written to a file.
+func WithPrinterCommand(command string) cpmoption {
+	return func(c *CPM) error {
+		c.prnCommand = command
+		return nil
+	}
+}
+
+// WithPrinterPageSplit allows printer output to be split into a distinct
+// numbered file, or command invocation, for each page.
+func WithPrinterPageSplit(split bool) cpmoption {
+	return func(c *CPM) error {
+		c.prnSplit = split
+		return nil
+	}
+}
+
+// WithAuxInput allows the auxiliary (reader) input device to be set in our
+// constructor.  See the auxio package for the format of the endpoint.
+func WithAuxInput(spec string) cpmoption {
+	return func(c *CPM) error {
+		c.auxInSpec = spec
+		return nil
+	}
+}
+
+// WithAuxOutput allows the auxiliary (punch) output device to be set in our
+// constructor.  See the auxio package for the format of the endpoint.
+func WithAuxOutput(spec string) cpmoption {
+	return func(c *CPM) error {
+		c.auxOutSpec = spec
+		return nil
+	}
+}
+
+// WithCharset allows the translation applied to characters with bit 7 set
+// to be changed in our constructor.
+func WithCharset(name string) cpmoption {
+	return func(c *CPM) error {
+		c.charset = name
+		return nil
+	}
+}
+
+// WithTranscript allows a transcript of all console output to be written
+// to the given file, either as raw bytes or as plain text.
+func WithTranscript(path string, plain bool) cpmoption {
+	return func(c *CPM) error {
+		c.transcriptPath = path
+		c.transcriptPlain = plain
+		return nil
+	}
+}
+
+// WithMHz limits the speed at which we execute instructions to that of a
+// processor with the given clock rate, in MHz.  Zero, the default, means
+// there is no limit.
+func WithMHz(mhz float64) cpmoption {
+	return func(c *CPM) error {
+		if mhz < 0 {
+			return fmt.Errorf("invalid clock rate %g", mhz)
+		}
+		c.clock.mhz = mhz
+		return nil
+	}
+}
+
+// WithCPU sets the processor we emulate, either "z80", the default, or
+// "8080".
+//
+// When emulating an 8080 the Z80-only instructions are refused, and the
+// flags behave as they do upon the 8080.
+func WithCPU(name string) cpmoption {
+	return func(c *CPM) error {
+		switch strings.ToLower(name) {
+		case "", "z80":
+			c.cpu8080 = false
+		case "8080":
+			c.cpu8080 = true
+		default:
+			return fmt.Errorf("unknown CPU '%s', valid choices are z80 and 8080", name)
+		}
+		return nil
+	}
+}
+
+// WithMemoryLayout sets the addresses of our fake BDOS, which marks the
+// top of the TPA, and our fake BIOS.
+//
+// The BIOS must be above the BDOS, and leave room for a stack above it.
+func WithMemoryLayout(bdos, bios uint16) cpmoption {
+	return func(c *CPM) error {
+		if bdos < 0x0200 {
+			return fmt.Errorf("invalid BDOS address 0x%04X, the TPA would be too small", bdos)
+		}
+		if int(bdos)+bdosSize > int(bios) {
+			return fmt.Errorf("invalid BIOS address 0x%04X, it must be at least 0x%04X", bios, int(bdos)+bdosSize)
+		}
+		if int(bios)+biosSize > 0x10000-stackSize {
+			return fmt.Errorf("invalid BIOS address 0x%04X, it must be no higher than 0x%04X", bios, 0x10000-stackSize-biosSize)
+		}
+		c.bdosAddr = bdos
+		c.biosAddr = bios
+		return nil
+	}
+}
+
+// WithBanks splits our memory into the given number of banks, for the
+// BIOS SELMEM, MOVE, and XMOVE functions.  The memory from the common
+// address upwards is shared by all banks, and must include our BDOS and
+// BIOS.
+//
+// The common address is checked against our memory layout once all our
+// options have been applied.
+func WithBanks(count int, common uint16) cpmoption {
+	return func(c *CPM) error {
+		if count < 1 || count > 256 {
+			return fmt.Errorf("invalid number of memory banks %d", count)
+		}
+		if count > 1 && common == 0 {
+			return fmt.Errorf("banked memory requires a common area")
+		}
+		c.banks = count
+		c.common = common
+		return nil
+	}
+}
+
+// WithMemoryProtection causes programs to be stopped, with an error, if
+// they write to the memory which contains our BIOS and BDOS.
+func WithMemoryProtection(enabled bool) cpmoption {
+	return func(c *CPM) error {
+		c.protectMemory = enabled
+		return nil
+	}
+}
+
+// WithCrashReport sets the file which WriteCrashReport will write to, and
+// whether the report should include the contents of memory.
+func WithCrashReport(path string, includeMemory bool) cpmoption {
+	return func(c *CPM) error {
+		c.crashPath = path
+		c.crashMemory = includeMemory
+		return nil
+	}
+}
+
+// WithContinueUnimplemented causes programs which call unimplemented BDOS
+// or BIOS functions to continue, with the given value returned to them,
+// rather than being stopped with ErrUnimplemented.
+func WithContinueUnimplemented(enabled bool, value uint8) cpmoption {
+	return func(c *CPM) error {
+		c.continueUnimplemented = enabled
+		c.unimplementedValue = value
+		return nil
+	}
+}
+
+// WithInterruptTimer causes a maskable interrupt to be raised the given
+// number of times a second, with the given value upon the data bus.  Zero,
+// the default, disables the timer.
+func WithInterruptTimer(hz float64, vector uint8) cpmoption {
+	return func(c *CPM) error {
+		if hz < 0 {
+			return fmt.Errorf("invalid interrupt rate %g", hz)
+		}
+		c.irq.hz = hz
+		c.irq.vector = vector
+		return nil
+	}
+}
+
+// WithPorts attaches built-in devices to our I/O ports, given as a
+// comma-separated list of name@port, such as "rtc@0x80,random@0x90".
+func WithPorts(devices string) cpmoption {
+	return func(c *CPM) error {
+		for _, spec := range strings.Split(devices, ",") {
+			if strings.TrimSpace(spec) == "" {
+				continue
+			}
+			first, last, dev, err := ports.Parse(spec)
+			if err != nil {
+				return err
+			}
+			err = c.RegisterPorts(first, last, dev)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// WithIdle allows disabling our detection of programs which are polling
+// for console input, in which case we'll not wait for input to arrive.
+func WithIdle(enabled bool) cpmoption {
+	return func(c *CPM) error {
+		c.idle.disabled = !enabled
+		return nil
+	}
+}
+
+// WithAutoExec sets commands which will be entered into the CCP when it
+// starts, after any A:AUTOEXEC.SUB has been processed.
+func WithAutoExec(commands []string) cpmoption {
+	return func(c *CPM) error {
+		c.autoExec = commands
+		return nil
+	}
+}
+
+// WithKeymap sets translations which are applied to console input, for
+// example to turn the escape sequences sent by cursor keys into the
+// control characters a CP/M program expects.
+func WithKeymap(keymap map[string]string) cpmoption {
+	return func(c *CPM) error {
+		c.input.SetKeymap(keymap)
+		return nil
+	}
+}
+
+// WithExpandArchives causes squeezed and crunched files, within archives
+// mounted as drives, to be expanded when the archive is mounted.
+func WithExpandArchives(expand bool) cpmoption {
+	return func(c *CPM) error {
+		c.expandArchives = expand
+		return nil
+	}
+}
+
+// WithTextDrives allows files upon the given drives to be opened in text
+// mode, with line-ending and EOF translation.  Drives are given as a
+// comma-separated list of letters, such as "B,C".
+func WithTextDrives(drives string) cpmoption {
+	return func(c *CPM) error {
+		for _, d := range strings.Split(drives, ",") {
+			d = strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(d), ":"))
+			if d == "" {
+				continue
+			}
+			if len(d) != 1 || d[0] < 'A' || d[0] > 'P' {
+				return fmt.Errorf("invalid drive '%s' for text mode", d)
+			}
+			c.textDrives += d
+		}
+		return nil
+	}
+}
+
+// WithTextExtensions allows files with the given extensions to be opened
+// in text mode, with line-ending and EOF translation.  Extensions are given
+// as a comma-separated list, such as "TXT,ASM".
+func WithTextExtensions(exts string) cpmoption {
+	return func(c *CPM) error {
+		for _, e := range strings.Split(exts, ",") {
+			e = strings.ToUpper(strings.TrimPrefix(strings.TrimSpace(e), "."))
+			if e != "" {
+				c.textExtensions = append(c.textExtensions, e)
+			}
+		}
+		return nil
+	}
+}
+
+// WithMaxOpenFiles allows the number of host files which may be open at
+// the same time to be changed in our constructor.
+func WithMaxOpenFiles(n int) cpmoption {
+	return func(c *CPM) error {
+		if n < 1 {
+			return fmt.Errorf("the open file limit must be at least one, not %d", n)
+		}
+		c.maxOpenFiles = n
+		return nil
+	}
+}
+
 // WithConsoleDriver allows the console driver to be created in our
 // constructor.
 func WithConsoleDriver(name string) cpmoption {
@@ -406,10 +818,7 @@ func New(options ...cpmoption) (*CPM, error) {
 	}
 	bdos[40] = CPMHandler{
 		Desc:    "F_WRITEZF",
-		Handler: BdosSysCallWriteRand,
-
-		// We don't zero-pad
-		Fake: true,
+		Handler: BdosSysCallWriteRandZero,
 	}
 	bdos[45] = CPMHandler{
 		Desc:    "F_ERRMODE",
@@ -459,10 +868,19 @@ func New(options ...cpmoption) (*CPM, error) {
 		Handler: BiosSysCallPrintChar,
 		Fake:    true,
 	}
+	bios[6] = CPMHandler{
+		Desc:    "PUNCH",
+		Handler: BiosSysCallPunch,
+		Noisy:   true,
+	}
+	bios[7] = CPMHandler{
+		Desc:    "READER",
+		Handler: BiosSysCallReader,
+		Noisy:   true,
+	}
 	bios[15] = CPMHandler{
 		Desc:    "LISTST",
 		Handler: BiosSysCallPrinterStatus,
-		Fake:    true,
 	}
 	bios[17] = CPMHandler{
 		Desc:    "CONOST",
@@ -473,12 +891,22 @@ func New(options ...cpmoption) (*CPM, error) {
 	bios[18] = CPMHandler{
 		Desc:    "AUXIST",
 		Handler: BiosSysCallAuxInputStatus,
-		Fake:    true,
 	}
 	bios[19] = CPMHandler{
 		Desc:    "AUXOST",
 		Handler: BiosSysCallAuxOutputStatus,
-		Fake:    true,
+	}
+	bios[25] = CPMHandler{
+		Desc:    "MOVE",
+		Handler: BiosSysCallMove,
+	}
+	bios[27] = CPMHandler{
+		Desc:    "SELMEM",
+		Handler: BiosSysCallSelectMemory,
+	}
+	bios[29] = CPMHandler{
+		Desc:    "XMOVE",
+		Handler: BiosSysCallExtendedMove,
 	}
 	bios[31] = CPMHandler{
 		Desc:    "RESERVE1",
@@ -499,8 +927,14 @@ func New(options ...cpmoption) (*CPM, error) {
 		ccp:          "ccp", // default
 		dma:          0x0080,
 		drives:       make(map[string]string),
-		files:        make(map[uint16]FileCache),
+		files:        make(map[fileKey]*FileCache),
 		input:        consolein.New(),
+		ioByte:       defaultIOByte,
+		banks:        1,
+		bdosAddr:     defaultBdosAddr,
+		biosAddr:     defaultBiosAddr,
+		irq:          interrupts{raised: make(chan struct{}, 1)},
+		maxOpenFiles: defaultMaxOpenFiles,
 		output:       driver,        // default
 		prnPath:      "printer.log", // default
 		start:        0x0100,
@@ -514,12 +948,86 @@ func New(options ...cpmoption) (*CPM, error) {
 		}
 	}
 
+	// The memory common to all banks must include our BDOS and BIOS.
+	if tmp.banks > 1 && tmp.common > tmp.bdosAddr {
+		return tmp, fmt.Errorf("invalid common memory address 0x%04X, it must be no higher than the BDOS at 0x%04X", tmp.common, tmp.bdosAddr)
+	}
+
+	// If our speed is limited allow it to be toggled.
+	if tmp.clock.mhz > 0 {
+		tmp.input.SetHotkey(turboKey, tmp.toggleTurbo)
+	}
+
+	// Create the printer device.
+	tmp.printer = printer.New(tmp.prnPath)
+	tmp.printer.SetCommand(tmp.prnCommand)
+	tmp.printer.SetPageSplit(tmp.prnSplit)
+
+	// Open the auxiliary devices.
+	//
+	// If the same endpoint is used for input and output, as might be
+	// the case for a socket, or a pseudo-terminal, we only open it once.
+	if tmp.auxInSpec != "" && tmp.auxInSpec == tmp.auxOutSpec {
+		tmp.auxIn, err = auxio.New(tmp.auxInSpec, auxio.Both)
+		if err != nil {
+			return tmp, err
+		}
+		tmp.auxOut = tmp.auxIn
+	} else {
+		if tmp.auxInSpec != "" {
+			tmp.auxIn, err = auxio.New(tmp.auxInSpec, auxio.Input)
+			if err != nil {
+				return tmp, err
+			}
+		}
+		if tmp.auxOutSpec != "" {
+			tmp.auxOut, err = auxio.New(tmp.auxOutSpec, auxio.Output)
+			if err != nil {
+				return tmp, err
+			}
+		}
+	}
+
+	// Set the charset now, so it doesn't matter if the console driver
+	// was changed after it was specified.
+	if tmp.charset != "" {
+		err = tmp.output.SetCharset(tmp.charset)
+		if err != nil {
+			return tmp, err
+		}
+	}
+
+	// If we're writing a transcript we wrap the output driver now,
+	// so it doesn't matter which order the options were given in.
+	if tmp.transcriptPath != "" {
+		tmp.transcript, err = os.OpenFile(tmp.transcriptPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return tmp, fmt.Errorf("failed to open transcript %s: %s", tmp.transcriptPath, err)
+		}
+		tmp.output.SetTranscript(tmp.transcript, tmp.transcriptPlain)
+	}
+
 	return tmp, nil
 }
 
-// Cleanup cleans up the state of the terminal, if necessary.
+// Cleanup cleans up the state of the terminal, if necessary, and flushes
+// any pending printer output.
 func (cpm *CPM) Cleanup() {
 	cpm.input.Reset()
+
+	cpm.closePrinter()
+
+	if cpm.auxIn != nil {
+		cpm.auxIn.Close()
+	}
+	if cpm.auxOut != nil && cpm.auxOut != cpm.auxIn {
+		cpm.auxOut.Close()
+	}
+
+	if cpm.transcript != nil {
+		cpm.transcript.Close()
+		cpm.transcript = nil
+	}
 }
 
 // GetOutputDriver returns the name of our configured output driver.
@@ -527,11 +1035,38 @@ func (cpm *CPM) GetOutputDriver() string {
 	return cpm.output.GetName()
 }
 
+// GetAuxDevices returns descriptions of the auxiliary input and output
+// devices, which will be empty if the console is in use.
+func (cpm *CPM) GetAuxDevices() (string, string) {
+	in := ""
+	out := ""
+	if cpm.auxIn != nil {
+		in = cpm.auxIn.String()
+	}
+	if cpm.auxOut != nil {
+		out = cpm.auxOut.String()
+	}
+	return in, out
+}
+
 // GetCCPName returns the name of the CCP we've been configured to load.
 func (cpm *CPM) GetCCPName() string {
 	return cpm.ccp
 }
 
+// closePrinter flushes any pending printer output, and finishes the current
+// print job.
+//
+// This happens when the emulator terminates, as well as when the running
+// program does, so that output is never left sitting in a buffer.
+func (cpm *CPM) closePrinter() {
+	err := cpm.printer.Close()
+	if err != nil {
+		slog.Error("failed to close printer",
+			slog.String("error", err.Error()))
+	}
+}
+
 // LogNoisy enables logging support for each of the functions which
 // would otherwise be disabled
 func (cpm *CPM) LogNoisy() {
@@ -551,12 +1086,15 @@ func (cpm *CPM) LogNoisy() {
 func (cpm *CPM) LoadBinary(filename string) error {
 
 	// Create 64K of memory, full of NOPs
-	if cpm.Memory == nil {
-		cpm.Memory = new(memory.Memory)
+	err := cpm.createMemory()
+	if err != nil {
+		return err
 	}
 
+	cpm.program = filename
+
 	// Load our binary into the memory
-	err := cpm.Memory.LoadFile(cpm.start, filename)
+	err = cpm.Memory.LoadFile(cpm.start, filename)
 	if err != nil {
 		return (fmt.Errorf("failed to load %s: %s", filename, err))
 	}
@@ -601,9 +1139,9 @@ func (cpm *CPM) LoadBinary(filename string) error {
 // we don't overlap with our CCP, or "large programs" loaded at 0x0100.
 func (cpm *CPM) fixupRAM() {
 	i := 0
-	BIOS := 0xFE00
-	BDOS := 0xF000
-	NENTRY := 30
+	BIOS := int(cpm.biosAddr)
+	BDOS := int(cpm.bdosAddr)
+	NENTRY := biosEntries
 
 	SETMEM := func(a int, v int) {
 		cpm.Memory.Set(uint16(a), uint8(v))
@@ -623,13 +1161,13 @@ func (cpm *CPM) fixupRAM() {
 	SETMEM(0x0002, ((BIOS + 3) >> 8))
 
 	// We setup a fake jump here, because 0x0006 is sometimes
-	// used to find the free RAM and we pretend our BDOS is at 0xDC00
+	// used to find the free RAM, and so the top of the TPA.
 	SETMEM(0x0005, 0x76)                /* HALT */
 	SETMEM(0x0006, ((BDOS + 6) & 0xFF)) /* Fake Address of entry point */
 	SETMEM(0x0007, ((BDOS + 6) >> 8))
 
 	// Now we setup the initial values of the I/O byte
-	SETMEM(0x0003, 0x00)
+	SETMEM(0x0003, int(cpm.ioByte))
 
 	// fake BIOS entry points for 30 syscalls.
 	//
@@ -642,7 +1180,7 @@ func (cpm *CPM) fixupRAM() {
 	//
 	//     func (cpm *CPM) Out(addr uint8, val uint8)
 	//
-	for i < 30 {
+	for i < NENTRY {
 		/* JP <bios-entry> */
 		SETMEM(BIOS+3*i, 0xC3)
 		SETMEM(BIOS+3*i+1, (BIOS+NENTRY*3+i*5)&0xFF)
@@ -663,6 +1201,23 @@ func (cpm *CPM) fixupRAM() {
 
 }
 
+// createMemory creates our memory, if it doesn't already exist, and
+// selects the first bank, which is where programs are loaded.
+func (cpm *CPM) createMemory() error {
+	if cpm.Memory == nil {
+		cpm.Memory = new(memory.Memory)
+		err := cpm.Memory.SetBanks(cpm.banks, cpm.common)
+		if err != nil {
+			return err
+		}
+		if cpm.protectMemory {
+			cpm.protect(cpm.Memory)
+		}
+	}
+	cpm.xmove.set = false
+	return cpm.Memory.SelectBank(0)
+}
+
 // LoadCCP loads the CCP into RAM, to be executed instead of an external binary.
 //
 // This function modifies the "start" attribute, to ensure the CCP is loaded
@@ -670,8 +1225,9 @@ func (cpm *CPM) fixupRAM() {
 func (cpm *CPM) LoadCCP() error {
 
 	// Create 64K of memory, full of NOPs
-	if cpm.Memory == nil {
-		cpm.Memory = new(memory.Memory)
+	err := cpm.createMemory()
+	if err != nil {
+		return err
 	}
 
 	//
@@ -683,8 +1239,19 @@ func (cpm *CPM) LoadCCP() error {
 		return fmt.Errorf("error retrieving CCP by name: %s", err)
 	}
 
+	// The CCP is relocated to sit just below our BDOS, as upon a
+	// real system.
+	start, err := cpm.ccpAddress(helper)
+	if err != nil {
+		return err
+	}
+	code, err := helper.Relocate(start)
+	if err != nil {
+		return err
+	}
+
 	// Load it into memory
-	cpm.Memory.SetRange(helper.Start, helper.Bytes...)
+	cpm.Memory.SetRange(start, code...)
 
 	// DMA area / CLI Args are going to be unset.
 	cpm.Memory.Set(0x0080, 0x00)
@@ -699,7 +1266,8 @@ func (cpm *CPM) LoadCCP() error {
 	cpm.Memory.FillRange(0x006C+1, 11, ' ')
 
 	// Ensure our starting point is what we expect
-	cpm.start = helper.Start
+	cpm.start = start
+	cpm.program = "CCP " + helper.Name
 
 	// patch low-memory so that RST instructions will
 	// ultimately invoke our CP/M syscalls, via our "Out"
@@ -709,22 +1277,45 @@ func (cpm *CPM) LoadCCP() error {
 	return nil
 }
 
+// ccpAddress returns the address at which the given CCP will be loaded,
+// which is the highest page boundary that leaves room for it below our
+// BDOS.
+func (cpm *CPM) ccpAddress(helper ccp.Flavour) (uint16, error) {
+	start := (int(cpm.bdosAddr) - len(helper.Bytes)) &^ 0xFF
+	if start < 0x0100 {
+		return 0, fmt.Errorf("there is no room for the CCP below the BDOS at 0x%04X", cpm.bdosAddr)
+	}
+	return uint16(start), nil
+}
+
 // Execute executes our named binary, with the specified arguments.
 //
 // The function will not return until the process being executed terminates,
 // and any error will be returned.
 func (cpm *CPM) Execute(args []string) error {
 
-	// Reset any cached filehandles.
+	// When the program terminates, or we warm boot, we'll close any
+	// files it left open.
 	//
-	// This is only required when running the CCP, as there we're persistent.
-	for fcb, obj := range cpm.files {
-		slog.Debug("Closing handle in FileCache",
-			slog.String("path", obj.name),
-			slog.Int("fcb", int(fcb)))
-		obj.handle.Close()
-	}
-	cpm.files = make(map[uint16]FileCache)
+	// This is required when running the CCP, as there we're persistent.
+	defer cpm.closeLeakedFiles()
+
+	// When the program terminates, or we warm boot, we'll ensure
+	// any pending printer output is written.
+	defer cpm.closePrinter()
+
+	// Writes to protected memory are only refused while a program
+	// is running.
+	cpm.running = true
+	defer func() {
+		cpm.running = false
+	}()
+
+	// Save the IOBYTE, which might have been changed by STAT, so
+	// that it will persist after the CCP is reloaded.
+	defer func() {
+		cpm.ioByte = cpm.Memory.Get(0x0003)
+	}()
 
 	// Create the CPU, pointing to our memory, and setting the initial program counter
 	// to point to our expected entry-point.
@@ -753,8 +1344,8 @@ func (cpm *CPM) Execute(args []string) error {
 	// Set the same value in RAM
 	cpm.Memory.Set(0x0004, cpm.CPU.States.BC.Lo)
 
-	BIOS := uint16(0xFE00)
-	BDOS := uint16(0xF000)
+	BIOS := cpm.biosAddr
+	BDOS := cpm.bdosAddr
 
 	// Setup our breakpoints.
 	//
@@ -798,10 +1389,14 @@ func (cpm *CPM) Execute(args []string) error {
 		}
 	}
 
+	// Start raising interrupts, if configured to.
+	stop := cpm.startTimer()
+	defer stop()
+
 	// Run forever :)
 	for {
 		// Run until we hit an error
-		err := cpm.CPU.Run(context.Background())
+		err := cpm.run(context.Background())
 
 		// If we ended up here because the I/O handler received
 		// an error, and then HALTed the emulator we'll process it
@@ -841,18 +1436,23 @@ func (cpm *CPM) Execute(args []string) error {
 		// Is there a syscall entry for this number?
 		//
 		handler, exists := cpm.BDOSSyscalls[syscall]
+		cpm.recordSyscall("BDOS", syscall, handler.Desc)
 
 		//
-		// Nope: That will stop execution with a fatal log
+		// Nope: That will stop execution with a fatal log, unless
+		// we have been asked to continue.
 		//
 		if !exists {
 
-			slog.Error("Unimplemented BDOS Syscall",
-				slog.Int("syscall", int(syscall)),
-				slog.String("syscallHex",
-					fmt.Sprintf("0x%02X", syscall)),
-			)
-			return ErrUnimplemented
+			if !cpm.continueUnimplemented {
+				slog.Error("Unimplemented BDOS Syscall",
+					slog.Int("syscall", int(syscall)),
+					slog.String("syscallHex",
+						fmt.Sprintf("0x%02X", syscall)),
+				)
+				return ErrUnimplemented
+			}
+			handler = CPMHandler{Desc: "UNIMPLEMENTED", Handler: BdosSysCallUnimplemented}
 		}
 
 		// Log the call we're going to make
@@ -907,9 +1507,16 @@ func (cpm *CPM) Execute(args []string) error {
 // a simple binary.
 //
 // If A:SUBMIT.COM and A:AUTOEXEC.SUB exist then we stuff the input-buffer with
-// a command to process them.
+// a command to process them, and then any commands given via WithAutoExec.
 func (cpm *CPM) RunAutoExec() {
 
+	// The configured commands follow the submit-file, if any.
+	defer func() {
+		for _, cmd := range cpm.autoExec {
+			cpm.input.StuffInput(cmd)
+		}
+	}()
+
 	// These files must be present
 	files := []string{"SUBMIT.COM", "AUTOEXEC.SUB"}
 
@@ -965,10 +1572,26 @@ func (cpm *CPM) SetDrivePath(drive string, path string) {
 	cpm.drives[drive] = path
 }
 
+// RegisterPorts attaches the given device to the I/O ports from first to
+// last, inclusive, so that programs which access hardware directly may be
+// run.
+//
+// Port 0xFF is reserved for our BIOS, and may not be claimed.
+func (cpm *CPM) RegisterPorts(first, last uint8, dev ports.Device) error {
+	if last == biosPort {
+		return fmt.Errorf("port 0x%02X is reserved", biosPort)
+	}
+	return cpm.ports.Register(first, last, dev)
+}
+
 // In is called to handle the I/O reading of a Z80 port.
 //
 // This is called by our embedded Z80 emulator.
 func (cpm *CPM) In(addr uint8) uint8 {
+	if val, ok := cpm.ports.In(addr); ok {
+		return val
+	}
+
 	slog.Debug("I/O IN",
 		slog.Int("port", int(addr)))
 
@@ -992,7 +1615,14 @@ func (cpm *CPM) Out(addr uint8, val uint8) {
 	// We use port FF for CP/M calls - via
 	// the compatibility instructions we deployed
 	// in fixRAM.
-	if addr != 0xFF {
+	//
+	// Other ports may have a device attached.
+	if addr != biosPort {
+		if !cpm.ports.Out(addr, val) {
+			slog.Debug("I/O OUT",
+				slog.Int("port", int(addr)),
+				slog.Int("value", int(val)))
+		}
 		return
 	}
 
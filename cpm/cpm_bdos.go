@@ -7,9 +7,9 @@
 package cpm
 
 import (
+	"bytes"
 	"fmt"
 	"io"
-	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
@@ -26,6 +26,12 @@ const blkSize = 128
 // maxRC is the maximum read count
 const maxRC = 128
 
+// sizeInRecords returns the number of records needed to hold the given
+// number of bytes, counting any partial record at the end.
+func sizeInRecords(size int64) int {
+	return int((size + blkSize - 1) / blkSize)
+}
+
 // BdosSysCallExit implements the Exit syscall
 func BdosSysCallExit(cpm *CPM) error {
 	return ErrExit
@@ -35,7 +41,7 @@ func BdosSysCallExit(cpm *CPM) error {
 func BdosSysCallReadChar(cpm *CPM) error {
 
 	// Block for input
-	c, err := cpm.input.BlockForCharacterWithEcho()
+	c, err := cpm.conReadEcho()
 	if err != nil {
 		return fmt.Errorf("error in call to BlockForCharacter: %s", err)
 	}
@@ -53,9 +59,7 @@ func BdosSysCallReadChar(cpm *CPM) error {
 // BdosSysCallWriteChar writes the single character in the E register to STDOUT.
 func BdosSysCallWriteChar(cpm *CPM) error {
 
-	cpm.output.PutCharacter(cpm.CPU.States.DE.Lo)
-
-	return nil
+	return cpm.conWrite(cpm.CPU.States.DE.Lo)
 }
 
 // BdosSysCallAuxRead reads a single character from the auxiliary input.
@@ -64,9 +68,9 @@ func BdosSysCallWriteChar(cpm *CPM) error {
 func BdosSysCallAuxRead(cpm *CPM) error {
 
 	// Block for input
-	c, err := cpm.input.BlockForCharacterNoEcho()
+	c, err := cpm.readerRead()
 	if err != nil {
-		return fmt.Errorf("error in call to BlockForCharacterNoEcho: %s", err)
+		return err
 	}
 
 	// Return values:
@@ -79,22 +83,22 @@ func BdosSysCallAuxRead(cpm *CPM) error {
 	return nil
 }
 
-// BdosSysCallAuxWrite writes the single character in the C register
+// BdosSysCallAuxWrite writes the single character in the E register
 // auxiliary / punch output.
 func BdosSysCallAuxWrite(cpm *CPM) error {
 
 	// The character we're going to write
-	c := cpm.CPU.States.BC.Lo
-	cpm.output.PutCharacter(c)
-	return nil
+	c := cpm.CPU.States.DE.Lo
+	return cpm.punchWrite(c)
 }
 
 // BdosSysCallPrinterWrite should send a single character to the printer,
 // we fake that by writing to a file instead.
 func BdosSysCallPrinterWrite(cpm *CPM) error {
 
-	// write the character to our printer-file
-	err := cpm.prnC(cpm.CPU.States.DE.Lo)
+	// write the character to the list device, which will
+	// usually be our printer-file.
+	err := cpm.listWrite(cpm.CPU.States.DE.Lo)
 	return err
 }
 
@@ -110,8 +114,8 @@ func BdosSysCallRawIO(cpm *CPM) error {
 	switch cpm.CPU.States.DE.Lo {
 	case 0xFF:
 		// Return a character without echoing if one is waiting; zero if none is available.
-		if cpm.input.PendingInput() {
-			out, err := cpm.input.BlockForCharacterNoEcho()
+		if cpm.conReady() {
+			out, err := cpm.conRead()
 			if err != nil {
 				return err
 			}
@@ -127,7 +131,7 @@ func BdosSysCallRawIO(cpm *CPM) error {
 		return nil
 	case 0xFE:
 		// Return console input status. Zero if no character is waiting, nonzero otherwise.
-		if cpm.input.PendingInput() {
+		if cpm.conReady() {
 
 			cpm.CPU.States.AF.Hi = 0xFF
 			cpm.CPU.States.AF.Lo = 0x00
@@ -141,7 +145,7 @@ func BdosSysCallRawIO(cpm *CPM) error {
 		return nil
 	case 0xFD:
 		// Wait until a character is ready, return it without echoing.
-		out, err := cpm.input.BlockForCharacterNoEcho()
+		out, err := cpm.conRead()
 		if err != nil {
 			return err
 		}
@@ -149,17 +153,17 @@ func BdosSysCallRawIO(cpm *CPM) error {
 		cpm.CPU.States.AF.Lo = 0x00
 		cpm.CPU.States.HL.Lo = 0x00
 		return nil
-	default:
-		// Anything else is to output a character.
-		cpm.output.PutCharacter(cpm.CPU.States.DE.Lo)
 	}
-	return nil
+
+	// Anything else is to output a character.
+	return cpm.conWrite(cpm.CPU.States.DE.Lo)
 }
 
 // BdosSysCallGetIOByte gets the IOByte, which is used to describe which devices
 // are used for I/O.  No CP/M utilities use it, except for STAT and PIP.
 //
 // The IOByte lives at 0x0003 in RAM, so it is often accessed directly when it is used.
+// The assignments it contains are honoured by our device I/O, see iobyte.go.
 func BdosSysCallGetIOByte(cpm *CPM) error {
 
 	// Get the value
@@ -189,7 +193,10 @@ func BdosSysCallWriteString(cpm *CPM) error {
 
 	c := cpm.Memory.Get(addr)
 	for c != '$' {
-		cpm.output.PutCharacter(c)
+		err := cpm.conWrite(c)
+		if err != nil {
+			return err
+		}
 		addr++
 		c = cpm.Memory.Get(addr)
 	}
@@ -219,7 +226,7 @@ func BdosSysCallReadString(cpm *CPM) error {
 	max := cpm.CPU.Memory.Get(addr)
 
 	// read the input
-	text, err := cpm.input.ReadLine(max)
+	text, err := cpm.conReadLine(max)
 
 	if err != nil {
 
@@ -256,7 +263,7 @@ func BdosSysCallReadString(cpm *CPM) error {
 // BdosSysCallConsoleStatus tests if we have pending console (character) input.
 func BdosSysCallConsoleStatus(cpm *CPM) error {
 
-	if cpm.input.PendingInput() {
+	if cpm.conReady() {
 		cpm.CPU.States.AF.Hi = 0xFF
 		cpm.CPU.States.HL.Lo = 0xFF
 	} else {
@@ -364,6 +371,9 @@ func BdosSysCallFileOpen(cpm *CPM) error {
 	// Create a structure with the contents
 	fcbPtr := fcb.FromBytes(xxx)
 
+	// Get the key for our cache of open files
+	key := cpm.fileKey(fcbPtr)
+
 	// Get the actual name
 	fileName := fcbPtr.GetFileName()
 
@@ -373,60 +383,52 @@ func BdosSysCallFileOpen(cpm *CPM) error {
 		drive = fcbPtr.Drive + 'A' - 1
 	}
 
-	// Remap to the place we're supposed to use.
-	path := cpm.drives[string(drive)]
-
 	//
 	// Ok we have a filename, but we probably have an upper-case
-	// filename.
+	// filename, or the alias of a host file with a long name.
 	//
-	// Run a glob, and if there's an existing file with the same
-	// name then replace with the mixed/lower cased version.
+	// If there's an existing file with the same name then replace
+	// with the mixed/lower cased, or long, version.
 	//
-	files, err2 := os.ReadDir(path)
-	if err2 == nil {
-		for _, n := range files {
-			if strings.ToUpper(n.Name()) == fileName {
-				fileName = n.Name()
-			}
-		}
-	}
+	// The name comes from the program, so we also ensure it is
+	// safe to use upon the host.
+	hostName, hostErr := cpm.hostPath(drive, fileName)
 
 	// child logger with more details.
 	l := slog.With(
 		slog.String("function", "SysCallFileOpen"),
 		slog.String("name", fileName),
 		slog.String("drive", string(cpm.currentDrive+'A')),
-		slog.String("result", fileName))
+		slog.String("result", hostName))
 
-	// Ensure the filename is qualified
-	fileName = filepath.Join(path, fileName)
+	fileName = hostName
 
-	// Remapped file
-	x := filepath.Base(fileName)
-	x = filepath.Join(string(cpm.currentDrive+'A'), x)
-
-	// Can we open this file from our embedded filesystem?
-	virt, er := cpm.static.ReadFile(x)
+	// Can we open this file from our embedded filesystem, or
+	// a mounted archive?
+	virt, er := cpm.readVirtualFile(drive, fcbPtr.GetFileName())
 	if er == nil {
 
 		// Yes we can!
-		// Save the file handle in our cache.
-		cpm.files[ptr] = FileCache{name: fileName, handle: nil}
-
-		// Get file size, in blocks
-		fLen := uint8(len(virt) / blkSize)
+		//
+		// Set the record-count of the extent we're opening,
+		// which must exist.
+		fcbPtr.RC = fcbPtr.GetExtentRecords(sizeInRecords(int64(len(virt))))
+		if fcbPtr.RC == 0 && (fcbPtr.Ex != 0 || fcbPtr.S2&0x3F != 0) {
+			l.Debug("failed to open, extent does not exist",
+				slog.Int("extent", int(fcbPtr.Ex)))
+			cpm.CPU.States.AF.Hi = 0xFF
+			return nil
+		}
 
-		// Set record-count
-		if fLen > maxRC {
-			fcbPtr.RC = maxRC
+		// Save the file handle in our cache.
+		obj, ok := cpm.files[key]
+		if ok {
+			obj.refs++
 		} else {
-			fcbPtr.RC = fLen
+			obj = &FileCache{name: fileName, handle: nil, data: virt, refs: 1}
+			cpm.addFile(key, obj)
 		}
-
-		// Write our cache-key in the FCB
-		fcbPtr.Al[0] = uint8(ptr & 0xFF)
-		fcbPtr.Al[1] = uint8(ptr >> 8)
+		setFileID(&fcbPtr, obj)
 
 		// Update the FCB in memory.
 		cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
@@ -436,15 +438,38 @@ func BdosSysCallFileOpen(cpm *CPM) error {
 		return nil
 	}
 
-	// Now we open from the filesystem
-	file, err := os.OpenFile(fileName, os.O_RDWR, 0644)
+	// Files upon the host aren't visible on a drive with an
+	// archive mounted.
+	if cpm.isMounted(drive) {
+		l.Debug("failed to open, file is not present in mounted archive")
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
+	}
+
+	// Refuse names which aren't safe.
+	if hostErr != nil {
+		l.Debug("failed to open",
+			slog.String("error", hostErr.Error()))
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
+	}
+
+	// Is the file already open?  Then we'll share the handle.
+	var err error
+	obj, open := cpm.files[key]
+	if open {
+		l.Debug("file is already open",
+			slog.Int("refs", obj.refs))
+	} else {
+		obj, err = cpm.openHostFile(drive, fileName, os.O_RDWR)
+	}
 	if err != nil {
 
 		// We might fail to open a file because it doesn't
-		// exist.
-		if os.IsNotExist(err) {
+		// exist, or because too many files are open.
+		if os.IsNotExist(err) || err == errTooManyFiles {
 
-			l.Debug("failed to open, file does not exist",
+			l.Debug("failed to open",
 				slog.String("path", fileName),
 				slog.String("error", err.Error()))
 
@@ -459,11 +484,8 @@ func BdosSysCallFileOpen(cpm *CPM) error {
 		return err
 	}
 
-	// Save the file handle in our cache.
-	cpm.files[ptr] = FileCache{name: fileName, handle: file}
-
 	// Get file size, in bytes
-	fi, err := file.Stat()
+	fi, err := obj.handle.Stat()
 	if err != nil {
 		return fmt.Errorf("failed to get file size of %s: %s", fileName, err)
 	}
@@ -471,26 +493,40 @@ func BdosSysCallFileOpen(cpm *CPM) error {
 	// Get file size, in bytes
 	fileSize := fi.Size()
 
-	// Get file size, in blocks
-	fLen := uint8(fileSize / blkSize)
+	// Set the record-count of the extent we're opening.
+	//
+	// If the FCB specifies an extent other than the first then
+	// it must exist, as CP/M has a directory entry for each.
+	fcbPtr.RC = fcbPtr.GetExtentRecords(sizeInRecords(fileSize))
+	if fcbPtr.RC == 0 && (fcbPtr.Ex != 0 || fcbPtr.S2&0x3F != 0) {
+		l.Debug("failed to open, extent does not exist",
+			slog.Int("extent", int(fcbPtr.Ex)),
+			slog.Int64("file_size", fileSize))
+
+		if !open {
+			err = cpm.closeFile(obj)
+			if err != nil {
+				return err
+			}
+		}
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
+	}
 
-	// Set record-count
-	if fLen > maxRC {
-		fcbPtr.RC = maxRC
-	} else {
-		fcbPtr.RC = fLen
+	// Save the file handle in our cache.
+	obj.refs++
+	if !open {
+		cpm.addFile(key, obj)
 	}
+	setFileID(&fcbPtr, obj)
 
 	l.Debug("result:OK",
 		slog.Int("fcb", int(ptr)),
-		slog.Int("handle", int(file.Fd())),
+		slog.Int("handle", int(obj.handle.Fd())),
+		slog.Int("refs", obj.refs),
 		slog.Int("record_count", int(fcbPtr.RC)),
 		slog.Int64("file_size", fileSize))
 
-	// Write our cache-key in the FCB
-	fcbPtr.Al[0] = uint8(ptr & 0xFF)
-	fcbPtr.Al[1] = uint8(uint16(ptr >> 8))
-
 	// Update the FCB in memory.
 	cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
 
@@ -520,11 +556,8 @@ func BdosSysCallFileClose(cpm *CPM) error {
 	// Create a structure with the contents
 	fcbPtr := fcb.FromBytes(xxx)
 
-	// Get our cache-key from the FCB
-	key := uint16(uint16(fcbPtr.Al[1])<<8 + uint16(fcbPtr.Al[0]))
-
 	// Get the file handle from our cache.
-	obj, ok := cpm.files[key]
+	obj, ok := cpm.getFile(fcbPtr)
 	if !ok {
 		slog.Debug("SysCallFileClose tried to close a file that wasn't open",
 			slog.Int("fcb", int(ptr)))
@@ -532,21 +565,14 @@ func BdosSysCallFileClose(cpm *CPM) error {
 		return nil
 	}
 
-	// Close of a virtual file.
-	if obj.handle == nil {
-		// Record success
-		cpm.CPU.States.AF.Hi = 0x00
-		return nil
-	}
-
 	// Is this a $-file?
-	if strings.Contains(obj.name, "$") {
+	if obj.handle != nil && strings.Contains(obj.name, "$") {
 
 		// Get the file size, in records
 		hostSize, _ := obj.handle.Seek(0, 2)
 		hostExtent := int((hostSize) / 16384)
 
-		seqEXT := int(fcbPtr.Ex)*32 + int(0x3F&fcbPtr.S2)
+		seqEXT := int(0x3F&fcbPtr.S2)*fcb.ExtentsPerModule + int(fcbPtr.Ex&0x1F)
 		seqCR := func(n int64) int {
 			return int(((n) % 16384) / 128)
 		}
@@ -561,19 +587,21 @@ func BdosSysCallFileClose(cpm *CPM) error {
 			}
 		}
 	}
-	// close the handle
-	err := obj.handle.Close()
-	if err != nil {
-		return fmt.Errorf("failed to close file %04X:%s", ptr, err)
-	}
 
-	// delete the entry from the cache.
-	delete(cpm.files, key)
+	// The file might have been opened more than once, in which
+	// case we only close the handle when the last user closes it.
+	obj.refs--
+	if obj.refs < 1 {
 
-	// Update the FCB in RAM
-	fcbPtr.Al[0] = 0x00
-	fcbPtr.Al[1] = 0x00
-	cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
+		// close the handle
+		err := cpm.closeFile(obj)
+		if err != nil {
+			return fmt.Errorf("failed to close file %04X:%s", ptr, err)
+		}
+
+		// delete the entry from the cache.
+		delete(cpm.files, obj.key)
+	}
 
 	// Record success
 	cpm.CPU.States.AF.Hi = 0x00
@@ -583,7 +611,99 @@ func BdosSysCallFileClose(cpm *CPM) error {
 	return nil
 }
 
+// allocBlockSize is the size of the allocation blocks of our disks,
+// which are the units in which files grow.
+const allocBlockSize = 1024
+
+// dirEntries returns the directory entries which describe the named file,
+// as they would be stored upon a real disk.
+//
+// Files larger than 16K have one entry for each extent, and each entry
+// has an allocation map describing the 1K blocks in use.  We don't have
+// real blocks, so we number them sequentially via the block argument.
+//
+// The allocation map holds 8-bit block numbers, so once we have used
+// them all we leave the rest of the map empty, rather than repeating a
+// number which would make two files appear to share a block.
+func (cpm *CPM) dirEntries(name string, size int64, block *int) []fcb.FCB {
+	var ret []fcb.FCB
+
+	records := int64(sizeInRecords(size))
+	extent := int64(0)
+
+	for {
+		x := fcb.FromString(name)
+		x.Drive = cpm.userNumber
+		x.Ex = uint8(extent & 0x1F)
+		x.S2 = uint8(extent >> 5)
+
+		// The number of records in this extent
+		rc := records - (extent * maxRC)
+		if rc > maxRC {
+			rc = maxRC
+		}
+		x.RC = uint8(rc)
+
+		// One block for each eight records.
+		for i := int64(0); i < (rc*blkSize+allocBlockSize-1)/allocBlockSize; i++ {
+			if *block > 0xFF {
+				break
+			}
+			x.Al[i] = uint8(*block)
+			*block++
+		}
+
+		ret = append(ret, x)
+
+		extent++
+		if extent*maxRC >= records {
+			break
+		}
+	}
+
+	return ret
+}
+
+// storeDirEntry copies the next search result into the DMA area, and
+// returns its directory code in A.
+//
+// Real disks have four directory entries in each 128-byte record, and
+// programs expect the entry they want to be at offset A*32 within the
+// DMA area, so we rotate through the four slots.
+func (cpm *CPM) storeDirEntry() {
+
+	// No more results?  Return an error
+	if cpm.findOffset >= len(cpm.findEntries) {
+		cpm.CPU.States.AF.Hi = 0xFF
+		cpm.CPU.States.HL.Hi = 0x00
+		cpm.CPU.States.HL.Lo = 0xFF
+		return
+	}
+
+	slot := uint8(cpm.findOffset % 4)
+	ent := cpm.findEntries[cpm.findOffset]
+	cpm.findOffset++
+
+	// The other slots contain unused entries.
+	data := make([]uint8, blkSize)
+	for i := range data {
+		data[i] = 0xE5
+	}
+	copy(data[int(slot)*32:], ent.AsBytes()[:32])
+	cpm.Memory.SetRange(cpm.dma, data...)
+
+	cpm.CPU.States.AF.Hi = slot
+	cpm.CPU.States.HL.Hi = 0x00
+	cpm.CPU.States.HL.Lo = slot
+	cpm.CPU.States.BC.Hi = 0x00
+}
+
 // BdosSysCallFindFirst finds the first filename, on disk, that matches the glob in the FCB supplied in DE.
+//
+// If the drive in the FCB is "?" then every entry on the current drive is
+// returned, regardless of name or extent, with the user number in the
+// first byte.  Our user areas all share the same host directory, so each
+// file is returned once, under the current user.
 func BdosSysCallFindFirst(cpm *CPM) error {
 	// The pointer to the FCB
 	ptr := cpm.CPU.States.DE.U16()
@@ -591,94 +711,80 @@ func BdosSysCallFindFirst(cpm *CPM) error {
 	xxx := cpm.Memory.GetRange(ptr, fcb.SIZE)
 
 	// Previous results are now invalidated
-	cpm.findFirstResults = []fcb.FCBFind{}
+	cpm.findEntries = []fcb.FCB{}
 	cpm.findOffset = 0
 
 	// Create a structure with the contents
 	fcbPtr := fcb.FromBytes(xxx)
 
-	// Look in the correct location.
-	dir := cpm.drives[string(cpm.currentDrive+'A')]
+	// "?" means all entries on the current drive.
+	all := fcbPtr.Drive == '?'
 
-	// Find files in the FCB.
-	res, err := fcbPtr.GetMatches(dir)
-	if err != nil {
-		slog.Debug("fcbPtr.GetMatches returned error",
-			slog.String("path", dir),
-			slog.String("error", err.Error()))
-
-		cpm.CPU.States.AF.Hi = 0xFF
-		return nil
+	// drive will default to our current drive, if the FCB drive field is 0
+	drive := cpm.currentDrive + 'A'
+	if fcbPtr.Drive != 0 && !all {
+		drive = fcbPtr.Drive + 'A' - 1
 	}
 
-	// Add on any virtual files, by merging the drive.
-	_ = fs.WalkDir(cpm.static, string(cpm.currentDrive+'A'),
-		func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				return nil
-			}
-			if d.IsDir() {
-				return nil
-			}
-
-			// Does the entry match the glob?
-			if fcbPtr.DoesMatch(filepath.Base(path)) {
+	// A search for all entries matches every name.
+	pattern := fcbPtr
+	if all {
+		pattern = fcb.FromString("????????.???")
+	}
 
-				// If so append
-				res = append(res, fcb.FCBFind{
-					Host: path,
-					Name: filepath.Base(path)})
-			}
+	// Look in the correct location.
+	dir := cpm.drives[string(drive)]
+
+	// Find files in the FCB, unless there is an archive mounted
+	// upon the drive, which replaces the host files.
+	var res []fcb.FCBFind
+	if !cpm.isMounted(drive) {
+		var err error
+		res, err = pattern.GetMatches(dir)
+		if err != nil {
+			slog.Debug("fcbPtr.GetMatches returned error",
+				slog.String("path", dir),
+				slog.String("error", err.Error()))
 
+			cpm.CPU.States.AF.Hi = 0xFF
+			cpm.CPU.States.HL.Hi = 0x00
+			cpm.CPU.States.HL.Lo = 0xFF
 			return nil
-		})
+		}
+	}
 
-	// No matches?  Return an error
-	if len(res) < 1 {
-		cpm.CPU.States.AF.Hi = 0xFF
-		return nil
+	// Text files are larger once translated.
+	for i := range res {
+		res[i].Size = cpm.textSize(drive, res[i].Host, res[i].Size)
 	}
 
+	// Add on any virtual files, by merging the drive.
+	res = append(res, cpm.findVirtualFiles(drive, pattern)...)
+
 	// Sort the list, since we've added the embedded files
 	// onto the end and that will look weird.
 	sort.Slice(res, func(i, j int) bool {
 		return res[i].Name < res[j].Name
 	})
 
-	// Here we save the results in our cache,
-	// dropping the first
-	cpm.findFirstResults = res[1:]
-	cpm.findOffset = 0
-
-	// Create a new FCB and store it in the DMA entry
-	x := fcb.FromString(res[0].Name)
-
-	// Get the file-size in records, and add to the FCB
-	tmp, err := os.OpenFile(res[0].Host, os.O_RDONLY, 0644)
-	if err == nil {
-		defer tmp.Close()
-
-		fi, err := tmp.Stat()
-		if err == nil {
-
-			fileSize := fi.Size()
-
-			// Get file size, in blocks
-			x.RC = uint8(fileSize / blkSize)
-
+	// Build up the directory entries for each file, keeping only
+	// the extent we were asked for - unless we were asked for all
+	// of them.
+	//
+	// As upon a real disk the module, in S2, must match too.
+	block := 2
+	for _, r := range res {
+		for _, ent := range cpm.dirEntries(r.Name, r.Size, &block) {
+			ex := fcbPtr.Ex == '?' || ent.Ex == fcbPtr.Ex&0x1F
+			s2 := fcbPtr.S2 == '?' || ent.S2 == fcbPtr.S2&0x7F
+			if all || (ex && s2) {
+				cpm.findEntries = append(cpm.findEntries, ent)
+			}
 		}
 	}
 
-	// Update the results
-	data := x.AsBytes()
-	cpm.Memory.SetRange(cpm.dma, data...)
-
-	// Return 0x00 to point to the first entry in the DMA area.
-	cpm.CPU.States.HL.Hi = 0x00
-	cpm.CPU.States.HL.Lo = 0x00
-	cpm.CPU.States.BC.Hi = 0x00
-	cpm.CPU.States.AF.Hi = 0x00
-
+	// Return the first entry, or the error if there were no matches.
+	cpm.storeDirEntry()
 	return nil
 }
 
@@ -687,43 +793,7 @@ func BdosSysCallFindNext(cpm *CPM) error {
 	//
 	// Assume we've been called with findFirst before
 	//
-	if (len(cpm.findFirstResults) == 0) || cpm.findOffset >= len(cpm.findFirstResults) {
-		// Return 0xFF to signal an error
-		cpm.CPU.States.AF.Hi = 0xFF
-		return nil
-	}
-
-	res := cpm.findFirstResults[cpm.findOffset]
-	cpm.findOffset++
-
-	// Create a new FCB and store it in the DMA entry
-	x := fcb.FromString(res.Name)
-
-	// Get the file-size in records, and add to the FCB
-	tmp, err := os.OpenFile(res.Host, os.O_RDONLY, 0644)
-	if err == nil {
-		defer tmp.Close()
-
-		fi, err := tmp.Stat()
-		if err == nil {
-
-			fileSize := fi.Size()
-
-			// Get file size, in blocks
-			x.RC = uint8(fileSize / blkSize)
-
-		}
-	}
-
-	data := x.AsBytes()
-	cpm.Memory.SetRange(cpm.dma, data...)
-
-	// Return 0x00 to point to the first entry in the DMA area.
-	cpm.CPU.States.HL.Hi = 0x00
-	cpm.CPU.States.HL.Lo = 0x00
-	cpm.CPU.States.BC.Hi = 0x00
-	cpm.CPU.States.AF.Hi = 0x00
-
+	cpm.storeDirEntry()
 	return nil
 }
 
@@ -748,6 +818,15 @@ func BdosSysCallDeleteFile(cpm *CPM) error {
 		drive = fcbPtr.Drive + 'A' - 1
 	}
 
+	// Mounted archives are read-only.
+	if cpm.isMounted(drive) {
+		slog.Debug("SysCallDeleteFile - drive is read-only",
+			slog.String("drive", string(drive)))
+
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
+	}
+
 	// Remap to the place we're supposed to use.
 	path := cpm.drives[string(drive)]
 
@@ -804,11 +883,8 @@ func BdosSysCallRead(cpm *CPM) error {
 	// Create a structure with the contents
 	fcbPtr := fcb.FromBytes(xxx)
 
-	// Get our cache-key from the FCB
-	key := uint16(uint16(fcbPtr.Al[1])<<8 + uint16(fcbPtr.Al[0]))
-
 	// Get the file handle in our cache.
-	obj, ok := cpm.files[key]
+	obj, ok := cpm.getFile(fcbPtr)
 	if !ok {
 		slog.Error("SysCallRead: Attempting to read from a file that isn't open")
 		cpm.CPU.States.AF.Hi = 0xFF
@@ -824,48 +900,59 @@ func BdosSysCallRead(cpm *CPM) error {
 	}
 
 	// Get the next read position
-	offset := fcbPtr.GetSequentialOffset()
+	record := fcbPtr.GetSequentialRecord()
+	offset := int64(record) * blkSize
+
+	// Reading past the largest file we support is the end of file.
+	if record >= fcb.MaxRecords {
+		cpm.CPU.States.AF.Hi = 0x01
+		return nil
+	}
 
 	// Are we reading from a virtual file?
 	if obj.handle == nil {
 
-		// Remap
-		p := filepath.Join(string(cpm.currentDrive+'A'), filepath.Base(obj.name))
+		// The contents were read when the file was opened.
+		file := obj.data
 
-		// open
-		file, err := fs.ReadFile(cpm.static, p)
-		if err != nil {
-			fmt.Printf("error on readfile for virtual path (%s):%s\n", p, err)
+		// End of file?
+		if offset >= int64(len(file)) {
+			cpm.CPU.States.AF.Hi = 0x01
+			return nil
 		}
-		i := 0
-
-		// default to being successful
-		cpm.CPU.States.AF.Hi = 0x00
 
 		// copy each appropriate byte into the data-area
-		for i < blkSize {
-			if int(offset)+i < len(file) {
-				data[i] = file[int(offset)+i]
-			} else {
-				cpm.CPU.States.AF.Hi = 0x01
-			}
-			i++
-		}
+		copy(data, file[offset:])
 
 		// Copy the data to the DMA area
 		cpm.Memory.SetRange(cpm.dma, data...)
 
-		// Update the next read position
+		// Update the next read position, and the record count
+		// in case we've moved to a new extent.
 		fcbPtr.IncreaseSequentialOffset()
+		fcbPtr.RC = fcbPtr.GetExtentRecords(sizeInRecords(int64(len(file))))
 
 		// Update the FCB in memory
 		cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
 
 		// All done
+		cpm.CPU.States.AF.Hi = 0x00
 		return nil
 	}
 
-	_, err := obj.handle.Seek(int64(offset), io.SeekStart)
+	// Get file size, in bytes
+	fi, err := obj.handle.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file size of %s: %s", obj.name, err)
+	}
+
+	// End of file?  Or a record that was never written?
+	if offset >= fi.Size() || !obj.isAllocated(offset) {
+		cpm.CPU.States.AF.Hi = 0x01
+		return nil
+	}
+
+	_, err = obj.handle.Seek(int64(offset), io.SeekStart)
 	if err != nil {
 		return fmt.Errorf("cannot seek to position %d: %s", offset, err)
 	}
@@ -886,19 +973,16 @@ func BdosSysCallRead(cpm *CPM) error {
 	// Copy the data to the DMA area
 	cpm.Memory.SetRange(cpm.dma, data...)
 
-	// Update the next read position
+	// Update the next read position, and the record count
+	// in case we've moved to a new extent.
 	fcbPtr.IncreaseSequentialOffset()
+	fcbPtr.RC = fcbPtr.GetExtentRecords(sizeInRecords(fi.Size()))
 
 	// Update the FCB in memory
 	cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
 
 	// All done
-	if err == io.EOF {
-		cpm.CPU.States.AF.Hi = 0x01
-	} else {
-		cpm.CPU.States.AF.Hi = 0x00
-	}
-
+	cpm.CPU.States.AF.Hi = 0x00
 	return nil
 }
 
@@ -913,24 +997,32 @@ func BdosSysCallWrite(cpm *CPM) error {
 	// Create a structure with the contents
 	fcbPtr := fcb.FromBytes(xxx)
 
-	// Get our cache-key from the FCB
-	key := uint16(uint16(fcbPtr.Al[1])<<8 + uint16(fcbPtr.Al[0]))
-
 	// Get the file handle in our cache.
-	obj, ok := cpm.files[key]
+	obj, ok := cpm.getFile(fcbPtr)
 	if !ok {
 		slog.Error("SysCallWrite: Attempting to write to a file that isn't open")
 		cpm.CPU.States.AF.Hi = 0xFF
 		return nil
 	}
 
-	// A virtual handle, from our embedded resources.
+	// A virtual file, which is read-only.
 	if obj.handle == nil {
-		return fmt.Errorf("fatal error SysCallWrite against an embedded resource %v", obj)
+		slog.Warn("SysCallWrite: Attempting to write to a read-only file",
+			slog.String("path", obj.name))
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
 	}
 
 	// Get the next write position
-	offset := fcbPtr.GetSequentialOffset()
+	record := fcbPtr.GetSequentialRecord()
+	offset := int64(record) * blkSize
+
+	// We can't extend the file past the largest size we support,
+	// which CP/M reports as being unable to extend the file.
+	if record >= fcb.MaxRecords {
+		cpm.CPU.States.AF.Hi = 0x01
+		return nil
+	}
 
 	// Add logging of the result and details.
 	slog.Debug("SysCallWrite",
@@ -953,12 +1045,19 @@ func BdosSysCallWrite(cpm *CPM) error {
 	if err != nil {
 		return fmt.Errorf("error writing to file %s", err)
 	}
+	obj.written = true
+	obj.allocate(offset, blkSize)
 
-	// Update the next write position
-	fcbPtr.IncreaseSequentialOffset()
+	// Get file size, in bytes, now we've written to it.
+	fi, err := obj.handle.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file size of %s: %s", obj.name, err)
+	}
 
-	// Sigh.
-	fcbPtr.RC++
+	// Update the next write position, and the record count of
+	// the extent.
+	fcbPtr.IncreaseSequentialOffset()
+	fcbPtr.RC = fcbPtr.GetExtentRecords(sizeInRecords(fi.Size()))
 
 	// Update the FCB in memory
 	cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
@@ -988,23 +1087,29 @@ func BdosSysCallMakeFile(cpm *CPM) error {
 		drive = fcbPtr.Drive + 'A' - 1
 	}
 
-	// Remap to the place we're supposed to use.
-	path := cpm.drives[string(drive)]
+	// Mounted archives are read-only, so there is no room for
+	// new files.
+	if cpm.isMounted(drive) {
+		slog.Debug("SysCallMakeFile - drive is read-only",
+			slog.String("drive", string(drive)))
+
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
+	}
 
 	//
 	// Ok we have a filename, but we probably have an upper-case
-	// filename.
+	// filename, or the alias of a host file with a long name.
 	//
-	// Run a glob, and if there's an existing file with the same
-	// name then replace with the mixed/lower cased version.
+	// If there's an existing file with the same name then replace
+	// with the mixed/lower cased, or long, version.
 	//
-	files, err2 := os.ReadDir(path)
-	if err2 == nil {
-		for _, n := range files {
-			if strings.ToUpper(n.Name()) == fileName {
-				fileName = n.Name()
-			}
-		}
+	// The name comes from the program, so we also ensure it is
+	// safe to use upon the host.
+	hostName, err := cpm.hostPath(drive, fileName)
+	if err != nil {
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
 	}
 
 	// child logger with more details.
@@ -1012,23 +1117,51 @@ func BdosSysCallMakeFile(cpm *CPM) error {
 		slog.String("function", "SysCallMakeFile"),
 		slog.String("name", fileName),
 		slog.String("drive", string(cpm.currentDrive+'A')),
-		slog.String("result", fileName))
+		slog.String("result", hostName))
 
-	// Qualify the path
-	fileName = filepath.Join(path, fileName)
+	fileName = hostName
 
-	// Create the file
-	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
+	// If the file is already open, via another FCB, then we share
+	// its handle, as OpenFile does, rather than closing it from
+	// underneath that FCB.
+	key := cpm.fileKey(fcbPtr)
+	obj, ok := cpm.files[key]
+	if ok && obj.handle == nil {
+		// Virtual files are read-only.
+		l.Debug("file is an open virtual file")
 
-		l.Debug("failed to open",
-			slog.String("path", fileName),
-			slog.String("error", err.Error()))
-		return err
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
 	}
+	if ok {
+		obj.refs++
+		l.Debug("sharing previously open file",
+			slog.Int("refs", obj.refs))
+	} else {
+		// Create the file
+		obj, err = cpm.openHostFile(drive, fileName, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+
+			l.Debug("failed to open",
+				slog.String("path", fileName),
+				slog.String("error", err.Error()))
+
+			// Too many open files is reported as a full directory.
+			if err == errTooManyFiles {
+				cpm.CPU.States.AF.Hi = 0xFF
+				return nil
+			}
+			return err
+		}
+
+		// Save the file-handle
+		obj.refs = 1
+		cpm.addFile(key, obj)
+	}
+	setFileID(&fcbPtr, obj)
 
 	// Get file size, in bytes
-	fi, err := file.Stat()
+	fi, err := obj.handle.Stat()
 	if err != nil {
 		return fmt.Errorf("failed to get file size of %s: %s", fileName, err)
 	}
@@ -1036,26 +1169,12 @@ func BdosSysCallMakeFile(cpm *CPM) error {
 	// Get file size, in bytes
 	fileSize := fi.Size()
 
-	// Get file size, in blocks
-	fLen := uint8(fileSize / blkSize)
-
-	// Set record-count
-	if fLen > maxRC {
-		fcbPtr.RC = maxRC
-	} else {
-		fcbPtr.RC = fLen
-	}
-
-	// Write our cache-key in the FCB
-	fcbPtr.Al[0] = uint8(ptr & 0xFF)
-	fcbPtr.Al[1] = uint8(ptr >> 8)
-
-	// Save the file-handle
-	cpm.files[ptr] = FileCache{name: fileName, handle: file}
+	// Set the record-count of the extent.
+	fcbPtr.RC = fcbPtr.GetExtentRecords(sizeInRecords(fileSize))
 
 	l.Debug("result:OK",
 		slog.Int("fcb", int(ptr)),
-		slog.Int("handle", int(file.Fd())),
+		slog.Int("handle", int(obj.handle.Fd())),
 		slog.Int("record_count", int(fcbPtr.RC)),
 		slog.Int64("file_size", fileSize))
 
@@ -1087,28 +1206,38 @@ func BdosSysCallRenameFile(cpm *CPM) error {
 	// Get the actual name
 	fileName := fcbPtr.GetFileName()
 
+	// drive will default to our current drive, if the FCB drive field is 0
+	drive := cpm.currentDrive + 'A'
+	if fcbPtr.Drive != 0 {
+		drive = fcbPtr.Drive + 'A' - 1
+	}
+
+	// Mounted archives are read-only.
+	if cpm.isMounted(drive) {
+		slog.Debug("Renaming file failed, drive is read-only",
+			slog.String("drive", string(drive)))
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
+	}
+
 	// Point to the directory
-	path := cpm.drives[string(cpm.currentDrive+'A')]
+	path := cpm.drives[string(drive)]
 
 	//
 	// Ok we have a filename, but we probably have an upper-case
-	// filename.
+	// filename, or the alias of a host file with a long name.
 	//
-	// Run a glob, and if there's an existing file with the same
-	// name then replace with the mixed/lower cased version.
+	// If there's an existing file with the same name then replace
+	// with the mixed/lower cased, or long, version.
 	//
-	files, err2 := os.ReadDir(path)
-	if err2 == nil {
-		for _, n := range files {
-			if strings.ToUpper(n.Name()) == fileName {
-				fileName = n.Name()
-			}
-		}
+	// The name comes from the program, so we also ensure it is
+	// safe to use upon the host.
+	fileName, err := cpm.hostPath(drive, fileName)
+	if err != nil {
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
 	}
 
-	// Ensure the filename is qualified
-	fileName = filepath.Join(path, fileName)
-
 	// 2. DEST
 	// The pointer to the FCB
 	xxx2 := cpm.Memory.GetRange(ptr+16, fcb.SIZE)
@@ -1119,6 +1248,15 @@ func BdosSysCallRenameFile(cpm *CPM) error {
 	// Get the name
 	dstName := dstPtr.GetFileName()
 
+	// Which must also be safe to use.
+	if !fcb.IsValidName(dstName) {
+		slog.Warn("Refusing to rename to invalid filename",
+			slog.String("drive", string(drive)),
+			slog.String("name", dstName))
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
+	}
+
 	// ensure the name is qualified
 	dstName = filepath.Join(path, dstName)
 
@@ -1126,7 +1264,7 @@ func BdosSysCallRenameFile(cpm *CPM) error {
 		slog.String("src", fileName),
 		slog.String("dst", dstName))
 
-	err := os.Rename(fileName, dstName)
+	err = os.Rename(fileName, dstName)
 	if err != nil {
 		slog.Debug("Renaming file failed",
 			slog.String("error", err.Error()))
@@ -1196,10 +1334,15 @@ func BdosSysCallDriveSetRO(cpm *CPM) error {
 // BdosSysCallDriveROVec will return a bitfield describing which drives are read-only.
 //
 // Bit 7 of H corresponds to P: while bit 0 of L corresponds to A:. A bit is set if the corresponding drive is
-// set to read-only in software.  As we never set drives to read-only we return 0x0000
+// set to read-only in software.  The only read-only drives we have are those with archives mounted upon them.
 func BdosSysCallDriveROVec(cpm *CPM) error {
-	cpm.CPU.States.HL.Hi = 0x00
-	cpm.CPU.States.HL.Lo = 0x00
+	var vec uint16
+	for i := uint8(0); i < 16; i++ {
+		if cpm.isMounted('A' + i) {
+			vec |= 1 << i
+		}
+	}
+	cpm.CPU.States.HL.SetU16(vec)
 	return nil
 }
 
@@ -1244,52 +1387,14 @@ func BdosSysCallUserNumber(cpm *CPM) error {
 }
 
 // BdosSysCallReadRand reads a random block from the FCB pointed to by DE into the DMA area.
+//
+// The return codes are:
+//
+//	0: success
+//	1: reading unwritten data
+//	4: seek to an unwritten extent
+//	6: seek past the end of the disk, i.e. the record is too large
 func BdosSysCallReadRand(cpm *CPM) error {
-	// Temporary area to read into
-	data := make([]byte, blkSize)
-
-	// sysRead reads from the given offset
-	//
-	// Return:
-	//  0 : read something successfully
-	//  1 : read nothing - error really
-	//
-	sysRead := func(f *os.File, offset int64) int {
-
-		// Get file size, in bytes
-		fi, err := f.Stat()
-		if err != nil {
-			fmt.Printf("ReadRand:failed to get file size of: %s", err)
-		}
-		fileSize := fi.Size()
-
-		// If the offset we're reading from is bigger than the file size then
-		// pad it up
-		if offset > fileSize {
-			return 06
-		}
-
-		_, err = f.Seek(offset, io.SeekStart)
-		if err != nil {
-			fmt.Printf("cannot seek to position %d: %s", offset, err)
-			return 0xFF
-		}
-
-		for i := range data {
-			data[i] = 0x1A
-		}
-
-		_, err = f.Read(data)
-		if err != nil {
-			if err != io.EOF {
-				fmt.Printf("failed to read offset %d: %s", offset, err)
-				return 0xFF
-			}
-		}
-
-		cpm.Memory.SetRange(cpm.dma, data...)
-		return 0
-	}
 
 	// The pointer to the FCB
 	ptr := cpm.CPU.States.DE.U16()
@@ -1300,53 +1405,110 @@ func BdosSysCallReadRand(cpm *CPM) error {
 	// Create a structure with the contents
 	fcbPtr := fcb.FromBytes(xxx)
 
-	// Get our cache-key from the FCB
-	key := uint16(uint16(fcbPtr.Al[1])<<8 + uint16(fcbPtr.Al[0]))
-
 	// Get the file handle in our cache.
-	obj, ok := cpm.files[key]
+	obj, ok := cpm.getFile(fcbPtr)
 	if !ok {
 		slog.Error("SysCallReadRand: Attempting to read from a file that isn't open")
 		cpm.CPU.States.AF.Hi = 0xFF
 		return nil
 	}
 
-	// A virtual handle, from our embedded resources.
-	if obj.handle == nil {
-		return fmt.Errorf("fatal error SysCallReadRand against an embedded resource %v", obj)
-	}
-
 	// Get the record to read
-	record := int(int(fcbPtr.R2)<<16) | int(int(fcbPtr.R1)<<8) | int(fcbPtr.R0)
+	record := fcbPtr.GetRandomRecord()
 
 	// Translate the record to a byte-offset
 	fpos := int64(record) * blkSize
 
+	// Get file size, in bytes, and the place to read from - which
+	// is the contents we already have for a virtual file.
+	var in io.ReaderAt = bytes.NewReader(obj.data)
+	size := int64(len(obj.data))
+	handle := -1
+	if obj.handle != nil {
+		fi, err := obj.handle.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to get file size of %s: %s", obj.name, err)
+		}
+		in = obj.handle
+		size = fi.Size()
+		handle = int(obj.handle.Fd())
+	}
+	records := sizeInRecords(size)
+
+	// Work out what we can do
+	res := 0
+	switch {
+	case record >= fcb.MaxRecords:
+		res = 6
+	case record >= records && record/fcb.RecordsPerExtent >= (records+fcb.RecordsPerExtent-1)/fcb.RecordsPerExtent:
+		res = 4
+	case record >= records:
+		res = 1
+	case obj.handle != nil && !obj.isAllocated(fpos):
+		res = 1
+	}
+
 	// Read the data
-	res := sysRead(obj.handle, fpos)
+	if res == 0 {
+		data := make([]byte, blkSize)
+		for i := range data {
+			data[i] = 0x1A
+		}
+
+		_, err := in.ReadAt(data, fpos)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read offset %d: %s", fpos, err)
+		}
+
+		cpm.Memory.SetRange(cpm.dma, data...)
+	}
 
 	// Add logging of the result and details.
 	slog.Debug("SysCallReadRand",
 		slog.Int("dma", int(cpm.dma)),
 		slog.Int("fcb", int(ptr)),
-		slog.Int("handle", int(obj.handle.Fd())),
+		slog.Int("handle", handle),
 		slog.Int("record_count", int(fcbPtr.RC)),
 		slog.Int("record", record),
 		slog.Int64("fpos", fpos),
 		slog.Int("result", res))
 
+	// The sequential position is now the record we've read, so a
+	// following sequential read will read it again.
+	if res < 4 {
+		fcbPtr.SetSequentialRecord(record)
+		fcbPtr.RC = fcbPtr.GetExtentRecords(records)
+	}
+
 	// Update the FCB in memory
 	cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
 
 	cpm.CPU.States.HL.Hi = 0x00
-	cpm.CPU.States.HL.Lo = 0x00
+	cpm.CPU.States.HL.Lo = uint8(res)
 	cpm.CPU.States.BC.Hi = 0x00
 	cpm.CPU.States.AF.Hi = uint8(res)
 	return nil
 }
 
 // BdosSysCallWriteRand writes a random block from DMA area to the FCB pointed to by DE.
+//
+// Writing past the end of the file leaves a gap, which will read as
+// zeros but is otherwise unwritten.
 func BdosSysCallWriteRand(cpm *CPM) error {
+	return writeRandom(cpm, false)
+}
+
+// BdosSysCallWriteRandZero writes a random block from DMA area to the FCB pointed to by DE.
+//
+// This is the same as BdosSysCallWriteRand except that any block which
+// is newly allocated for the record is filled with zeros.
+func BdosSysCallWriteRandZero(cpm *CPM) error {
+	return writeRandom(cpm, true)
+}
+
+// writeRandom is the implementation of BdosSysCallWriteRand and
+// BdosSysCallWriteRandZero.
+func writeRandom(cpm *CPM, zeroFill bool) error {
 
 	// The pointer to the FCB
 	ptr := cpm.CPU.States.DE.U16()
@@ -1357,71 +1519,85 @@ func BdosSysCallWriteRand(cpm *CPM) error {
 	// Create a structure with the contents
 	fcbPtr := fcb.FromBytes(xxx)
 
-	// Get our cache-key from the FCB
-	key := uint16(uint16(fcbPtr.Al[1])<<8 + uint16(fcbPtr.Al[0]))
-
 	// Get the file handle in our cache.
-	obj, ok := cpm.files[key]
+	obj, ok := cpm.getFile(fcbPtr)
 	if !ok {
 		slog.Error("SysCallWriteRand: Attempting to write to a file that isn't open")
 		cpm.CPU.States.AF.Hi = 0xFF
 		return nil
 	}
 
-	// A virtual handle, from our embedded resources.
+	// A virtual file, which is read-only.
 	if obj.handle == nil {
-		return fmt.Errorf("fatal error SysCallWriteRand against an embedded resource %v", obj)
+		slog.Warn("SysCallWriteRand: Attempting to write to a read-only file",
+			slog.String("path", obj.name))
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
 	}
 
 	// Get the data range from the DMA area
 	data := cpm.Memory.GetRange(cpm.dma, 128)
 
 	// Get the record to write
-	record := int(int(fcbPtr.R2)<<16) | int(int(fcbPtr.R1)<<8) | int(fcbPtr.R0)
+	record := fcbPtr.GetRandomRecord()
+
+	// Is the record too large?
+	if record >= fcb.MaxRecords {
+		cpm.CPU.States.AF.Hi = 0x06
+		cpm.CPU.States.HL.Hi = 0x00
+		cpm.CPU.States.HL.Lo = 0x06
+		cpm.CPU.States.BC.Hi = 0x00
+		return nil
+	}
 
 	// Get the file position that translates to
 	fpos := int64(record) * blkSize
 
-	// Get file size, in bytes
-	fi, err := obj.handle.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to get file size of: %s", err)
-	}
-	fileSize := fi.Size()
+	// The block the record is within, on a real disk.
+	block := (fpos / allocBlockSize) * allocBlockSize
 
-	// If the offset we're writing to is bigger than the file size then
-	// we need to add an appropriate amount of padding.
-	padding := fpos - fileSize
+	// Zero-fill the block, if it is newly allocated.
+	//
+	// Otherwise writing past the end of the file leaves a gap,
+	// which reads as zeros, but is still "unwritten".
+	zero := zeroFill && !obj.isAllocated(block)
 
 	// Add logging of the result and details.
 	slog.Debug("SysCallWriteRand",
 		slog.Int("dma", int(cpm.dma)),
 		slog.Int("fcb", int(ptr)),
-		slog.Int("padding", int(padding)),
+		slog.Bool("zero_fill", zero),
 		slog.Int("handle", int(obj.handle.Fd())),
 		slog.Int("record_count", int(fcbPtr.RC)),
 		slog.Int("record", record),
 		slog.Int64("fpos", fpos))
 
-	for padding > 0 {
-		_, er := obj.handle.Write([]byte{0x00})
-		if er != nil {
-			return fmt.Errorf("error adding padding: %s", er)
+	// We only fill the part of the block before the record, as
+	// the file doesn't need to grow past the record we're writing.
+	if zero && fpos > block {
+		_, err := obj.handle.WriteAt(make([]byte, fpos-block), block)
+		if err != nil {
+			return fmt.Errorf("error zero-filling block at %d: %s", block, err)
 		}
-		padding--
 	}
 
-	_, err = obj.handle.Seek(fpos, io.SeekStart)
+	_, err := obj.handle.WriteAt(data, fpos)
 	if err != nil {
-		return fmt.Errorf("cannot seek to position %d: %s", fpos, err)
+		return fmt.Errorf("failed to write to offset %d: %s", fpos, err)
 	}
+	obj.written = true
+	obj.allocate(fpos, blkSize)
 
-	_, err = obj.handle.Write(data)
+	// Get file size, in bytes, now we've written to it.
+	fi, err := obj.handle.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to write to offset %d: %s", fpos, err)
+		return fmt.Errorf("failed to get file size of %s: %s", obj.name, err)
 	}
 
-	fcbPtr.IncreaseSequentialOffset()
+	// The sequential position is now the record we've written, so a
+	// following sequential write will write it again.
+	fcbPtr.SetSequentialRecord(record)
+	fcbPtr.RC = fcbPtr.GetExtentRecords(sizeInRecords(fi.Size()))
 
 	// Update the FCB in memory
 	cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
@@ -1458,31 +1634,52 @@ func BdosSysCallFileSize(cpm *CPM) error {
 	// Get the actual name
 	fileName := fcbPtr.GetFileName()
 
-	// Should we remap drives?
-	path := cpm.drives[string(cpm.currentDrive+'A')]
+	// drive will default to our current drive, if the FCB drive field is 0
+	drive := cpm.currentDrive + 'A'
+	if fcbPtr.Drive != 0 {
+		drive = fcbPtr.Drive + 'A' - 1
+	}
+
+	// Virtual files have a known size.
+	virt, err := cpm.readVirtualFile(drive, fileName)
+	if err == nil {
+		fcbPtr.SetRandomRecord(sizeInRecords(int64(len(virt))))
+
+		cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
+		cpm.CPU.States.AF.Hi = 0x00
+		return nil
+	}
+
+	// Files upon the host aren't visible on a drive with an
+	// archive mounted.
+	if cpm.isMounted(drive) {
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
+	}
 
 	//
 	// Ok we have a filename, but we probably have an upper-case
-	// filename.
+	// filename, or the alias of a host file with a long name.
 	//
-	// Run a glob, and if there's an existing file with the same
-	// name then replace with the mixed/lower cased version.
+	// If there's an existing file with the same name then replace
+	// with the mixed/lower cased, or long, version.
 	//
-	files, err2 := os.ReadDir(path)
-	if err2 == nil {
-		for _, n := range files {
-			if strings.ToUpper(n.Name()) == fileName {
-				fileName = n.Name()
-			}
-		}
+	// The name comes from the program, so we also ensure it is
+	// safe to use upon the host.
+	fileName, err = cpm.hostPath(drive, fileName)
+	if err != nil {
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
 	}
 
-	// esnure the path is qualified
-	fileName = filepath.Join(path, fileName)
-
 	file, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to open file for FileSize %s:%s", fileName, err)
+		slog.Debug("SysCallFileSize: failed to open file",
+			slog.String("path", fileName),
+			slog.String("error", err.Error()))
+
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
 	}
 
 	// ensure we close
@@ -1494,20 +1691,15 @@ func BdosSysCallFileSize(cpm *CPM) error {
 		return fmt.Errorf("failed to get file size of %s: %s", fileName, err)
 	}
 
-	// Now we have the size we need to turn it into the number
-	// of records
-	records := int(fi.Size() / 128)
-
-	// Store the value in the three fields
-	fcbPtr.R0 = uint8(records & 0xFF)
-	fcbPtr.R1 = uint8(records >> 8)
-	fcbPtr.R2 = uint8(records >> 16)
+	// Text files are larger once translated.
+	size := cpm.textSize(drive, fileName, fi.Size())
 
-	// sanity check because I've messed this up in the past
-	n := int(int(fcbPtr.R2)<<16) | int(int(fcbPtr.R1)<<8) | int(fcbPtr.R0)
-	if n != records {
-		return fmt.Errorf("failed to update because maths is hard %d != %d", n, records)
-	}
+	// Now we have the size we need to turn it into the number
+	// of records, and store it in the random record fields.
+	//
+	// Note that a file of the maximum size will set R2 to
+	// show the overflow.
+	fcbPtr.SetRandomRecord(sizeInRecords(size))
 
 	// Update the FCB in memory
 	cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
@@ -1529,19 +1721,9 @@ func BdosSysCallRandRecord(cpm *CPM) error {
 	// Create a structure with the contents
 	fcbPtr := fcb.FromBytes(xxx)
 
-	// So the sequential offset is found here
-	offset := int(fcbPtr.GetSequentialOffset())
-
-	// Now we set the "random record" which is R0,R1,R2
-	fcbPtr.R0 = uint8(offset & 0xFF)
-	fcbPtr.R1 = uint8(offset >> 8)
-	fcbPtr.R2 = uint8(offset >> 16)
-
-	// sanity check because I've messed this up in the past
-	n := int(int(fcbPtr.R2)<<16) | int(int(fcbPtr.R1)<<8) | int(fcbPtr.R0)
-	if n != offset {
-		return fmt.Errorf("failed to update because maths is hard %d != %d", n, offset)
-	}
+	// Now we set the "random record" which is R0,R1,R2, to the
+	// record the sequential calls would use next.
+	fcbPtr.SetRandomRecord(fcbPtr.GetSequentialRecord())
 
 	// Update the FCB in memory.
 	cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
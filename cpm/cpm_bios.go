@@ -15,10 +15,35 @@ import (
 	"golang.org/x/term"
 
 	"github.com/skx/cpmulator/ccp"
-	"github.com/skx/cpmulator/consoleout"
 	"github.com/skx/cpmulator/version"
 )
 
+// biosPort is the I/O port which our BIOS trampolines write to, with the
+// number of the BIOS function to invoke.
+const biosPort = 0xFF
+
+// defaultBiosAddr is the default address of our fake BIOS jump table,
+// which is followed by the trampolines which invoke our BIOS functions.
+const defaultBiosAddr = 0xFE00
+
+// biosEntries is the number of entries in our BIOS jump table.
+const biosEntries = 30
+
+// biosSize is the size of the BIOS jump table and trampolines, each entry
+// has a three byte jump and a five byte trampoline.
+const biosSize = biosEntries * 8
+
+// defaultBdosAddr is the default address of our fake BDOS, which is where
+// the jump at 0x0005 claims to go, and so marks the top of the TPA.
+const defaultBdosAddr = 0xF000
+
+// bdosSize is the size of the region reserved for our fake BDOS.
+const bdosSize = 8
+
+// stackSize is the amount of memory we leave above our BIOS, for the
+// stack of programs which don't set their own.
+const stackSize = 0x100
+
 // BiosSysCallColdBoot handles a cold boot.
 func BiosSysCallColdBoot(cpm *CPM) error {
 
@@ -41,7 +66,7 @@ func BiosSysCallWarmBoot(cpm *CPM) error {
 // pending, otherwise 0xFF.
 func BiosSysCallConsoleStatus(cpm *CPM) error {
 
-	if cpm.input.PendingInput() {
+	if cpm.conReady() {
 		cpm.CPU.States.AF.Hi = 0xFF
 	} else {
 		cpm.CPU.States.AF.Hi = 0x00
@@ -54,7 +79,7 @@ func BiosSysCallConsoleStatus(cpm *CPM) error {
 // and return the character pressed in the A-register.
 func BiosSysCallConsoleInput(cpm *CPM) error {
 
-	out, err := cpm.input.BlockForCharacterNoEcho()
+	out, err := cpm.conRead()
 	if err != nil {
 		return err
 	}
@@ -69,9 +94,7 @@ func BiosSysCallConsoleOutput(cpm *CPM) error {
 
 	// Write the character in C to the screen.
 	c := cpm.CPU.States.BC.Lo
-	cpm.output.PutCharacter(c)
-
-	return nil
+	return cpm.conWrite(c)
 }
 
 // BiosSysCallPrintChar should print the specified character, in the C-register,
@@ -82,17 +105,21 @@ func BiosSysCallPrintChar(cpm *CPM) error {
 	c := cpm.CPU.States.BC.Lo
 
 	// Write the character to the printer
-	err := cpm.prnC(c)
+	err := cpm.listWrite(c)
 	return err
 }
 
 // BiosSysCallPrinterStatus returns status of current printer device.
 //
-// This is fake, and always returns "ready".
+// The printer is ready if output is configured, and writing to it
+// hasn't previously failed.
 func BiosSysCallPrinterStatus(cpm *CPM) error {
 
-	// Ready
-	cpm.CPU.States.AF.Hi = 0xFF
+	if cpm.listReady() {
+		cpm.CPU.States.AF.Hi = 0xFF
+	} else {
+		cpm.CPU.States.AF.Hi = 0x00
+	}
 	return nil
 }
 
@@ -106,23 +133,113 @@ func BiosSysCallScreenOutputStatus(cpm *CPM) error {
 	return nil
 }
 
+// BiosSysCallPunch should write a single character, in the C-register,
+// to the auxiliary output device.
+func BiosSysCallPunch(cpm *CPM) error {
+
+	c := cpm.CPU.States.BC.Lo
+	return cpm.punchWrite(c)
+}
+
+// BiosSysCallReader should block for a single character from the
+// auxiliary input device, and return it in the A-register.
+func BiosSysCallReader(cpm *CPM) error {
+
+	c, err := cpm.readerRead()
+	if err != nil {
+		return err
+	}
+
+	cpm.CPU.States.AF.Hi = c
+	return nil
+}
+
 // BiosSysCallAuxInputStatus returns status of current auxiliary input device.
 //
-// This is fake, and always returns "ready".
+// If no device is configured the console is used instead.
 func BiosSysCallAuxInputStatus(cpm *CPM) error {
 
-	// Ready
-	cpm.CPU.States.AF.Hi = 0xFF
+	if cpm.readerReady() {
+		cpm.CPU.States.AF.Hi = 0xFF
+	} else {
+		cpm.CPU.States.AF.Hi = 0x00
+	}
 	return nil
 }
 
 // BiosSysCallAuxOutputStatus returns status of current auxiliary output device.
 //
-// This is fake, and always returns "ready".
+// If no device is configured the console is used instead, which is
+// always ready.
 func BiosSysCallAuxOutputStatus(cpm *CPM) error {
 
-	// Ready
-	cpm.CPU.States.AF.Hi = 0xFF
+	if cpm.punchReady() {
+		cpm.CPU.States.AF.Hi = 0xFF
+	} else {
+		cpm.CPU.States.AF.Hi = 0x00
+	}
+	return nil
+}
+
+// BiosSysCallMove copies BC bytes of memory from DE to HL, leaving both
+// pointing after the bytes copied.
+//
+// The copy is between the banks given to XMOVE, if it was called first,
+// otherwise within the selected bank.
+func BiosSysCallMove(cpm *CPM) error {
+
+	src := cpm.CPU.States.DE.U16()
+	dst := cpm.CPU.States.HL.U16()
+	count := cpm.CPU.States.BC.U16()
+
+	srcBank := cpm.Memory.Bank()
+	dstBank := cpm.Memory.Bank()
+	if cpm.xmove.set {
+		srcBank = cpm.xmove.src
+		dstBank = cpm.xmove.dst
+		cpm.xmove.set = false
+	}
+
+	// Copy a byte at a time, as LDIR would, so overlapping
+	// regions behave the same way.
+	for ; count > 0; count-- {
+		cpm.Memory.SetBank(dstBank, dst, cpm.Memory.GetBank(srcBank, src))
+		src++
+		dst++
+	}
+
+	cpm.CPU.States.DE.SetU16(src)
+	cpm.CPU.States.HL.SetU16(dst)
+	return nil
+}
+
+// BiosSysCallSelectMemory selects the memory bank given in A.
+func BiosSysCallSelectMemory(cpm *CPM) error {
+
+	bank := int(cpm.CPU.States.AF.Hi)
+	err := cpm.Memory.SelectBank(bank)
+	if err != nil {
+		return fmt.Errorf("SELMEM: %s", err)
+	}
+
+	slog.Debug("Selected memory bank",
+		slog.Int("bank", bank))
+	return nil
+}
+
+// BiosSysCallExtendedMove sets the banks which the next call to MOVE
+// copies between, the source in C and the destination in B.
+func BiosSysCallExtendedMove(cpm *CPM) error {
+
+	src := int(cpm.CPU.States.BC.Lo)
+	dst := int(cpm.CPU.States.BC.Hi)
+	if src >= cpm.Memory.Banks() || dst >= cpm.Memory.Banks() {
+		return fmt.Errorf("XMOVE: invalid memory banks %d and %d", src, dst)
+	}
+
+	cpm.xmove.src = src
+	cpm.xmove.dst = dst
+	cpm.xmove.set = true
 	return nil
 }
 
@@ -224,8 +341,11 @@ func BiosSysCallReserved1(cpm *CPM) error {
 		// Get the string pointed to by DE
 		str := getStringFromMemory(de)
 
-		// Output driver needs to be created
-		driver, err := consoleout.New(str)
+		old := cpm.output.GetName()
+
+		// Change the driver in-place, which will preserve any
+		// transcript which is being written.
+		err := cpm.output.ChangeDriver(str)
 
 		// If it failed we're not going to terminate the syscall, or
 		// the emulator, just ignore the attempt.
@@ -234,11 +354,8 @@ func BiosSysCallReserved1(cpm *CPM) error {
 			return nil
 		}
 
-		old := cpm.output.GetName()
-		cpm.output = driver
-
 		if old != str {
-			fmt.Printf("Console driver changed from %s to %s.\n", old, driver.GetName())
+			fmt.Printf("Console driver changed from %s to %s.\n", old, cpm.output.GetName())
 		}
 
 	// Get/Set the CCP
@@ -277,7 +394,8 @@ func BiosSysCallReserved1(cpm *CPM) error {
 		cpm.ccp = str
 
 		if old != str {
-			fmt.Printf("CCP changed to %s [%s] Size:0x%04X Entry-Point:0x%04X\n", str, entry.Description, len(entry.Bytes), entry.Start)
+			start, _ := cpm.ccpAddress(entry)
+			fmt.Printf("CCP changed to %s [%s] Size:0x%04X Entry-Point:0x%04X\n", str, entry.Description, len(entry.Bytes), start)
 		}
 
 	// Get/Set the quiet flag
@@ -336,6 +454,13 @@ func (cpm *CPM) BiosHandler(val uint8) {
 
 	// Lookup the handler
 	handler, ok := cpm.BIOSSyscalls[val]
+	cpm.recordSyscall("BIOS", val, handler.Desc)
+
+	// If we're continuing past unimplemented calls use our stub.
+	if !ok && cpm.continueUnimplemented {
+		handler = CPMHandler{Desc: "UNIMPLEMENTED", Handler: BiosSysCallUnimplemented}
+		ok = true
+	}
 
 	// If it doesn't exist we don't have it implemented.
 	if !ok {
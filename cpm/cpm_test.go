@@ -1,8 +1,20 @@
 package cpm
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/koron-go/z80"
+	"github.com/skx/cpmulator/ccp"
+	"github.com/skx/cpmulator/fcb"
+	"github.com/skx/cpmulator/memory"
 )
 
 // TestSimple ensures the most basic program runs
@@ -122,6 +134,9 @@ func TestPrinterOutput(t *testing.T) {
 		t.Fatalf("failed to write character to printer-file")
 	}
 
+	// Output is buffered, so we need to flush it.
+	obj.Cleanup()
+
 	// Read back the file.
 	var data []byte
 	data, err = os.ReadFile(file.Name())
@@ -241,3 +256,1771 @@ func TestCoverage(t *testing.T) {
 		t.Fatalf("expected unimplemented, got %s", obj.biosErr)
 	}
 }
+
+// TestIOByte tests that output is routed according to the IOBYTE.
+func TestIOByte(t *testing.T) {
+
+	// Create a printer-output file
+	file, err := os.CreateTemp("", "tst-*.prn")
+	if err != nil {
+		t.Fatalf("failed to create temporary file")
+	}
+	defer os.Remove(file.Name())
+
+	obj, err := New(WithConsoleDriver("null"), WithPrinterPath(file.Name()))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+
+	err = obj.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP")
+	}
+
+	// The default IOBYTE should be setup.
+	if obj.Memory.Get(0x0003) != defaultIOByte {
+		t.Fatalf("IOBYTE has the wrong default")
+	}
+
+	// LST:=LPT: - goes to the printer.
+	err = obj.listWrite('s')
+	if err != nil {
+		t.Fatalf("failed to write to list device")
+	}
+
+	// LST:=TTY: - goes to the console.
+	obj.Memory.Set(0x0003, 0x15)
+	err = obj.listWrite('x')
+	if err != nil {
+		t.Fatalf("failed to write to list device")
+	}
+
+	// CON:=BAT: LST:=LPT: - console output goes to the printer.
+	obj.Memory.Set(0x0003, 0x96)
+	err = obj.conWrite('k')
+	if err != nil {
+		t.Fatalf("failed to write to console device")
+	}
+
+	obj.Cleanup()
+
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("failed to read from file")
+	}
+	if string(data) != "sk" {
+		t.Fatalf("printer output had the wrong content '%s'", data)
+	}
+}
+
+// TestFindFirst tests that directory searches return one entry per extent,
+// rotating through the slots of the DMA area.
+func TestFindFirst(t *testing.T) {
+
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "BIG.TXT"), make([]byte, 40*1024), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file")
+	}
+	err = os.WriteFile(filepath.Join(dir, "SMALL.TXT"), make([]byte, 300), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file")
+	}
+
+	obj, err := New(WithConsoleDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	err = obj.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP")
+	}
+	obj.SetDrivePath("B", dir)
+
+	// search runs a find-first, or find-next, for the given FCB and
+	// returns the directory entry which was found.
+	search := func(f func(*CPM) error, pattern fcb.FCB) []uint8 {
+		obj.Memory.SetRange(0x005C, pattern.AsBytes()...)
+		obj.CPU.States.DE.SetU16(0x005C)
+		err := f(obj)
+		if err != nil {
+			t.Fatalf("search failed: %s", err)
+		}
+		code := obj.CPU.States.AF.Hi
+		if code == 0xFF {
+			return nil
+		}
+		if code > 3 {
+			t.Fatalf("bogus directory code %02X", code)
+		}
+		start := obj.dma + uint16(code)*32
+		return obj.Memory.GetRange(start, 32)
+	}
+
+	// Search B: for the first extent of all files.
+	pattern := fcb.FromString("*.TXT")
+	pattern.Drive = 2
+	ent := search(BdosSysCallFindFirst, pattern)
+	if string(ent[1:12]) != "BIG     TXT" || ent[12] != 0 || ent[15] != 0x80 {
+		t.Fatalf("wrong first entry %v", ent)
+	}
+	if ent[16] == 0 || ent[31] == 0 {
+		t.Fatalf("allocation map is not populated %v", ent)
+	}
+	ent = search(BdosSysCallFindNext, pattern)
+	if string(ent[1:12]) != "SMALL   TXT" || ent[15] != 3 {
+		t.Fatalf("wrong second entry %v", ent)
+	}
+	if obj.CPU.States.AF.Hi != 1 {
+		t.Fatalf("wrong directory code for the second entry")
+	}
+	ent = search(BdosSysCallFindNext, pattern)
+	if ent != nil {
+		t.Fatalf("unexpected third entry %v", ent)
+	}
+
+	// Now search for all extents.
+	pattern.Ex = '?'
+	expected := []struct {
+		name string
+		ex   uint8
+		rc   uint8
+	}{
+		{"BIG     TXT", 0, 0x80},
+		{"BIG     TXT", 1, 0x80},
+		{"BIG     TXT", 2, 0x40},
+		{"SMALL   TXT", 0, 3},
+	}
+	f := BdosSysCallFindFirst
+	for i, e := range expected {
+		ent = search(f, pattern)
+		f = BdosSysCallFindNext
+
+		if ent == nil {
+			t.Fatalf("missing entry %d", i)
+		}
+		if obj.CPU.States.AF.Hi != uint8(i%4) {
+			t.Fatalf("wrong directory code for entry %d", i)
+		}
+		if string(ent[1:12]) != e.name || ent[12] != e.ex || ent[15] != e.rc {
+			t.Fatalf("wrong entry %d: %v", i, ent)
+		}
+	}
+	if search(f, pattern) != nil {
+		t.Fatalf("unexpected extra entry")
+	}
+
+	// A file larger than 512K has extents in a second module, which
+	// are found via S2.
+	huge, err := os.Create(filepath.Join(dir, "HUGE.DAT"))
+	if err != nil {
+		t.Fatalf("failed to create file")
+	}
+	err = huge.Truncate(600 * 1024)
+	huge.Close()
+	if err != nil {
+		t.Fatalf("failed to size file")
+	}
+	pattern = fcb.FromString("HUGE.DAT")
+	pattern.Drive = 2
+	pattern.Ex = 2
+	pattern.S2 = 1
+	ent = search(BdosSysCallFindFirst, pattern)
+	if ent == nil || ent[12] != 2 || ent[14] != 1 || ent[15] != 0x80 {
+		t.Fatalf("wrong entry in the second module %v", ent)
+	}
+	if search(BdosSysCallFindNext, pattern) != nil {
+		t.Fatalf("unexpected extra entry")
+	}
+
+	// "?" in the drive returns every entry on the current drive, regardless
+	// of the name in the FCB, once, for the current user.
+	obj.currentDrive = 1
+	obj.userNumber = 3
+	pattern = fcb.FromString("NOPE.COM")
+	pattern.Drive = '?'
+	f = BdosSysCallFindFirst
+	count := 0
+	blocks := make(map[uint8]bool)
+	for ent = search(f, pattern); ent != nil; ent = search(f, pattern) {
+		f = BdosSysCallFindNext
+		count++
+
+		if ent[0] != 3 {
+			t.Fatalf("wrong user for entry %d: %v", count, ent)
+		}
+
+		// Every block has a different number.
+		for _, b := range ent[16:32] {
+			if b != 0 && blocks[b] {
+				t.Fatalf("block %d is used twice", b)
+			}
+			blocks[b] = true
+		}
+	}
+
+	// BIG.TXT has three extents, HUGE.DAT 38, and SMALL.TXT one.
+	if count != 3+38+1 {
+		t.Fatalf("wrong number of entries %d", count)
+	}
+}
+
+// TestTextMode tests that text files are translated when read and written.
+func TestTextMode(t *testing.T) {
+
+	if string(textToHost(textToCPM([]byte("a\nb\r\nc")))) != "a\nb\nc" {
+		t.Fatalf("text didn't survive the round-trip")
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notes.txt")
+	err := os.WriteFile(path, []byte("hello\nworld\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file")
+	}
+
+	obj, err := New(WithConsoleDriver("null"), WithTextExtensions("txt,asm"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	err = obj.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP")
+	}
+	obj.SetDrivePath("A", dir)
+
+	// call invokes the given syscall against our FCB.
+	call := func(f func(*CPM) error) {
+		obj.CPU.States.DE.SetU16(0x005C)
+		err := f(obj)
+		if err != nil {
+			t.Fatalf("syscall failed: %s", err)
+		}
+	}
+
+	x := fcb.FromString("NOTES.TXT")
+	obj.Memory.SetRange(0x005C, x.AsBytes()...)
+	call(BdosSysCallFileOpen)
+	if obj.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to open file")
+	}
+
+	// Reading should give us CR/LF line-endings, and ^Z padding.
+	call(BdosSysCallRead)
+	data := obj.Memory.GetRange(obj.dma, 128)
+	if string(data[:14]) != "hello\r\nworld\r\n" || data[14] != 0x1A || data[127] != 0x1A {
+		t.Fatalf("unexpected record %v", data)
+	}
+
+	// Closing without changes should leave the file alone.
+	call(BdosSysCallFileClose)
+	if out, _ := os.ReadFile(path); string(out) != "hello\nworld\n" {
+		t.Fatalf("file was modified: %s", out)
+	}
+
+	// Now overwrite the first record.
+	obj.Memory.SetRange(0x005C, x.AsBytes()...)
+	call(BdosSysCallFileOpen)
+	record := make([]uint8, 128)
+	for i := range record {
+		record[i] = 0x1A
+	}
+	copy(record, "bye\r\n")
+	obj.Memory.SetRange(obj.dma, record...)
+	call(BdosSysCallWrite)
+	call(BdosSysCallFileClose)
+
+	if out, _ := os.ReadFile(path); string(out) != "bye\n" {
+		t.Fatalf("file has the wrong content: %v", out)
+	}
+
+	// Upon a text drive binary files are left alone.
+	textDir := t.TempDir()
+	program := []byte{0x3E, 0x0A, 0xC9, 0x0A, 0x1A}
+	err = os.WriteFile(filepath.Join(textDir, "PROG.COM"), program, 0644)
+	if err != nil {
+		t.Fatalf("failed to write file")
+	}
+	err = os.WriteFile(filepath.Join(textDir, "DATA.DAT"), []byte{0x00, 0x0A, 0x0A}, 0644)
+	if err != nil {
+		t.Fatalf("failed to write file")
+	}
+	err = os.WriteFile(filepath.Join(textDir, "LINES.DOC"), bytes.Repeat([]byte("x\n"), 64), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file")
+	}
+	obj, err = New(WithConsoleDriver("null"), WithTextDrives("B"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	err = obj.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP")
+	}
+	obj.SetDrivePath("B", textDir)
+	for name, contents := range map[string][]byte{"PROG.COM": program, "DATA.DAT": {0x00, 0x0A, 0x0A}} {
+		x = fcb.FromString(name)
+		x.Drive = 2
+		obj.Memory.SetRange(0x005C, x.AsBytes()...)
+		call(BdosSysCallFileOpen)
+		if obj.CPU.States.AF.Hi != 0x00 {
+			t.Fatalf("failed to open %s", name)
+		}
+		call(BdosSysCallRead)
+		if !bytes.Equal(obj.Memory.GetRange(obj.dma, len(contents)), contents) {
+			t.Fatalf("%s was translated", name)
+		}
+		call(BdosSysCallFileClose)
+	}
+
+	// Text files are larger once translated, which their size and
+	// directory entry show.
+	x = fcb.FromString("LINES.DOC")
+	x.Drive = 2
+	obj.Memory.SetRange(0x005C, x.AsBytes()...)
+	call(BdosSysCallFileSize)
+	if obj.Memory.Get(0x005C+33) != 2 {
+		t.Fatalf("wrong size for a text file %d", obj.Memory.Get(0x005C+33))
+	}
+	obj.Memory.SetRange(0x005C, x.AsBytes()...)
+	call(BdosSysCallFindFirst)
+	if obj.CPU.States.AF.Hi > 3 || obj.Memory.Get(obj.dma+uint16(obj.CPU.States.AF.Hi)*32+15) != 2 {
+		t.Fatalf("wrong record count in the directory entry for a text file")
+	}
+
+	// Binary files created upon a text drive are written untranslated.
+	x = fcb.FromString("NEW.DAT")
+	x.Drive = 2
+	obj.Memory.SetRange(0x005C, x.AsBytes()...)
+	call(BdosSysCallMakeFile)
+	record = make([]uint8, 128)
+	record[1] = 0x0A
+	record[2] = 0x1A
+	obj.Memory.SetRange(obj.dma, record...)
+	call(BdosSysCallWrite)
+	call(BdosSysCallFileClose)
+	if out, _ := os.ReadFile(filepath.Join(textDir, "NEW.DAT")); !bytes.Equal(out, record) {
+		t.Fatalf("binary file was translated: %v", out)
+	}
+}
+
+// TestExtents tests that large files are handled across extents.
+func TestExtents(t *testing.T) {
+
+	dir := t.TempDir()
+
+	obj, err := New(WithConsoleDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	err = obj.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP")
+	}
+	obj.SetDrivePath("A", dir)
+
+	// call invokes the given syscall against the FCB, and returns
+	// the updated FCB along with the result.
+	call := func(f func(*CPM) error, x fcb.FCB) (fcb.FCB, uint8) {
+		obj.Memory.SetRange(0x005C, x.AsBytes()...)
+		obj.CPU.States.DE.SetU16(0x005C)
+		err := f(obj)
+		if err != nil {
+			t.Fatalf("syscall failed: %s", err)
+		}
+		return fcb.FromBytes(obj.Memory.GetRange(0x005C, fcb.SIZE)), obj.CPU.States.AF.Hi
+	}
+
+	// Write 130 records, sequentially.
+	x := fcb.FromString("BIG.DAT")
+	x, res := call(BdosSysCallMakeFile, x)
+	if res != 0 {
+		t.Fatalf("failed to create file")
+	}
+	for i := 0; i < 130; i++ {
+		obj.Memory.SetRange(obj.dma, make([]uint8, 128)...)
+		obj.Memory.Set(obj.dma, uint8(i))
+		x, res = call(BdosSysCallWrite, x)
+		if res != 0 {
+			t.Fatalf("failed to write record %d", i)
+		}
+		if i == 127 && (x.Ex != 0 || x.Cr != 128 || x.RC != 128) {
+			t.Fatalf("wrong position at the end of the first extent %v", x)
+		}
+	}
+	if x.Ex != 1 || x.Cr != 2 || x.RC != 2 {
+		t.Fatalf("wrong position after writing %v", x)
+	}
+
+	// The random record should be the next one.
+	x, _ = call(BdosSysCallRandRecord, x)
+	if x.GetRandomRecord() != 130 {
+		t.Fatalf("wrong random record %d", x.GetRandomRecord())
+	}
+	_, _ = call(BdosSysCallFileClose, x)
+
+	// Open the second extent, and read from it.
+	x = fcb.FromString("BIG.DAT")
+	x.Ex = 1
+	x, res = call(BdosSysCallFileOpen, x)
+	if res != 0 || x.RC != 2 {
+		t.Fatalf("failed to open the second extent %v", x)
+	}
+	x, res = call(BdosSysCallRead, x)
+	if res != 0 || obj.Memory.Get(obj.dma) != 128 {
+		t.Fatalf("read the wrong record")
+	}
+
+	// Random reads past the end of the file.
+	for record, code := range map[int]uint8{129: 0, 130: 1, 300: 4, fcb.MaxRecords: 6} {
+		x.SetRandomRecord(record)
+		x, res = call(BdosSysCallReadRand, x)
+		if res != code {
+			t.Fatalf("reading record %d gave %d not %d", record, res, code)
+		}
+	}
+	_, _ = call(BdosSysCallFileClose, x)
+
+	// The third extent doesn't exist.
+	x = fcb.FromString("BIG.DAT")
+	x.Ex = 2
+	_, res = call(BdosSysCallFileOpen, x)
+	if res != 0xFF {
+		t.Fatalf("opened a missing extent")
+	}
+
+	// Make the file larger than 8MB, and check the size.
+	err = os.Truncate(filepath.Join(dir, "BIG.DAT"), 9*1024*1024+1)
+	if err != nil {
+		t.Fatalf("failed to grow file")
+	}
+	x = fcb.FromString("BIG.DAT")
+	x, res = call(BdosSysCallFileSize, x)
+	if res != 0 || x.GetRandomRecord() != 9*8192+1 {
+		t.Fatalf("wrong file size %d", x.GetRandomRecord())
+	}
+
+	// A missing file has no size.
+	_, res = call(BdosSysCallFileSize, fcb.FromString("MISSING.DAT"))
+	if res != 0xFF {
+		t.Fatalf("found the size of a missing file")
+	}
+}
+
+// TestFileCache tests that open files are shared, and limited.
+func TestFileCache(t *testing.T) {
+
+	dir := t.TempDir()
+	for _, name := range []string{"ONE.TXT", "TWO.TXT"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatalf("failed to write file")
+		}
+	}
+
+	obj, err := New(WithConsoleDriver("null"), WithMaxOpenFiles(1))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	err = obj.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP")
+	}
+	obj.SetDrivePath("A", dir)
+
+	// call invokes the given syscall against an FCB at the given address.
+	call := func(f func(*CPM) error, addr uint16, name string) uint8 {
+		x := fcb.FromString(name)
+		obj.Memory.SetRange(addr, x.AsBytes()...)
+		obj.CPU.States.DE.SetU16(addr)
+		err := f(obj)
+		if err != nil {
+			t.Fatalf("syscall failed: %s", err)
+		}
+		return obj.CPU.States.AF.Hi
+	}
+
+	// Open the same file via two FCBs
+	if call(BdosSysCallFileOpen, 0x005C, "ONE.TXT") != 0 {
+		t.Fatalf("failed to open file")
+	}
+	if call(BdosSysCallFileOpen, 0x0200, "ONE.TXT") != 0 {
+		t.Fatalf("failed to open file twice")
+	}
+	if len(obj.files) != 1 || obj.hostHandles() != 1 {
+		t.Fatalf("file should only be open once")
+	}
+
+	// A copy of the FCB can be read from.
+	if call(BdosSysCallRead, 0x0300, "ONE.TXT") != 0 {
+		t.Fatalf("failed to read via a copied FCB")
+	}
+	if string(obj.Memory.GetRange(obj.dma, 7)) != "ONE.TXT" {
+		t.Fatalf("read the wrong data")
+	}
+
+	// We're at our limit.
+	if call(BdosSysCallFileOpen, 0x0200, "TWO.TXT") != 0xFF {
+		t.Fatalf("opened too many files")
+	}
+
+	// Closing once leaves it open
+	call(BdosSysCallFileClose, 0x005C, "ONE.TXT")
+	if len(obj.files) != 1 {
+		t.Fatalf("file was closed too soon")
+	}
+	call(BdosSysCallFileClose, 0x0200, "ONE.TXT")
+	if len(obj.files) != 0 {
+		t.Fatalf("file wasn't closed")
+	}
+
+	// Now we can open the other, and leak it.
+	if call(BdosSysCallFileOpen, 0x0200, "TWO.TXT") != 0 {
+		t.Fatalf("failed to open second file")
+	}
+	obj.closeLeakedFiles()
+	if len(obj.files) != 0 {
+		t.Fatalf("leaked file wasn't closed")
+	}
+
+	// Making a file which is open shares the handle, rather than
+	// closing it from underneath the other FCB.
+	if call(BdosSysCallFileOpen, 0x005C, "TWO.TXT") != 0 {
+		t.Fatalf("failed to open file")
+	}
+	if call(BdosSysCallMakeFile, 0x0200, "TWO.TXT") != 0 {
+		t.Fatalf("failed to make open file")
+	}
+	if obj.hostHandles() != 1 || obj.files[obj.fileKey(fcb.FromString("TWO.TXT"))].refs != 2 {
+		t.Fatalf("file should be shared")
+	}
+	call(BdosSysCallFileClose, 0x0200, "TWO.TXT")
+	if call(BdosSysCallRead, 0x005C, "TWO.TXT") != 0 {
+		t.Fatalf("failed to read after the other FCB was closed")
+	}
+	if string(obj.Memory.GetRange(obj.dma, 7)) != "TWO.TXT" {
+		t.Fatalf("read the wrong data")
+	}
+	obj.closeLeakedFiles()
+
+	_, err = New(WithMaxOpenFiles(0))
+	if err == nil {
+		t.Fatalf("expected an error with no open files allowed")
+	}
+}
+
+// TestFileCacheDriveChange tests that an open file can still be used after
+// the program changes the current drive and user number.
+func TestFileCacheDriveChange(t *testing.T) {
+
+	dirA := t.TempDir()
+	dirB := t.TempDir()
+	err := os.WriteFile(filepath.Join(dirA, "ONE.TXT"), []byte("ONE.TXT"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file")
+	}
+
+	obj, err := New(WithConsoleDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	err = obj.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP")
+	}
+	obj.SetDrivePath("A", dirA)
+	obj.SetDrivePath("B", dirB)
+
+	// Open the file, upon the current drive.
+	x := fcb.FromString("ONE.TXT")
+	obj.Memory.SetRange(0x005C, x.AsBytes()...)
+	obj.CPU.States.DE.SetU16(0x005C)
+	err = BdosSysCallFileOpen(obj)
+	if err != nil || obj.CPU.States.AF.Hi != 0 {
+		t.Fatalf("failed to open file")
+	}
+
+	// Change user, and drive.
+	obj.CPU.States.DE.SetU16(0x0005)
+	err = BdosSysCallUserNumber(obj)
+	if err != nil || obj.userNumber != 5 {
+		t.Fatalf("failed to change user")
+	}
+	obj.CPU.States.DE.SetU16(0x0001)
+	obj.CPU.States.AF.Hi = 0x01
+	err = BdosSysCallDriveSet(obj)
+	if err != nil || obj.currentDrive != 1 {
+		t.Fatalf("failed to change drive")
+	}
+
+	// The file can still be read, and closed.
+	obj.CPU.States.DE.SetU16(0x005C)
+	err = BdosSysCallRead(obj)
+	if err != nil || obj.CPU.States.AF.Hi != 0 {
+		t.Fatalf("failed to read after changing drive")
+	}
+	if string(obj.Memory.GetRange(obj.dma, 7)) != "ONE.TXT" {
+		t.Fatalf("read the wrong data")
+	}
+	obj.CPU.States.DE.SetU16(0x005C)
+	err = BdosSysCallFileClose(obj)
+	if err != nil || obj.CPU.States.AF.Hi != 0 {
+		t.Fatalf("failed to close after changing drive")
+	}
+	if len(obj.files) != 0 {
+		t.Fatalf("file wasn't closed")
+	}
+}
+
+// TestSparse tests that random writes leave unwritten gaps, and that
+// F_WRITEZF zero-fills the blocks it allocates.
+func TestSparse(t *testing.T) {
+
+	dir := t.TempDir()
+
+	// An existing file, all of which is data.
+	err := os.WriteFile(filepath.Join(dir, "OLD.DAT"), make([]byte, 4*blkSize), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file")
+	}
+
+	obj, err := New(WithConsoleDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	err = obj.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP")
+	}
+	obj.SetDrivePath("A", dir)
+
+	// call invokes the given syscall against the FCB, for the given record.
+	x := fcb.FromString("DB.DAT")
+	call := func(f func(*CPM) error, record int) uint8 {
+		x.SetRandomRecord(record)
+		obj.Memory.SetRange(0x005C, x.AsBytes()...)
+		obj.CPU.States.DE.SetU16(0x005C)
+		err := f(obj)
+		if err != nil {
+			t.Fatalf("syscall failed: %s", err)
+		}
+		return obj.CPU.States.AF.Hi
+	}
+
+	if call(BdosSysCallMakeFile, 0) != 0 {
+		t.Fatalf("failed to create file")
+	}
+
+	// Write records 100 and 203.
+	record := make([]uint8, blkSize)
+	for i := range record {
+		record[i] = 0xAA
+	}
+	obj.Memory.SetRange(obj.dma, record...)
+	if call(BdosSysCallWriteRand, 100) != 0 {
+		t.Fatalf("failed to write record")
+	}
+	if call(BdosSysCallWriteRandZero, 203) != 0 {
+		t.Fatalf("failed to write record")
+	}
+
+	// The records we wrote can be read
+	for _, n := range []int{100, 203} {
+		obj.Memory.SetRange(obj.dma, make([]uint8, blkSize)...)
+		if call(BdosSysCallReadRand, n) != 0 || obj.Memory.Get(obj.dma) != 0xAA {
+			t.Fatalf("failed to read record %d", n)
+		}
+	}
+
+	// The rest of the block F_WRITEZF allocated is zeros
+	obj.Memory.SetRange(obj.dma, record...)
+	if call(BdosSysCallReadRand, 201) != 0 || obj.Memory.Get(obj.dma) != 0x00 {
+		t.Fatalf("block wasn't zero-filled")
+	}
+
+	// The gap is zeros on the host.
+	data, err := os.ReadFile(filepath.Join(dir, "DB.DAT"))
+	if err != nil {
+		t.Fatalf("failed to read file")
+	}
+	if len(data) != 204*blkSize || data[0] != 0x00 || data[150*blkSize] != 0x00 {
+		t.Fatalf("file has the wrong content")
+	}
+
+	// But unwritten within CP/M.  Records 96-103 share a block, so
+	// the first and last of those are data, but those either side
+	// of them, in other blocks, are not.
+	for n, want := range map[int]uint8{0: 1, 95: 1, 96: 0, 103: 0, 104: 1, 150: 1, 199: 1, 200: 0} {
+		if got := call(BdosSysCallReadRand, n); got != want {
+			t.Fatalf("reading record %d gave %d, expected %d", n, got, want)
+		}
+	}
+
+	// Sequential reads see the same gaps.
+	x.SetSequentialRecord(104)
+	obj.Memory.SetRange(0x005C, x.AsBytes()...)
+	obj.CPU.States.DE.SetU16(0x005C)
+	err = BdosSysCallRead(obj)
+	if err != nil || obj.CPU.States.AF.Hi != 1 {
+		t.Fatalf("expected record 104 to be unwritten")
+	}
+
+	// Once the file is closed, and reopened, we find the larger gaps
+	// via the host, if it supports sparse files.
+	if call(BdosSysCallFileClose, 0) != 0 || len(obj.files) != 0 {
+		t.Fatalf("failed to close file")
+	}
+	handle, err := os.Open(filepath.Join(dir, "DB.DAT"))
+	if err != nil {
+		t.Fatalf("failed to open file")
+	}
+	sparse := isUnwritten(handle, 0, allocBlockSize)
+	handle.Close()
+	if sparse {
+		if call(BdosSysCallFileOpen, 0) != 0 {
+			t.Fatalf("failed to reopen file")
+		}
+		for n, want := range map[int]uint8{0: 1, 100: 0, 150: 1, 203: 0} {
+			if got := call(BdosSysCallReadRand, n); got != want {
+				t.Fatalf("reading record %d of the reopened file gave %d, expected %d", n, got, want)
+			}
+		}
+		obj.closeLeakedFiles()
+	} else {
+		t.Logf("the host doesn't support sparse files")
+	}
+
+	// Files which existed before they were opened are all data.
+	x = fcb.FromString("OLD.DAT")
+	if call(BdosSysCallFileOpen, 0) != 0 {
+		t.Fatalf("failed to open file")
+	}
+	for n := 0; n < 4; n++ {
+		if call(BdosSysCallReadRand, n) != 0 {
+			t.Fatalf("expected record %d to be data", n)
+		}
+	}
+	if call(BdosSysCallReadRand, 4) != 1 {
+		t.Fatalf("expected record 4 to be unwritten")
+	}
+}
+
+// TestMountArchive ensures that archives can be used as read-only drives.
+func TestMountArchive(t *testing.T) {
+
+	// A host file, which should be hidden by the archive.
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "HOST.TXT"), []byte("host"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file")
+	}
+
+	// An archive with a file of two and a half records.
+	contents := bytes.Repeat([]byte("x"), 320)
+	out, err := os.Create(filepath.Join(dir, "test.zip"))
+	if err != nil {
+		t.Fatalf("failed to create archive")
+	}
+	w := zip.NewWriter(out)
+	f, err := w.Create("dir/game.dat")
+	if err != nil {
+		t.Fatalf("failed to add file")
+	}
+	_, err = f.Write(contents)
+	if err != nil {
+		t.Fatalf("failed to write file")
+	}
+	w.Close()
+	out.Close()
+
+	obj, err := New(WithConsoleDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	err = obj.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP")
+	}
+	obj.SetDrivePath("C", dir)
+
+	err = obj.MountArchive("C", "zip:"+filepath.Join(dir, "missing.zip"))
+	if err == nil {
+		t.Fatalf("mounted an archive which doesn't exist")
+	}
+	err = obj.MountArchive("C", "zip:"+filepath.Join(dir, "test.zip"))
+	if err != nil {
+		t.Fatalf("failed to mount archive: %s", err)
+	}
+
+	// call invokes the given syscall against the FCB for the given name.
+	call := func(f func(*CPM) error, name string) uint8 {
+		x := fcb.FromString(name)
+		x.Drive = 3
+		obj.Memory.SetRange(0x005C, x.AsBytes()...)
+		obj.CPU.States.DE.SetU16(0x005C)
+		err := f(obj)
+		if err != nil {
+			t.Fatalf("syscall failed: %s", err)
+		}
+		return obj.CPU.States.AF.Hi
+	}
+
+	// Only the archive contents are visible.
+	if call(BdosSysCallFindFirst, "*.*") != 0 {
+		t.Fatalf("failed to find files")
+	}
+	if string(obj.Memory.GetRange(obj.dma+1, 11)) != "GAME    DAT" {
+		t.Fatalf("found the wrong file")
+	}
+	if call(BdosSysCallFindNext, "*.*") != 0xFF {
+		t.Fatalf("found too many files")
+	}
+	if call(BdosSysCallFileOpen, "HOST.TXT") != 0xFF {
+		t.Fatalf("opened a host file on a mounted drive")
+	}
+
+	// The size is known.
+	if call(BdosSysCallFileSize, "GAME.DAT") != 0 {
+		t.Fatalf("failed to get file size")
+	}
+	x := fcb.FromBytes(obj.Memory.GetRange(0x005C, fcb.SIZE))
+	if x.GetRandomRecord() != 3 {
+		t.Fatalf("wrong file size %d", x.GetRandomRecord())
+	}
+
+	// The file can be read, sequentially and randomly.
+	if call(BdosSysCallFileOpen, "GAME.DAT") != 0 {
+		t.Fatalf("failed to open file")
+	}
+	x = fcb.FromBytes(obj.Memory.GetRange(0x005C, fcb.SIZE))
+	if x.RC != 3 {
+		t.Fatalf("wrong record count %d", x.RC)
+	}
+	if call(BdosSysCallRead, "GAME.DAT") != 0 {
+		t.Fatalf("failed to read file")
+	}
+	if !bytes.Equal(obj.Memory.GetRange(obj.dma, 128), contents[:128]) {
+		t.Fatalf("read the wrong data")
+	}
+
+	x = fcb.FromString("GAME.DAT")
+	x.Drive = 3
+	x.SetRandomRecord(2)
+	obj.Memory.SetRange(0x005C, x.AsBytes()...)
+	err = BdosSysCallReadRand(obj)
+	if err != nil || obj.CPU.States.AF.Hi != 0 {
+		t.Fatalf("failed to read record randomly")
+	}
+	if !bytes.Equal(obj.Memory.GetRange(obj.dma, 64), contents[256:]) || obj.Memory.Get(obj.dma+64) != 0x1A {
+		t.Fatalf("read the wrong data randomly")
+	}
+
+	// But it can't be written to, or replaced.
+	if call(BdosSysCallWrite, "GAME.DAT") != 0xFF {
+		t.Fatalf("wrote to a mounted archive")
+	}
+	if call(BdosSysCallMakeFile, "NEW.DAT") != 0xFF {
+		t.Fatalf("created a file on a mounted archive")
+	}
+	if call(BdosSysCallDeleteFile, "GAME.DAT") != 0xFF {
+		t.Fatalf("deleted a file on a mounted archive")
+	}
+	_, err = os.Stat(filepath.Join(dir, "NEW.DAT"))
+	if err == nil {
+		t.Fatalf("created a file on the host")
+	}
+
+	// The drive is reported as read-only.
+	err = BdosSysCallDriveROVec(obj)
+	if err != nil || obj.CPU.States.HL.U16() != 0x0004 {
+		t.Fatalf("wrong read-only vector %04X", obj.CPU.States.HL.U16())
+	}
+
+	// rename renames the file on the given drive, from the current drive.
+	rename := func(drive uint8, src string, dst string) uint8 {
+		x := fcb.FromString(src)
+		x.Drive = drive
+		y := fcb.FromString(dst)
+		obj.Memory.SetRange(0x005C, x.AsBytes()[:16]...)
+		obj.Memory.SetRange(0x005C+16, y.AsBytes()[:16]...)
+		obj.CPU.States.DE.SetU16(0x005C)
+		err := BdosSysCallRenameFile(obj)
+		if err != nil {
+			t.Fatalf("syscall failed: %s", err)
+		}
+		return obj.CPU.States.AF.Hi
+	}
+
+	// Renaming uses the drive in the FCB, rather than the current
+	// drive, even if that shares the directory beneath the archive.
+	obj.SetDrivePath("A", dir)
+	if rename(3, "HOST.TXT", "MOVED.TXT") != 0xFF {
+		t.Fatalf("renamed a file on a mounted archive")
+	}
+	_, err = os.Stat(filepath.Join(dir, "HOST.TXT"))
+	if err != nil {
+		t.Fatalf("renamed the host file beneath a mounted archive")
+	}
+
+	other := t.TempDir()
+	err = os.WriteFile(filepath.Join(other, "FOO.TXT"), []byte("foo"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file")
+	}
+	obj.SetDrivePath("B", other)
+	if rename(2, "FOO.TXT", "BAR.TXT") != 0 {
+		t.Fatalf("failed to rename a file on another drive")
+	}
+	_, err = os.Stat(filepath.Join(other, "BAR.TXT"))
+	if err != nil {
+		t.Fatalf("renamed file is missing")
+	}
+}
+
+// TestSandbox ensures that programs cannot access files outside their drives.
+func TestSandbox(t *testing.T) {
+
+	outside := t.TempDir()
+	dir := t.TempDir()
+
+	for _, name := range []string{filepath.Join(outside, "SECRET.TXT"), filepath.Join(dir, "INSIDE.TXT")} {
+		err := os.WriteFile(name, []byte("data"), 0644)
+		if err != nil {
+			t.Fatalf("failed to write file")
+		}
+	}
+	links := map[string]string{
+		"ESCAPE.TXT":   filepath.Join(outside, "SECRET.TXT"),
+		"DANGLING.TXT": filepath.Join(outside, "CREATED.TXT"),
+		"LINK.TXT":     "INSIDE.TXT",
+	}
+	for name, target := range links {
+		err := os.Symlink(target, filepath.Join(dir, name))
+		if err != nil {
+			t.Skipf("cannot create symlinks: %s", err)
+		}
+	}
+
+	obj, err := New(WithConsoleDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	err = obj.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP")
+	}
+	obj.SetDrivePath("A", dir)
+
+	// call invokes the given syscall against the given FCB.
+	call := func(f func(*CPM) error, x fcb.FCB) uint8 {
+		obj.Memory.SetRange(0x005C, x.AsBytes()...)
+		obj.CPU.States.DE.SetU16(0x005C)
+		err := f(obj)
+		if err != nil {
+			t.Fatalf("syscall failed: %s", err)
+		}
+		return obj.CPU.States.AF.Hi
+	}
+
+	// Names containing path separators are refused.
+	bad := fcb.FCB{}
+	copy(bad.Name[:], "../../X")
+	copy(bad.Type[:], "   ")
+	if call(BdosSysCallMakeFile, bad) != 0xFF {
+		t.Fatalf("created a file with an invalid name")
+	}
+	if call(BdosSysCallFileOpen, bad) != 0xFF {
+		t.Fatalf("opened a file with an invalid name")
+	}
+
+	// As are links which point outside the drive, or nowhere.
+	for _, name := range []string{"ESCAPE.TXT", "DANGLING.TXT"} {
+		if call(BdosSysCallFileOpen, fcb.FromString(name)) != 0xFF {
+			t.Fatalf("opened %s", name)
+		}
+		if call(BdosSysCallFileSize, fcb.FromString(name)) != 0xFF {
+			t.Fatalf("found the size of %s", name)
+		}
+		if call(BdosSysCallMakeFile, fcb.FromString(name)) != 0xFF {
+			t.Fatalf("created %s", name)
+		}
+	}
+	_, err = os.Stat(filepath.Join(outside, "CREATED.TXT"))
+	if err == nil {
+		t.Fatalf("created a file outside the drive")
+	}
+
+	// Renaming to an invalid name is refused.
+	x := fcb.FromString("INSIDE.TXT")
+	dst := bad.AsBytes()
+	obj.Memory.SetRange(0x005C+16, dst...)
+	obj.Memory.SetRange(0x005C, x.AsBytes()[:16]...)
+	obj.CPU.States.DE.SetU16(0x005C)
+	err = BdosSysCallRenameFile(obj)
+	if err != nil || obj.CPU.States.AF.Hi != 0xFF {
+		t.Fatalf("renamed to an invalid name")
+	}
+
+	// Links within the drive are fine, and attribute bits are ignored.
+	if call(BdosSysCallFileOpen, fcb.FromString("LINK.TXT")) != 0 {
+		t.Fatalf("failed to open link within the drive")
+	}
+	x = fcb.FromString("INSIDE.TXT")
+	x.Type[0] |= 0x80
+	if call(BdosSysCallFileOpen, x) != 0 {
+		t.Fatalf("failed to open file with attributes set")
+	}
+}
+
+// TestTiming ensures we count the T-states of instructions correctly.
+func TestTiming(t *testing.T) {
+	tests := []struct {
+		code     [4]uint8
+		pc, next uint16
+		expected int
+	}{
+		{[4]uint8{0x00}, 0x100, 0x101, 4},                    // NOP
+		{[4]uint8{0x21, 0x00, 0x00}, 0x100, 0x103, 10},       // LD HL,nn
+		{[4]uint8{0x7E}, 0x100, 0x101, 7},                    // LD A,(HL)
+		{[4]uint8{0x20, 0xFE}, 0x100, 0x100, 12},             // JR NZ, taken
+		{[4]uint8{0x20, 0xFE}, 0x100, 0x102, 7},              // JR NZ, not taken
+		{[4]uint8{0x10, 0xFE}, 0x100, 0x100, 13},             // DJNZ, taken
+		{[4]uint8{0xC4, 0x00, 0x02}, 0x100, 0x200, 17},       // CALL NZ, taken
+		{[4]uint8{0xC4, 0x00, 0x02}, 0x100, 0x103, 10},       // CALL NZ, not taken
+		{[4]uint8{0xC9}, 0x100, 0x200, 10},                   // RET
+		{[4]uint8{0xCB, 0x46}, 0x100, 0x102, 12},             // BIT 0,(HL)
+		{[4]uint8{0xCB, 0xC6}, 0x100, 0x102, 15},             // SET 0,(HL)
+		{[4]uint8{0xCB, 0x00}, 0x100, 0x102, 8},              // RLC B
+		{[4]uint8{0xED, 0xB0}, 0x100, 0x100, 21},             // LDIR, repeating
+		{[4]uint8{0xED, 0xB0}, 0x100, 0x102, 16},             // LDIR, done
+		{[4]uint8{0xED, 0x43, 0x00, 0x00}, 0x100, 0x104, 20}, // LD (nn),BC
+		{[4]uint8{0xDD, 0x21, 0x00, 0x00}, 0x100, 0x104, 14}, // LD IX,nn
+		{[4]uint8{0xDD, 0x7E, 0x01}, 0x100, 0x103, 19},       // LD A,(IX+d)
+		{[4]uint8{0xDD, 0x34, 0x01}, 0x100, 0x103, 23},       // INC (IX+d)
+		{[4]uint8{0xFD, 0x36, 0x01, 0x00}, 0x100, 0x104, 19}, // LD (IY+d),n
+		{[4]uint8{0xFD, 0xCB, 0x01, 0x46}, 0x100, 0x104, 20}, // BIT 0,(IY+d)
+		{[4]uint8{0xFD, 0xCB, 0x01, 0xC6}, 0x100, 0x104, 23}, // SET 0,(IY+d)
+		{[4]uint8{0xDD, 0xE5}, 0x100, 0x102, 15},             // PUSH IX
+	}
+
+	for _, test := range tests {
+		got := tstates(test.code, test.pc, test.next)
+		if got != test.expected {
+			t.Fatalf("wrong timing for %02X: got %d, expected %d", test.code, got, test.expected)
+		}
+	}
+}
+
+// TestThrottle ensures that limiting our speed works.
+func TestThrottle(t *testing.T) {
+
+	// A program which counts down from 0x1000 in a loop of 26 T-states,
+	// then halts.
+	//
+	//   LD BC,0x1000
+	// loop:
+	//   DEC BC        ; 6
+	//   LD A,B        ; 4
+	//   OR C          ; 4
+	//   JR NZ,loop    ; 12
+	//   HALT
+	program := []uint8{0x01, 0x00, 0x10, 0x0B, 0x78, 0xB1, 0x20, 0xFB, 0x76}
+
+	obj, err := New(WithConsoleDriver("null"), WithMHz(1))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	_, err = New(WithMHz(-1))
+	if err == nil {
+		t.Fatalf("expected error with a negative clock rate")
+	}
+
+	obj.Memory = new(memory.Memory)
+	obj.Memory.SetRange(0x0100, program...)
+	obj.CPU = z80.CPU{Memory: obj.Memory, IO: obj}
+	obj.CPU.PC = 0x0100
+
+	// About 0x1000 * 26 T-states, at 1MHz, is around 106ms.
+	start := time.Now()
+	err = obj.run(context.Background())
+	if err != nil {
+		t.Fatalf("failed to run: %s", err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 80*time.Millisecond {
+		t.Fatalf("program ran too quickly: %s", elapsed)
+	}
+
+	// In turbo mode it runs at full speed.
+	obj.toggleTurbo()
+	obj.CPU.PC = 0x0100
+	start = time.Now()
+	err = obj.run(context.Background())
+	if err != nil {
+		t.Fatalf("failed to run: %s", err)
+	}
+	if time.Since(start) > 80*time.Millisecond {
+		t.Fatalf("turbo mode is too slow: %s", time.Since(start))
+	}
+}
+
+// TestIdle tests that we wait for input when polled in a tight loop.
+func TestIdle(t *testing.T) {
+
+	obj, err := New(WithConsoleDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+
+	// Polls in a tight loop are counted.
+	for i := 0; i < 10; i++ {
+		obj.pollConsole()
+	}
+	if obj.idle.polls != 9 {
+		t.Fatalf("unexpected poll count %d", obj.idle.polls)
+	}
+
+	// A gap between polls resets the count.
+	obj.idle.last = time.Now().Add(-idleGap * 2)
+	obj.pollConsole()
+	if obj.idle.polls != 0 {
+		t.Fatalf("unexpected poll count %d", obj.idle.polls)
+	}
+
+	// As does work between polls, however quickly it was done.
+	obj.Memory = new(memory.Memory)
+	obj.pollConsole()
+	for i := 0; i < 3; i++ {
+		obj.Memory.GetRange(0x0100, idleWork+1)
+		obj.pollConsole()
+		if obj.idle.polls != 0 {
+			t.Fatalf("unexpected poll count %d after work", obj.idle.polls)
+		}
+	}
+	obj.Memory.GetRange(0x0100, 10)
+	obj.pollConsole()
+	if obj.idle.polls != 1 {
+		t.Fatalf("unexpected poll count %d", obj.idle.polls)
+	}
+
+	// And we can disable it.
+	obj, err = New(WithConsoleDriver("null"), WithIdle(false))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	for i := 0; i < 10; i++ {
+		obj.pollConsole()
+	}
+	if obj.idle.polls != 0 {
+		t.Fatalf("unexpected poll count %d", obj.idle.polls)
+	}
+}
+
+// TestInterrupts tests our timer interrupts, and raising them via our API.
+func TestInterrupts(t *testing.T) {
+
+	// A program which counts three interrupts, in IM 1, waiting for each
+	// via HALT, then disables interrupts and halts.
+	//
+	//   LD SP,0x8000
+	//   IM 1
+	//   XOR A
+	//   EI
+	// loop:
+	//   HALT
+	//   CP 3
+	//   JR NZ,loop
+	//   DI
+	//   HALT
+	program := []uint8{0x31, 0x00, 0x80, 0xED, 0x56, 0xAF, 0xFB, 0x76, 0xFE, 0x03, 0x20, 0xFB, 0xF3, 0x76}
+
+	// The handler at 0x0038.
+	//
+	//   INC A
+	//   EI
+	//   RETI
+	handler := []uint8{0x3C, 0xFB, 0xED, 0x4D}
+
+	obj, err := New(WithConsoleDriver("null"), WithInterruptTimer(1000, 0xFF))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	_, err = New(WithInterruptTimer(-1, 0xFF))
+	if err == nil {
+		t.Fatalf("expected error with a negative interrupt rate")
+	}
+
+	obj.Memory = new(memory.Memory)
+	obj.Memory.SetRange(0x0100, program...)
+	obj.Memory.SetRange(0x0038, handler...)
+	obj.CPU = z80.CPU{Memory: obj.Memory, IO: obj}
+	obj.CPU.PC = 0x0100
+
+	stop := obj.startTimer()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err = obj.run(ctx)
+	cancel()
+	stop()
+
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if obj.CPU.AF.Hi != 3 {
+		t.Fatalf("unexpected interrupt count %d", obj.CPU.AF.Hi)
+	}
+	if obj.CPU.PC != 0x010D {
+		t.Fatalf("unexpected PC %04X", obj.CPU.PC)
+	}
+
+	// Only one interrupt may be waiting, but an NMI replaces it.
+	obj.RaiseInterrupt(0xFF)
+	obj.RaiseInterrupt(0xCF)
+	p := obj.irq.pending.Load()
+	if p == nil || p.Data[0] != 0xFF {
+		t.Fatalf("unexpected pending interrupt %v", p)
+	}
+	obj.RaiseNMI()
+	obj.deliverInterrupt()
+	if obj.CPU.Interrupt == nil || obj.CPU.Interrupt.Type != z80.NMIType {
+		t.Fatalf("expected an NMI to be delivered")
+	}
+	if obj.irq.pending.Load() != nil {
+		t.Fatalf("expected no pending interrupt")
+	}
+
+	// In IM 2 the vector is read from the table.
+	obj.CPU = z80.CPU{Memory: obj.Memory, IO: obj}
+	obj.CPU.IM = 2
+	obj.CPU.IFF1 = true
+	obj.CPU.SP = 0x8000
+	obj.CPU.PC = 0x0100
+	obj.CPU.IR.Hi = 0x20
+	obj.Memory.SetRange(0x2010, 0x34, 0x12)
+	obj.RaiseInterrupt(0x10)
+	obj.deliverInterrupt()
+	obj.CPU.Step()
+	if obj.CPU.PC != 0x1234 {
+		t.Fatalf("unexpected PC %04X", obj.CPU.PC)
+	}
+}
+
+// latch is an I/O device which returns the last value written to it.
+type latch struct {
+	val uint8
+}
+
+func (l *latch) In(port uint8) uint8 {
+	return l.val + port
+}
+
+func (l *latch) Out(port uint8, val uint8) {
+	l.val = val
+}
+
+// TestPorts tests attaching devices to our I/O ports.
+func TestPorts(t *testing.T) {
+
+	obj, err := New(WithConsoleDriver("null"), WithPorts("rtc@0x80, random@0x90"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	_, err = New(WithPorts("rtc@0x80,random@0x82"))
+	if err == nil {
+		t.Fatalf("expected error with overlapping devices")
+	}
+	_, err = New(WithPorts("printer@0x10"))
+	if err == nil {
+		t.Fatalf("expected error with an unknown device")
+	}
+
+	// Our BIOS port is reserved.
+	err = obj.RegisterPorts(0xF0, 0xFF, &latch{})
+	if err == nil {
+		t.Fatalf("expected error claiming the BIOS port")
+	}
+
+	l := &latch{}
+	err = obj.RegisterPorts(0x10, 0x11, l)
+	if err != nil {
+		t.Fatalf("failed to register ports: %s", err)
+	}
+	obj.Out(0x10, 0x41)
+	if obj.In(0x11) != 0x42 {
+		t.Fatalf("unexpected value read from device")
+	}
+
+	// Unclaimed ports read as zero.
+	if obj.In(0x20) != 0x00 {
+		t.Fatalf("unexpected value read from unclaimed port")
+	}
+	if obj.In(0x85) > 99 {
+		t.Fatalf("unexpected year from the clock")
+	}
+}
+
+// TestCPU8080 tests our 8080 mode.
+func TestCPU8080(t *testing.T) {
+
+	_, err := New(WithCPU("6502"))
+	if err == nil {
+		t.Fatalf("expected error with an unknown CPU")
+	}
+
+	type TestCase struct {
+		program []uint8
+		a       uint8
+		f       uint8
+	}
+
+	tests := []TestCase{
+		// LD A,0x7F; ADD A,1 - parity rather than overflow.
+		{program: []uint8{0x3E, 0x7F, 0xC6, 0x01, 0x76}, a: 0x80, f: 0x92},
+		// LD A,0x10; SUB 1; DAA - DAA adjusts for addition.
+		{program: []uint8{0x3E, 0x10, 0xD6, 0x01, 0x27, 0x76}, a: 0x15, f: 0x12},
+		// LD A,0x03; CP 0; parity of the comparison.
+		{program: []uint8{0x3E, 0x03, 0xFE, 0x00, 0x76}, a: 0x03, f: 0x06},
+		// LD B,0x7F; INC B; LD A,B.
+		{program: []uint8{0x06, 0x7F, 0x04, 0x78, 0x76}, a: 0x80, f: 0x92},
+	}
+
+	for i, test := range tests {
+		obj, err := New(WithConsoleDriver("null"), WithCPU("8080"))
+		if err != nil {
+			t.Fatalf("failed to create CPM")
+		}
+
+		obj.Memory = new(memory.Memory)
+		obj.Memory.SetRange(0x0100, test.program...)
+		obj.CPU = z80.CPU{Memory: obj.Memory, IO: obj}
+		obj.CPU.PC = 0x0100
+
+		err = obj.run(context.Background())
+		if err != nil {
+			t.Fatalf("%d: unexpected error %s", i, err)
+		}
+		if obj.CPU.AF.Hi != test.a || obj.CPU.AF.Lo != test.f {
+			t.Fatalf("%d: unexpected AF %02X%02X", i, obj.CPU.AF.Hi, obj.CPU.AF.Lo)
+		}
+	}
+
+	// Z80-only instructions are refused.
+	obj, err := New(WithConsoleDriver("null"), WithCPU("8080"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	obj.Memory = new(memory.Memory)
+	obj.Memory.SetRange(0x0100, 0x00, 0xED, 0xB0, 0x76)
+	obj.CPU = z80.CPU{Memory: obj.Memory, IO: obj}
+	obj.CPU.PC = 0x0100
+
+	err = obj.run(context.Background())
+	if !errors.Is(err, ErrZ80Instruction) {
+		t.Fatalf("expected a Z80 instruction error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "0x0101") {
+		t.Fatalf("expected the PC in the error, got %s", err)
+	}
+}
+
+// TestBanks tests the BIOS functions for banked memory.
+func TestBanks(t *testing.T) {
+
+	_, err := New(WithBanks(0, 0xC000))
+	if err == nil {
+		t.Fatalf("expected error with no banks")
+	}
+	_, err = New(WithBanks(2, 0xF800))
+	if err == nil {
+		t.Fatalf("expected error with our BIOS outside common memory")
+	}
+
+	obj, err := New(WithConsoleDriver("null"), WithBanks(3, 0xC000))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	err = obj.createMemory()
+	if err != nil {
+		t.Fatalf("failed to create memory: %s", err)
+	}
+
+	// Select bank 2, and write something there.
+	obj.CPU.States.AF.Hi = 2
+	err = BiosSysCallSelectMemory(obj)
+	if err != nil {
+		t.Fatalf("failed to select memory: %s", err)
+	}
+	obj.Memory.SetRange(0x1000, []uint8("STEVE")...)
+
+	obj.CPU.States.AF.Hi = 3
+	err = BiosSysCallSelectMemory(obj)
+	if err == nil {
+		t.Fatalf("expected error selecting a missing bank")
+	}
+
+	// Copy it to bank 1.
+	obj.CPU.States.BC.SetU16(0x0102)
+	err = BiosSysCallExtendedMove(obj)
+	if err != nil {
+		t.Fatalf("failed to set banks: %s", err)
+	}
+	obj.CPU.States.BC.SetU16(5)
+	obj.CPU.States.DE.SetU16(0x1000)
+	obj.CPU.States.HL.SetU16(0x2000)
+	err = BiosSysCallMove(obj)
+	if err != nil {
+		t.Fatalf("failed to move: %s", err)
+	}
+	if obj.CPU.States.DE.U16() != 0x1005 || obj.CPU.States.HL.U16() != 0x2005 {
+		t.Fatalf("unexpected registers after move")
+	}
+	if obj.Memory.Get(0x2000) != 0x00 {
+		t.Fatalf("move wrote to the selected bank")
+	}
+	if string([]uint8{obj.Memory.GetBank(1, 0x2000), obj.Memory.GetBank(1, 0x2004)}) != "SE" {
+		t.Fatalf("move didn't copy to bank 1")
+	}
+
+	// Without XMOVE we copy within the selected bank.
+	obj.CPU.States.BC.SetU16(5)
+	obj.CPU.States.DE.SetU16(0x1000)
+	obj.CPU.States.HL.SetU16(0x3000)
+	err = BiosSysCallMove(obj)
+	if err != nil {
+		t.Fatalf("failed to move: %s", err)
+	}
+	if string(obj.Memory.GetRange(0x3000, 5)) != "STEVE" {
+		t.Fatalf("move didn't copy within the bank")
+	}
+
+	// Invalid banks are refused.
+	obj.CPU.States.BC.SetU16(0x0300)
+	err = BiosSysCallExtendedMove(obj)
+	if err == nil {
+		t.Fatalf("expected error with a missing bank")
+	}
+
+	// Loading a program selects the first bank.
+	err = obj.createMemory()
+	if err != nil || obj.Memory.Bank() != 0 {
+		t.Fatalf("expected the first bank to be selected")
+	}
+}
+
+// TestProtect tests that writes to our BIOS stop the program.
+func TestProtect(t *testing.T) {
+
+	// LD A,0x42
+	// LD (0xFE01),A
+	// HALT
+	program := []uint8{0x3E, 0x42, 0x32, 0x01, 0xFE, 0x76}
+
+	for _, enabled := range []bool{true, false} {
+		obj, err := New(WithConsoleDriver("null"), WithMemoryProtection(enabled))
+		if err != nil {
+			t.Fatalf("failed to create CPM")
+		}
+		err = obj.createMemory()
+		if err != nil {
+			t.Fatalf("failed to create memory: %s", err)
+		}
+
+		// We can write to the memory when setting up.
+		obj.fixupRAM()
+		obj.Memory.SetRange(0x0100, program...)
+		if obj.biosErr != nil {
+			t.Fatalf("unexpected error setting up memory")
+		}
+
+		obj.CPU = z80.CPU{Memory: obj.Memory, IO: obj}
+		obj.CPU.PC = 0x0100
+		obj.running = true
+		err = obj.run(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+
+		if !enabled {
+			if obj.biosErr != nil || obj.Memory.Get(0xFE01) != 0x42 {
+				t.Fatalf("unexpected protection when disabled")
+			}
+			continue
+		}
+
+		if !errors.Is(obj.biosErr, ErrProtection) {
+			t.Fatalf("expected a protection error, got %v", obj.biosErr)
+		}
+		if !strings.Contains(obj.biosErr.Error(), "0xFE01") || !strings.Contains(obj.biosErr.Error(), "0x0102") {
+			t.Fatalf("expected the address and PC in the error, got %s", obj.biosErr)
+		}
+	}
+
+	// The jump to the BDOS may be changed, to lower the TPA.
+	//
+	// LD HL,0x9000
+	// LD (0x0006),HL
+	// HALT
+	obj, err := New(WithConsoleDriver("null"), WithMemoryProtection(true))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	err = obj.createMemory()
+	if err != nil {
+		t.Fatalf("failed to create memory: %s", err)
+	}
+	obj.fixupRAM()
+	obj.Memory.SetRange(0x0100, 0x21, 0x00, 0x90, 0x22, 0x06, 0x00, 0x76)
+	obj.CPU = z80.CPU{Memory: obj.Memory, IO: obj}
+	obj.CPU.PC = 0x0100
+	obj.running = true
+	err = obj.run(context.Background())
+	if err != nil || obj.biosErr != nil {
+		t.Fatalf("unexpected error changing the BDOS jump %v %v", err, obj.biosErr)
+	}
+	if obj.Memory.GetU16(0x0006) != 0x9000 {
+		t.Fatalf("the BDOS jump wasn't changed")
+	}
+}
+
+// TestMemoryLayout tests that our memory map may be changed.
+func TestMemoryLayout(t *testing.T) {
+
+	bad := [][2]uint16{
+		{0x0100, 0xFE00}, // TPA too small
+		{0xF000, 0xF004}, // BIOS overlaps BDOS
+		{0xF000, 0xFF00}, // No room for the stack
+	}
+	for _, b := range bad {
+		_, err := New(WithMemoryLayout(b[0], b[1]))
+		if err == nil {
+			t.Fatalf("expected error with layout %04X %04X", b[0], b[1])
+		}
+	}
+
+	// Common memory must include the BDOS.
+	_, err := New(WithMemoryLayout(0xB000, 0xBE00), WithBanks(2, 0xC000))
+	if err == nil {
+		t.Fatalf("expected error with the BDOS outside common memory")
+	}
+
+	obj, err := New(WithConsoleDriver("null"), WithMemoryLayout(0xB000, 0xBE00))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	err = obj.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP: %s", err)
+	}
+
+	// The jumps in page zero point to our BIOS and BDOS.
+	if obj.Memory.GetU16(0x0001) != 0xBE03 {
+		t.Fatalf("unexpected BIOS address %04X", obj.Memory.GetU16(0x0001))
+	}
+	if obj.Memory.GetU16(0x0006) != 0xB006 {
+		t.Fatalf("unexpected BDOS address %04X", obj.Memory.GetU16(0x0006))
+	}
+
+	// And the BIOS jump table is there.
+	if obj.Memory.Get(0xBE00) != 0xC3 || obj.Memory.GetU16(0xBE01) != 0xBE00+biosEntries*3 {
+		t.Fatalf("BIOS jump table not found")
+	}
+
+	// The CCP is relocated to sit just below the BDOS.
+	if obj.start != 0xA700 {
+		t.Fatalf("unexpected CCP address %04X", obj.start)
+	}
+	helper, err := ccp.Get(obj.ccp)
+	if err != nil {
+		t.Fatalf("failed to get CCP: %s", err)
+	}
+	code, err := helper.Relocate(0xA700)
+	if err != nil {
+		t.Fatalf("failed to relocate CCP: %s", err)
+	}
+	for i, c := range code {
+		if obj.Memory.Get(0xA700+uint16(i)) != c {
+			t.Fatalf("relocated CCP not found at %04X", 0xA700+i)
+		}
+	}
+
+	// Unless there isn't room for it.
+	obj, err = New(WithConsoleDriver("null"), WithMemoryLayout(0x0800, 0x0900))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	err = obj.LoadCCP()
+	if err == nil {
+		t.Fatalf("expected error loading the CCP below a low BDOS")
+	}
+}
+
+// TestCrashReport tests the contents of our crash reports.
+func TestCrashReport(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "crash.log")
+
+	obj, err := New(WithConsoleDriver("null"), WithCrashReport(path, true))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	err = obj.createMemory()
+	if err != nil {
+		t.Fatalf("failed to create memory: %s", err)
+	}
+	obj.fixupRAM()
+
+	// LD C,99
+	// CALL 0x0005
+	obj.Memory.SetRange(0x0100, 0x0E, 0x63, 0xCD, 0x05, 0x00)
+	obj.CPU = z80.CPU{Memory: obj.Memory, IO: obj}
+	obj.CPU.PC = 0x0100
+	obj.CPU.SP = 0x8000
+	obj.CPU.BreakPoints = map[uint16]struct{}{0x0005: {}}
+	err = obj.run(context.Background())
+	if err != z80.ErrBreakPoint {
+		t.Fatalf("expected a breakpoint, got %v", err)
+	}
+	obj.recordSyscall("BDOS", 99, "")
+
+	name, err := obj.WriteCrashReport(ErrUnimplemented)
+	if err != nil || name != path {
+		t.Fatalf("failed to write crash report: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read crash report: %s", err)
+	}
+	report := string(data)
+
+	expected := []string{
+		"Error:    UNIMPLEMENTED",
+		"PC=0005 SP=7FFE",
+		"7FFE: 0105  return address, after CALL 0005h at 0102",
+		"=> 0005  76           HALT",
+		"   0100  0E 63        LD C,63h",
+		"BDOS  99 unimplemented            from 0105",
+		"  0100: 0E 63 CD 05 00 00",
+	}
+	for _, e := range expected {
+		if !strings.Contains(report, e) {
+			t.Fatalf("crash report doesn't contain %q:\n%s", e, report)
+		}
+	}
+
+	// No report is written if we're not configured to.
+	obj, err = New(WithConsoleDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	name, err = obj.WriteCrashReport(ErrUnimplemented)
+	if err != nil || name != "" {
+		t.Fatalf("unexpected crash report")
+	}
+}
+
+// TestContinueUnimplemented tests that programs may continue past
+// unimplemented syscalls, and that we summarize them.
+func TestContinueUnimplemented(t *testing.T) {
+
+	// LD C,0xF0; CALL 5; LD (0x0200),A; JP 0
+	program := []byte{0x0E, 0xF0, 0xCD, 0x05, 0x00, 0x32, 0x00, 0x02, 0xC3, 0x00, 0x00}
+
+	file, err := os.CreateTemp("", "tst-*.com")
+	if err != nil {
+		t.Fatalf("failed to create temporary file")
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(program)
+	if err != nil {
+		t.Fatalf("failed to write program to temporary file")
+	}
+	file.Close()
+
+	// By default we stop.
+	obj, err := New(WithConsoleDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	err = obj.LoadBinary(file.Name())
+	if err != nil {
+		t.Fatalf("failed to load binary")
+	}
+	err = obj.Execute([]string{})
+	if err != ErrUnimplemented {
+		t.Fatalf("expected unimplemented, got %v", err)
+	}
+
+	// Now continue.
+	obj, err = New(WithConsoleDriver("null"), WithContinueUnimplemented(true, 0xEE))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	if obj.UnimplementedSummary() != "" {
+		t.Fatalf("unexpected summary before running")
+	}
+	err = obj.LoadBinary(file.Name())
+	if err != nil {
+		t.Fatalf("failed to load binary")
+	}
+	err = obj.Execute([]string{})
+	if err != ErrBoot {
+		t.Fatalf("expected boot, got %v", err)
+	}
+	if obj.Memory.Get(0x0200) != 0xEE {
+		t.Fatalf("unexpected result %02X", obj.Memory.Get(0x0200))
+	}
+
+	// An unimplemented BIOS call.
+	obj.CPU.AF.Hi = 0xF0
+	obj.Out(0xFF, 0xF0)
+	if obj.biosErr != nil {
+		t.Fatalf("unexpected error %s", obj.biosErr)
+	}
+	if obj.CPU.AF.Hi != 0xEE {
+		t.Fatalf("unexpected result %02X", obj.CPU.AF.Hi)
+	}
+
+	summary := obj.UnimplementedSummary()
+	for _, want := range []string{"BDOS 240 (0xF0), called 1 time(s), from 0102", "BIOS 240 (0xF0)"} {
+		if !strings.Contains(summary, want) {
+			t.Fatalf("summary is missing %q:\n%s", want, summary)
+		}
+	}
+}
+
+// TestRunFast tests that interrupts raised while we're running via
+// z80.CPU.Run are still delivered.
+func TestRunFast(t *testing.T) {
+
+	//   LD SP,0x8000
+	//   IM 1
+	//   EI
+	// loop:
+	//   JR loop
+	program := []uint8{0x31, 0x00, 0x80, 0xED, 0x56, 0xFB, 0x18, 0xFE}
+
+	obj, err := New(WithConsoleDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+
+	obj.Memory = new(memory.Memory)
+	obj.Memory.SetRange(0x0100, program...)
+	obj.Memory.Set(0x0038, 0x76)
+	obj.CPU = z80.CPU{Memory: obj.Memory, IO: obj}
+	obj.CPU.PC = 0x0100
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		obj.RaiseInterrupt(0xFF)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = obj.run(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if obj.CPU.PC != 0x0038 {
+		t.Fatalf("interrupt wasn't taken, PC is %04X", obj.CPU.PC)
+	}
+}
@@ -0,0 +1,143 @@
+package cpm
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// The Z80 runs almost all 8080 code, so programs developed under a Z80
+// emulator may accidentally use instructions which a real 8080 lacks, or
+// depend upon the Z80's flags.  In 8080 mode we refuse to execute the
+// Z80-only instructions, and adjust the flags after each instruction to
+// match those of an 8080:
+//
+//   - The P/V flag always holds parity, there is no overflow flag.
+//   - There is no N flag, and DAA always adjusts for an addition.
+//   - Bit 1 of the flags is always set, and bits 3 and 5 always clear.
+//
+// The 8080's half-carry differs after some logical and subtraction
+// instructions, but that's not emulated.
+
+// ErrZ80Instruction is returned when a Z80-only instruction is executed in
+// 8080 mode.
+var ErrZ80Instruction = errors.New("Z80-only instruction")
+
+// Flag bits in the F register.
+const (
+	flagN  = 0x02
+	flagPV = 0x04
+	flagX  = 0x08
+	flagY  = 0x20
+)
+
+// z80Only contains the names of the opcodes which the 8080 doesn't have.
+var z80Only = [256]string{
+	0x08: "EX AF,AF'",
+	0x10: "DJNZ",
+	0x18: "JR",
+	0x20: "JR NZ",
+	0x28: "JR Z",
+	0x30: "JR NC",
+	0x38: "JR C",
+	0xCB: "CB prefix",
+	0xD9: "EXX",
+	0xDD: "IX prefix",
+	0xED: "ED prefix",
+	0xFD: "IY prefix",
+}
+
+// check8080 returns an error if the given instruction, about to be
+// executed, doesn't exist upon the 8080.
+func check8080(code [4]uint8, pc uint16) error {
+	name := z80Only[code[0]]
+	if name == "" {
+		return nil
+	}
+
+	bytes := fmt.Sprintf("%02X %02X", code[0], code[1])
+	slog.Error("Z80-only instruction executed in 8080 mode",
+		slog.String("instruction", name),
+		slog.String("bytes", bytes),
+		slog.String("PC", fmt.Sprintf("%04X", pc)))
+
+	return fmt.Errorf("%w %s (%s) at 0x%04X", ErrZ80Instruction, name, bytes, pc)
+}
+
+// parity returns true if the given value has an even number of bits set.
+func parity(v uint8) bool {
+	v ^= v >> 4
+	v ^= v >> 2
+	v ^= v >> 1
+	return v&1 == 0
+}
+
+// register returns the value of the 8-bit register, or memory at HL, which
+// is encoded in the low three bits of an opcode.
+func (cpm *CPM) register(op uint8) uint8 {
+	switch op & 0x07 {
+	case 0:
+		return cpm.CPU.BC.Hi
+	case 1:
+		return cpm.CPU.BC.Lo
+	case 2:
+		return cpm.CPU.DE.Hi
+	case 3:
+		return cpm.CPU.DE.Lo
+	case 4:
+		return cpm.CPU.HL.Hi
+	case 5:
+		return cpm.CPU.HL.Lo
+	case 6:
+		return cpm.Memory.Get(cpm.CPU.HL.U16())
+	}
+	return cpm.CPU.AF.Hi
+}
+
+// step8080 executes a single instruction as an 8080 would.
+//
+// The instruction must have been checked by check8080.
+func (cpm *CPM) step8080(code [4]uint8) {
+	op := code[0]
+
+	// The result of a comparison isn't stored, so work it out now.
+	var compared uint8
+	switch {
+	case op >= 0xB8 && op <= 0xBF:
+		compared = cpm.CPU.AF.Hi - cpm.register(op)
+	case op == 0xFE:
+		compared = cpm.CPU.AF.Hi - code[1]
+	}
+
+	// DAA always adjusts for an addition.
+	if op == 0x27 {
+		cpm.CPU.AF.Lo &^= flagN
+	}
+
+	cpm.CPU.Step()
+
+	// Arithmetic sets the parity flag, rather than overflow.
+	var result uint8
+	arith := true
+	switch {
+	case op >= 0x80 && op <= 0x9F, op == 0xC6, op == 0xCE, op == 0xD6, op == 0xDE:
+		result = cpm.CPU.AF.Hi
+	case op >= 0xB8 && op <= 0xBF, op == 0xFE:
+		result = compared
+	case op&0xC7 == 0x04, op&0xC7 == 0x05:
+		// INC r and DEC r store their result in the register
+		// they name, which is encoded in bits 3-5.
+		result = cpm.register(op >> 3)
+	default:
+		arith = false
+	}
+	if arith {
+		cpm.CPU.AF.Lo &^= flagPV
+		if parity(result) {
+			cpm.CPU.AF.Lo |= flagPV
+		}
+	}
+
+	// Bit 1, which is N upon the Z80, is always set.
+	cpm.CPU.AF.Lo = cpm.CPU.AF.Lo&^(flagX|flagY) | flagN
+}
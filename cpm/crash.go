@@ -0,0 +1,278 @@
+package cpm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/skx/cpmulator/disasm"
+	"github.com/skx/cpmulator/version"
+)
+
+// When we stop because of a fatal error we can write a report describing
+// the state of the emulator, which users may attach to bug reports, rather
+// than having to reproduce the problem with logging enabled.
+
+// recentSyscalls is the number of syscalls we remember, for crash reports.
+const recentSyscalls = 32
+
+// syscallRecord describes a syscall which was made.
+type syscallRecord struct {
+	// kind is either "BDOS" or "BIOS".
+	kind string
+
+	// number is the number of the function.
+	number uint8
+
+	// name is the name of the function, if it is implemented.
+	name string
+
+	// caller is the address the syscall will return to.
+	caller uint16
+
+	// af, bc, de, and hl are the registers when it was made.
+	af, bc, de, hl uint16
+}
+
+// recordSyscall remembers the syscall which is about to be made, for use
+// in any crash report.
+func (cpm *CPM) recordSyscall(kind string, number uint8, name string) {
+	r := syscallRecord{
+		kind:   kind,
+		number: number,
+		name:   name,
+		af:     cpm.CPU.AF.U16(),
+		bc:     cpm.CPU.BC.U16(),
+		de:     cpm.CPU.DE.U16(),
+		hl:     cpm.CPU.HL.U16(),
+	}
+	if cpm.Memory != nil {
+		r.caller = cpm.Memory.GetU16(cpm.CPU.SP)
+	}
+	cpm.recent[cpm.recentNext%recentSyscalls] = r
+	cpm.recentNext++
+}
+
+// WriteCrashReport writes a report describing the state of the emulator,
+// after the given fatal error, to the file configured via WithCrashReport,
+// and returns its name.
+//
+// If no file was configured nothing is written, and the name is empty.
+func (cpm *CPM) WriteCrashReport(reason error) (string, error) {
+	if cpm.crashPath == "" {
+		return "", nil
+	}
+
+	var out bytes.Buffer
+	cpm.crashReport(&out, reason)
+
+	err := os.WriteFile(cpm.crashPath, out.Bytes(), 0644)
+	if err != nil {
+		return "", err
+	}
+	return cpm.crashPath, nil
+}
+
+// crashReport writes our report to the given writer.
+func (cpm *CPM) crashReport(w io.Writer, reason error) {
+	c := &cpm.CPU
+
+	fmt.Fprintf(w, "cpmulator crash report\n\n")
+	fmt.Fprintf(w, "Version:  %s\n", version.GetVersionString())
+	fmt.Fprintf(w, "Time:     %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "Error:    %v\n", reason)
+	fmt.Fprintf(w, "Program:  %s\n", cpm.program)
+	fmt.Fprintf(w, "Memory:   BDOS %04X, BIOS %04X, bank %d of %d\n",
+		cpm.bdosAddr, cpm.biosAddr, cpm.Memory.Bank(), cpm.Memory.Banks())
+
+	fmt.Fprintf(w, "\nRegisters:\n")
+	fmt.Fprintf(w, "  AF=%04X BC=%04X DE=%04X HL=%04X IX=%04X IY=%04X\n",
+		c.AF.U16(), c.BC.U16(), c.DE.U16(), c.HL.U16(), c.IX, c.IY)
+	fmt.Fprintf(w, "  AF'=%04X BC'=%04X DE'=%04X HL'=%04X\n",
+		c.Alternate.AF.U16(), c.Alternate.BC.U16(), c.Alternate.DE.U16(), c.Alternate.HL.U16())
+	fmt.Fprintf(w, "  PC=%04X SP=%04X I=%02X R=%02X IM=%d IFF1=%t\n",
+		c.PC, c.SP, c.IR.Hi, c.IR.Lo, c.IM, c.IFF1)
+	fmt.Fprintf(w, "  Flags=%s\n", flagString(c.AF.Lo))
+
+	// The stack, noting the values which might be return addresses.
+	fmt.Fprintf(w, "\nStack:\n")
+	for i := 0; i < 16; i++ {
+		// Stop at the top of memory.
+		if int(c.SP)+i*2 > 0xFFFE {
+			break
+		}
+		addr := c.SP + uint16(i*2)
+		val := cpm.Memory.GetU16(addr)
+		note := ""
+		if call, ok := cpm.callBefore(val); ok {
+			note = fmt.Sprintf("  return address, after %s", call)
+		}
+		fmt.Fprintf(w, "  %04X: %04X%s\n", addr, val, note)
+	}
+
+	fmt.Fprintf(w, "\nCode at PC:\n")
+	cpm.disassembleAround(w, c.PC)
+
+	// If we stopped within our BDOS or BIOS the code which called
+	// us is more interesting.
+	if cpm.isTrap(c.PC) {
+		caller := cpm.Memory.GetU16(c.SP)
+		fmt.Fprintf(w, "\nCode at the return address:\n")
+		cpm.disassembleAround(w, caller)
+	}
+
+	fmt.Fprintf(w, "\nRecent syscalls, oldest first:\n")
+	start := 0
+	if cpm.recentNext > recentSyscalls {
+		start = cpm.recentNext - recentSyscalls
+	}
+	if cpm.recentNext == 0 {
+		fmt.Fprintf(w, "  none\n")
+	}
+	for i := start; i < cpm.recentNext; i++ {
+		r := cpm.recent[i%recentSyscalls]
+		name := r.name
+		if name == "" {
+			name = "unimplemented"
+		}
+		fmt.Fprintf(w, "  %s %3d %-24s from %04X  AF=%04X BC=%04X DE=%04X HL=%04X\n",
+			r.kind, r.number, name, r.caller, r.af, r.bc, r.de, r.hl)
+	}
+
+	fmt.Fprintf(w, "\nOpen files:\n")
+	var keys []fileKey
+	for k := range cpm.files {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	if len(keys) == 0 {
+		fmt.Fprintf(w, "  none\n")
+	}
+	for _, k := range keys {
+		obj := cpm.files[k]
+		fmt.Fprintf(w, "  %c: %-11s %s refs=%d written=%t\n",
+			k.drive, k.name, obj.name, obj.refs, obj.written)
+	}
+
+	if cpm.crashMemory {
+		fmt.Fprintf(w, "\nMemory:\n")
+		cpm.hexdump(w)
+	}
+}
+
+// flagString returns the flags in the given value, in a readable form.
+func flagString(f uint8) string {
+	names := "SZ5H3PNC"
+	out := []byte("--------")
+	for i := 0; i < 8; i++ {
+		if f&(0x80>>i) != 0 {
+			out[i] = names[i]
+		}
+	}
+	return string(out)
+}
+
+// isTrap returns true if the given address is within our fake BDOS or BIOS.
+func (cpm *CPM) isTrap(addr uint16) bool {
+	if addr == 0x0005 {
+		return true
+	}
+	if addr >= cpm.bdosAddr && addr < cpm.bdosAddr+bdosSize {
+		return true
+	}
+	return addr >= cpm.biosAddr && addr < cpm.biosAddr+biosSize
+}
+
+// callBefore returns the instruction before the given address, if it is a
+// CALL or RST, which would have pushed the address as a return address.
+func (cpm *CPM) callBefore(addr uint16) (string, bool) {
+	op := cpm.Memory.Get(addr - 3)
+	if op == 0xCD || op&0xC7 == 0xC4 {
+		text, _ := disasm.Disassemble(cpm.Memory.Get, addr-3)
+		return fmt.Sprintf("%s at %04X", text, addr-3), true
+	}
+	op = cpm.Memory.Get(addr - 1)
+	if op&0xC7 == 0xC7 {
+		text, _ := disasm.Disassemble(cpm.Memory.Get, addr-1)
+		return fmt.Sprintf("%s at %04X", text, addr-1), true
+	}
+	return "", false
+}
+
+// disassembleAround writes the instructions around the given address.
+//
+// Instructions have different lengths, so we can't simply work backwards,
+// instead we find the earliest address from which decoding reaches the
+// given address, and show the last few instructions from there.
+func (cpm *CPM) disassembleAround(w io.Writer, addr uint16) {
+	var before []uint16
+	for back := uint16(24); back > 0; back-- {
+		if back > addr {
+			continue
+		}
+		var found []uint16
+		a := addr - back
+		for a < addr {
+			found = append(found, a)
+			_, n := disasm.Disassemble(cpm.Memory.Get, a)
+			a += uint16(n)
+		}
+		if a == addr {
+			before = found
+			break
+		}
+	}
+	if len(before) > 8 {
+		before = before[len(before)-8:]
+	}
+
+	show := func(a uint16) uint16 {
+		text, n := disasm.Disassemble(cpm.Memory.Get, a)
+		marker := "  "
+		if a == addr {
+			marker = "=>"
+		}
+		fmt.Fprintf(w, "%s %04X  %-12s %s\n", marker, a, disasm.Bytes(cpm.Memory.Get, a, n), text)
+		return uint16(n)
+	}
+
+	for _, a := range before {
+		show(a)
+	}
+	a := addr
+	for i := 0; i < 8; i++ {
+		a += show(a)
+	}
+}
+
+// hexdump writes the contents of memory, omitting repeated lines.
+func (cpm *CPM) hexdump(w io.Writer) {
+	var last []uint8
+	skipping := false
+	for addr := 0; addr < 0x10000; addr += 16 {
+		line := cpm.Memory.GetRange(uint16(addr), 16)
+		if last != nil && bytes.Equal(line, last) {
+			if !skipping {
+				fmt.Fprintf(w, "  *\n")
+				skipping = true
+			}
+			continue
+		}
+		last = line
+		skipping = false
+
+		text := make([]byte, 16)
+		for i, c := range line {
+			text[i] = '.'
+			if c >= 0x20 && c < 0x7F {
+				text[i] = c
+			}
+		}
+		fmt.Fprintf(w, "  %04X: % X  %s\n", addr, line, text)
+	}
+}
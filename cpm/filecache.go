@@ -0,0 +1,261 @@
+package cpm
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/skx/cpmulator/fcb"
+)
+
+// defaultMaxOpenFiles is the number of host files which may be open at
+// the same time, unless changed via WithMaxOpenFiles.
+const defaultMaxOpenFiles = 64
+
+// errTooManyFiles is returned when we cannot open a file, because the
+// limit on the number of open files has been reached.
+var errTooManyFiles = errors.New("too many open files")
+
+// FileCache is used to cache filehandles on the host-side of the system,
+// which have been opened by the CP/M binary/CCP.
+type FileCache struct {
+	// name holds the name of the file, when it was opened/created,
+	// on the host-side.
+	name string
+
+	// handle has the file handle of the opened file.
+	//
+	// For files opened in text mode this is a temporary file, which
+	// contains the translated contents.
+	handle *os.File
+
+	// data holds the contents of a virtual file, which has no handle.
+	data []byte
+
+	// text is true if the file was opened in text mode.
+	text bool
+
+	// original contains the translated contents of a text mode file,
+	// when it was opened, so that we can tell if it has been changed.
+	original []byte
+
+	// refs contains the number of times the file has been opened,
+	// and not yet closed.
+	refs int
+
+	// written is true if the file has been written to.
+	written bool
+
+	// key identifies the file in our cache.
+	key fileKey
+
+	// id is stored in the FCBs which open the file, so that we can
+	// find it again.
+	id uint16
+
+	// openBlocks is the number of allocation blocks the file had when
+	// it was opened.
+	openBlocks int64
+
+	// allocated contains the allocation blocks which have been written
+	// to since the file was opened.
+	//
+	// Writing past the end of a file leaves a gap, which reads as
+	// zeros upon the host but is unwritten within CP/M.  We record
+	// the blocks which really were written ourselves, and for the
+	// blocks the file had when it was opened we ask the host whether
+	// they lie within a hole of a sparse file.
+	//
+	// Host filesystems have larger blocks than ours, typically 4K,
+	// so a gap smaller than that is forgotten once the file is
+	// closed, as are all gaps upon hosts or filesystems which don't
+	// support sparse files.
+	allocated map[int64]bool
+}
+
+// isAllocated returns true if the allocation block containing the given
+// offset holds data, rather than being within a gap that was never
+// written to.
+func (obj *FileCache) isAllocated(offset int64) bool {
+	block := offset / allocBlockSize
+	if obj.allocated[block] {
+		return true
+	}
+	if block >= obj.openBlocks || obj.handle == nil {
+		return false
+	}
+	return !isUnwritten(obj.handle, block*allocBlockSize, allocBlockSize)
+}
+
+// allocate records that the allocation blocks containing the given range
+// of the file have been written to.
+func (obj *FileCache) allocate(offset int64, length int64) {
+	if obj.allocated == nil {
+		obj.allocated = make(map[int64]bool)
+	}
+	for block := offset / allocBlockSize; block*allocBlockSize < offset+length; block++ {
+		obj.allocated[block] = true
+	}
+}
+
+// fileKey identifies an open file in our cache.
+//
+// CP/M doesn't have file handles, instead programs pass the FCB of the
+// file to each call.  Programs may copy an FCB after opening it, or
+// open the same file via two FCBs, so we identify open files by the
+// drive and name rather than the address of the FCB.
+//
+// Every user area shares the same host directory, so the user number
+// isn't part of the key.
+type fileKey struct {
+	// drive is the letter of the drive the file is on.
+	drive uint8
+
+	// name is the name of the file, as it appears in the FCB.
+	name string
+}
+
+// fileIDOffset is the offset, within the allocation map of an FCB, at
+// which we store the id of the file it opened.
+//
+// The allocation map is reserved for the BDOS, and as we have no real
+// blocks to record there we're free to use it.
+const fileIDOffset = 14
+
+// fileKey returns the key of the file the given FCB refers to, upon the
+// drive it names, or our current drive.
+func (cpm *CPM) fileKey(f fcb.FCB) fileKey {
+
+	// drive will default to our current drive, if the FCB drive field is 0
+	drive := cpm.currentDrive + 'A'
+	if f.Drive != 0 {
+		drive = f.Drive + 'A' - 1
+	}
+
+	// Ignore the attribute bits, which are stored in bit 7 of the
+	// name, as programs may change them while the file is open.
+	var name strings.Builder
+	for _, c := range append(f.Name[:], f.Type[:]...) {
+		name.WriteByte(c & 0x7F)
+	}
+
+	return fileKey{drive: drive, name: name.String()}
+}
+
+// addFile adds a file which has just been opened to our cache, giving it
+// a new id.
+func (cpm *CPM) addFile(key fileKey, obj *FileCache) {
+	cpm.lastFileID++
+	if cpm.lastFileID == 0 {
+		cpm.lastFileID++
+	}
+	obj.key = key
+	obj.id = cpm.lastFileID
+	cpm.files[key] = obj
+}
+
+// setFileID stores the id of the given open file within an FCB.
+func setFileID(f *fcb.FCB, obj *FileCache) {
+	f.Al[fileIDOffset] = uint8(obj.id)
+	f.Al[fileIDOffset+1] = uint8(obj.id >> 8)
+}
+
+// getFile returns the open file the given FCB refers to, if any.
+//
+// The drive the FCB refers to is resolved when the file is opened, and
+// programs may change the current drive before they use the file again,
+// so we first look for the id we stored in the FCB.  We fall back to the
+// drive and name for FCBs which were never opened themselves.
+func (cpm *CPM) getFile(f fcb.FCB) (*FileCache, bool) {
+	key := cpm.fileKey(f)
+
+	id := uint16(f.Al[fileIDOffset]) | uint16(f.Al[fileIDOffset+1])<<8
+	if id != 0 {
+		for _, obj := range cpm.files {
+			if obj.id == id && obj.key.name == key.name && (f.Drive == 0 || obj.key.drive == key.drive) {
+				return obj, true
+			}
+		}
+	}
+
+	obj, ok := cpm.files[key]
+	return obj, ok
+}
+
+// hostHandles returns the number of host files we have open.
+func (cpm *CPM) hostHandles() int {
+	count := 0
+	for _, obj := range cpm.files {
+		if obj.handle != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// closeLeakedFiles closes all the files which are still open, which we
+// do when a program terminates, with a warning for each.
+//
+// CP/M doesn't require files which were only read from to be closed,
+// and many programs, including the CCP, don't bother.  The warning says
+// whether the file was written to, as then its contents might not be
+// what the program intended.
+func (cpm *CPM) closeLeakedFiles() {
+	for key, obj := range cpm.files {
+		slog.Warn("Closing file which was left open",
+			slog.String("path", obj.name),
+			slog.String("drive", string(key.drive)),
+			slog.Int("refs", obj.refs),
+			slog.Bool("written", obj.written))
+
+		err := cpm.closeFile(obj)
+		if err != nil {
+			slog.Error("Failed to close handle in FileCache",
+				slog.String("path", obj.name),
+				slog.String("error", err.Error()))
+		}
+	}
+	cpm.files = make(map[fileKey]*FileCache)
+}
+
+// openHostFile opens the named host file, with the given flags, for use
+// as an open file in our cache.
+//
+// The number of host files we have open is limited, and files which
+// should be opened in text mode are translated.
+func (cpm *CPM) openHostFile(drive uint8, name string, flag int) (*FileCache, error) {
+
+	if cpm.hostHandles() >= cpm.maxOpenFiles {
+		slog.Warn("Refusing to open file, too many files are open",
+			slog.String("path", name),
+			slog.Int("limit", cpm.maxOpenFiles))
+		return nil, errTooManyFiles
+	}
+
+	file, err := os.OpenFile(name, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &FileCache{name: name, handle: file}
+
+	// Text files are translated into a temporary file.
+	if cpm.isTextFile(drive, name) {
+		obj.handle, obj.original, err = cpm.openTextFile(file)
+		if err != nil {
+			return nil, err
+		}
+		obj.text = true
+	}
+
+	// The contents of the file when it was opened are data, unless
+	// they're within a hole.
+	fi, err := obj.handle.Stat()
+	if err != nil {
+		return nil, err
+	}
+	obj.openBlocks = (fi.Size() + allocBlockSize - 1) / allocBlockSize
+
+	return obj, nil
+}
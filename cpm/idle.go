@@ -0,0 +1,90 @@
+package cpm
+
+import (
+	"time"
+)
+
+// Programs which are waiting for a key often poll the console status in a
+// tight loop, and as each poll returns immediately that would use all of a
+// host CPU.
+//
+// We count the polls which find no input, and which come quickly after the
+// previous one with little work done in between.  Once there have been
+// enough of them we decide the program is idle, and make each poll wait
+// for input for a short while.  We return as soon as input arrives, so key
+// presses are still seen immediately.
+//
+// Programs such as games, which poll once for each frame they draw, do
+// plenty of work between polls, so aren't slowed down even if each frame
+// is drawn quickly.
+
+const (
+	// idleGap is the longest time between polls which we consider to be
+	// a tight loop.
+	idleGap = 2 * time.Millisecond
+
+	// idleWork is the largest number of bytes the processor may read,
+	// which includes fetching its instructions, between polls which we
+	// consider to be a tight loop.
+	idleWork = 1000
+
+	// idlePolls is the number of polls, in a tight loop, after which we
+	// decide the program is idle.
+	idlePolls = 100
+
+	// idleWait is the time we wait for input, in each poll, when the
+	// program is idle.
+	idleWait = 10 * time.Millisecond
+)
+
+// idle holds the state we use to detect programs polling for input.
+type idle struct {
+	// disabled is true if we shouldn't wait for input.
+	disabled bool
+
+	// polls is the number of polls which found no input, in a tight
+	// loop.
+	polls int
+
+	// last is the time at which the previous poll finished.
+	last time.Time
+
+	// reads is the number of bytes the processor had read when the
+	// previous poll finished.
+	reads uint64
+}
+
+// pollConsole returns true if there is pending console input, waiting for
+// some to arrive first if the program seems to be doing nothing else.
+func (cpm *CPM) pollConsole() bool {
+	if cpm.idle.disabled {
+		return cpm.input.PendingInput()
+	}
+
+	// How much work has been done since the previous poll?
+	var reads uint64
+	if cpm.Memory != nil {
+		reads = cpm.Memory.Reads()
+	}
+
+	// Is this poll part of a tight loop?
+	if time.Since(cpm.idle.last) < idleGap && reads-cpm.idle.reads <= idleWork {
+		cpm.idle.polls++
+	} else {
+		cpm.idle.polls = 0
+	}
+
+	var ready bool
+	if cpm.idle.polls >= idlePolls {
+		ready = cpm.input.WaitForInput(idleWait)
+	} else {
+		ready = cpm.input.PendingInput()
+	}
+
+	if ready {
+		cpm.idle.polls = 0
+	}
+	cpm.idle.last = time.Now()
+	cpm.idle.reads = reads
+	return ready
+}
@@ -0,0 +1,154 @@
+package cpm
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/koron-go/z80"
+)
+
+// CP/M itself never uses interrupts, but some programs install their own
+// handlers, in interrupt mode 1 or 2, and expect the hardware to invoke them
+// periodically.
+//
+// Interrupts may be raised from any goroutine, via RaiseInterrupt or
+// RaiseNMI, and we also have an optional timer which raises them at a fixed
+// rate.  Raised interrupts are held until our run-loop passes them to the
+// processor, which will then take them as soon as they're enabled.
+
+// interrupts holds the state of our interrupt sources.
+type interrupts struct {
+	// hz is the rate at which our timer raises interrupts, zero if
+	// the timer is disabled.
+	hz float64
+
+	// vector is the value the timer places upon the data bus, as
+	// used in interrupt modes 0 and 2.
+	vector uint8
+
+	// pending holds an interrupt which has been raised, but not yet
+	// passed to the processor.
+	pending atomic.Pointer[z80.Interrupt]
+
+	// raised is used to wake the processor, if it is waiting within a
+	// HALT instruction.
+	raised chan struct{}
+
+	// active is true once we have a source of interrupts, either the
+	// timer or a device which has raised one.
+	active atomic.Bool
+
+	// stopRun stops z80.CPU.Run, which we use when there are no
+	// interrupts, so that an interrupt which is raised is delivered.
+	stopRun atomic.Pointer[context.CancelFunc]
+}
+
+// RaiseInterrupt raises a maskable interrupt, with the given value upon the
+// data bus.
+//
+// In interrupt mode 0 the value is executed as an instruction, typically an
+// RST, in mode 2 it is the low byte of the address of the vector to use, and
+// in mode 1 it is ignored.
+//
+// The interrupt is held until the processor takes it, and raising another
+// before then has no effect.  This may be called from any goroutine.
+func (cpm *CPM) RaiseInterrupt(data uint8) {
+	cpm.irq.active.Store(true)
+	if cpm.irq.pending.CompareAndSwap(nil, z80.IM0Interrupt(data)) {
+		cpm.irq.wake()
+	}
+}
+
+// RaiseNMI raises a non-maskable interrupt, which takes priority over any
+// maskable interrupt which is waiting.
+//
+// This may be called from any goroutine.
+func (cpm *CPM) RaiseNMI() {
+	cpm.irq.active.Store(true)
+	cpm.irq.pending.Store(z80.NMIInterrupt())
+	cpm.irq.wake()
+}
+
+// wake wakes the processor, if it is waiting within a HALT instruction,
+// or stops z80.CPU.Run so that the interrupt may be delivered.
+func (irq *interrupts) wake() {
+	if stop := irq.stopRun.Load(); stop != nil {
+		(*stop)()
+	}
+
+	select {
+	case irq.raised <- struct{}{}:
+	default:
+	}
+}
+
+// startTimer starts raising interrupts at the configured rate, if any, and
+// returns a function which stops doing so.
+func (cpm *CPM) startTimer() func() {
+	if cpm.irq.hz == 0 {
+		return func() {}
+	}
+	cpm.irq.active.Store(true)
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / cpm.irq.hz))
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				cpm.RaiseInterrupt(cpm.irq.vector)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// deliverInterrupt passes any interrupt which has been raised to the
+// processor.
+//
+// A maskable interrupt stays with the processor until interrupts are
+// enabled, but a non-maskable one may replace it.
+func (cpm *CPM) deliverInterrupt() {
+	p := cpm.irq.pending.Load()
+	if p == nil {
+		return
+	}
+	if cpm.CPU.Interrupt == nil || p.Type == z80.NMIType {
+		cpm.CPU.Interrupt = cpm.irq.pending.Swap(nil)
+	}
+}
+
+// halted is called when the processor has executed a HALT instruction, and
+// returns true if we should continue running.
+//
+// A real processor waits within HALT for an interrupt, so we do the same if
+// interrupts are enabled and something might raise one.  Otherwise HALT is
+// how programs, and our BIOS, stop the emulator.
+func (cpm *CPM) halted(ctx context.Context) (bool, error) {
+	if !cpm.CPU.IFF1 || !cpm.irq.active.Load() || cpm.biosErr != nil || cpm.CPU.PC == 0x0000 {
+		return false, nil
+	}
+
+	// HALT leaves the program counter upon itself, but the interrupt
+	// should return to the next instruction.
+	cpm.CPU.HALT = false
+	cpm.CPU.PC++
+
+	if cpm.CPU.Interrupt != nil || cpm.irq.pending.Load() != nil {
+		return true, nil
+	}
+
+	select {
+	case <-cpm.irq.raised:
+		return true, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
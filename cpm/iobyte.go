@@ -0,0 +1,184 @@
+package cpm
+
+import (
+	"strings"
+)
+
+// The IOBYTE, stored at 0x0003 in RAM, describes which physical device
+// is assigned to each of the four logical devices; two bits per device:
+//
+//	bits 0-1: CON: - 0=TTY: 1=CRT: 2=BAT: 3=UC1:
+//	bits 2-3: RDR: - 0=TTY: 1=PTR: 2=UR1: 3=UR2:
+//	bits 4-5: PUN: - 0=TTY: 1=PTP: 2=UP1: 3=UP2:
+//	bits 6-7: LST: - 0=TTY: 1=CRT: 2=LPT: 3=UL1:
+//
+// We treat TTY:, CRT: and UC1: as the console.  The reader and punch
+// devices are our auxiliary devices, and LPT: and UL1: are the printer.
+// BAT: is "batch mode", where console input comes from the reader and
+// console output goes to the list device.
+
+// defaultIOByte is the IOBYTE we start with:
+//
+//	CON:=CRT: RDR:=PTR: PUN:=PTP: LST:=LPT:
+const defaultIOByte = 0x95
+
+// conBAT is the value of the CON: field of the IOBYTE which selects
+// batch mode.
+const conBAT = 2
+
+// ioByteCON returns the device assigned to the console.
+func (cpm *CPM) ioByteCON() uint8 {
+	return cpm.Memory.Get(0x0003) & 0x03
+}
+
+// ioByteRDR returns the device assigned to the reader.
+func (cpm *CPM) ioByteRDR() uint8 {
+	return (cpm.Memory.Get(0x0003) >> 2) & 0x03
+}
+
+// ioBytePUN returns the device assigned to the punch.
+func (cpm *CPM) ioBytePUN() uint8 {
+	return (cpm.Memory.Get(0x0003) >> 4) & 0x03
+}
+
+// ioByteLST returns the device assigned to the list device.
+func (cpm *CPM) ioByteLST() uint8 {
+	return (cpm.Memory.Get(0x0003) >> 6) & 0x03
+}
+
+// conWrite writes a character to the console device, as selected by the IOBYTE.
+func (cpm *CPM) conWrite(c uint8) error {
+	if cpm.ioByteCON() == conBAT {
+		return cpm.listWrite(c)
+	}
+
+	cpm.output.PutCharacter(c)
+	return nil
+}
+
+// conReady returns true if there is pending input from the console device,
+// as selected by the IOBYTE.
+func (cpm *CPM) conReady() bool {
+	if cpm.ioByteCON() == conBAT {
+		return cpm.readerReady()
+	}
+
+	return cpm.pollConsole()
+}
+
+// conRead blocks for a character from the console device, as selected by the
+// IOBYTE, without echoing it.
+func (cpm *CPM) conRead() (uint8, error) {
+	if cpm.ioByteCON() == conBAT {
+		return cpm.readerRead()
+	}
+
+	return cpm.input.BlockForCharacterNoEcho()
+}
+
+// conReadEcho blocks for a character from the console device, as selected by
+// the IOBYTE, echoing it.
+func (cpm *CPM) conReadEcho() (uint8, error) {
+	if cpm.ioByteCON() == conBAT {
+		c, err := cpm.readerRead()
+		if err != nil {
+			return c, err
+		}
+		return c, cpm.listWrite(c)
+	}
+
+	return cpm.input.BlockForCharacterWithEcho()
+}
+
+// conReadLine reads a line of input from the console device, as selected by
+// the IOBYTE.
+func (cpm *CPM) conReadLine(max uint8) (string, error) {
+	if cpm.ioByteCON() != conBAT {
+		return cpm.input.ReadLine(max)
+	}
+
+	// In batch mode we read from the reader until we find the end
+	// of the line, or the end of the input.
+	var text strings.Builder
+	for text.Len() < int(max) {
+		c, err := cpm.readerRead()
+		if err != nil {
+			return "", err
+		}
+
+		// Skip the LF of a CR/LF pair.
+		if c == '\n' && text.Len() == 0 {
+			continue
+		}
+		if c == '\r' || c == '\n' || c == 0x1A {
+			break
+		}
+		text.WriteByte(c)
+	}
+
+	// Echo the line to the list device, as the console would.
+	for _, c := range []byte(text.String() + "\r\n") {
+		err := cpm.listWrite(c)
+		if err != nil {
+			return "", err
+		}
+	}
+	return text.String(), nil
+}
+
+// readerReady returns true if there is pending input from the reader device,
+// as selected by the IOBYTE.
+func (cpm *CPM) readerReady() bool {
+	if cpm.ioByteRDR() == 0 {
+		return cpm.pollConsole()
+	}
+	if cpm.auxIn != nil {
+		return cpm.auxIn.InputReady()
+	}
+	return cpm.pollConsole()
+}
+
+// readerRead blocks for a character from the reader device, as selected by
+// the IOBYTE.
+func (cpm *CPM) readerRead() (uint8, error) {
+	if cpm.ioByteRDR() == 0 {
+		return cpm.input.BlockForCharacterNoEcho()
+	}
+	return cpm.auxRead()
+}
+
+// punchReady returns true if the punch device, as selected by the IOBYTE,
+// is able to accept output.
+func (cpm *CPM) punchReady() bool {
+	if cpm.ioBytePUN() == 0 || cpm.auxOut == nil {
+		return true
+	}
+	return cpm.auxOut.OutputReady()
+}
+
+// punchWrite writes a character to the punch device, as selected by the IOBYTE.
+func (cpm *CPM) punchWrite(c uint8) error {
+	if cpm.ioBytePUN() == 0 {
+		cpm.output.PutCharacter(c)
+		return nil
+	}
+	return cpm.auxWrite(c)
+}
+
+// listReady returns true if the list device, as selected by the IOBYTE, is
+// able to accept output.
+func (cpm *CPM) listReady() bool {
+	if cpm.ioByteLST() < 2 {
+		return true
+	}
+	return cpm.printer.Ready()
+}
+
+// listWrite writes a character to the list device, as selected by the IOBYTE.
+func (cpm *CPM) listWrite(c uint8) error {
+	if cpm.ioByteLST() < 2 {
+		cpm.output.PutCharacter(c)
+		return nil
+	}
+	return cpm.prnC(c)
+}
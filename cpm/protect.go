@@ -0,0 +1,61 @@
+package cpm
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/skx/cpmulator/memory"
+)
+
+// Programs which overrun their buffers may silently overwrite the code we
+// install in memory, for our BIOS and BDOS, and then crash in confusing
+// ways some time later.  If protection is enabled we stop as soon as a
+// program writes to those regions, and report where it did so.
+
+// ErrProtection is returned when a program writes to memory which is
+// reserved for the emulator, and protection is enabled.
+var ErrProtection = errors.New("write to reserved memory")
+
+// reservedRegion describes an area of memory reserved for the emulator.
+type reservedRegion struct {
+	start uint16
+	end   uint16
+	name  string
+}
+
+// reservedRegions returns the areas of memory reserved for the emulator.
+//
+// The jump to the BDOS, at 0x0005, isn't included as debuggers and RSX
+// loaders legitimately change it, to lower the top of the TPA.
+func (cpm *CPM) reservedRegions() []reservedRegion {
+	return []reservedRegion{
+		{start: 0x0000, end: 0x0002, name: "warm boot jump"},
+		{start: cpm.bdosAddr, end: cpm.bdosAddr + bdosSize - 1, name: "BDOS entry point"},
+		{start: cpm.biosAddr, end: cpm.biosAddr + biosSize - 1, name: "BIOS jump table"},
+	}
+}
+
+// protect adds watchpoints to the given memory which stop the emulator
+// when the reserved regions are written to.
+//
+// Writes are only refused while a program is running, so that we may
+// install our BIOS and BDOS when loading programs.
+func (cpm *CPM) protect(mem *memory.Memory) {
+	for _, r := range cpm.reservedRegions() {
+		mem.Watch(r.start, r.end, memory.Write, func(_ memory.Access, addr uint16, value uint8) {
+			if !cpm.running || cpm.biosErr != nil {
+				return
+			}
+
+			slog.Error("Write to reserved memory",
+				slog.String("region", r.name),
+				slog.String("address", fmt.Sprintf("%04X", addr)),
+				slog.String("value", fmt.Sprintf("%02X", value)),
+				slog.String("PC", fmt.Sprintf("%04X", cpm.instructionPC)))
+
+			cpm.biosErr = fmt.Errorf("%w: 0x%04X (%s) written with 0x%02X by the instruction at 0x%04X", ErrProtection, addr, r.name, value, cpm.instructionPC)
+			cpm.CPU.HALT = true
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package cpm
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/skx/cpmulator/fcb"
+)
+
+// The names within FCBs come from the memory of the program we're
+// running, so they cannot be trusted.  Before we use a name upon the host
+// we ensure that it is a valid CP/M filename, so that it cannot contain
+// path separators, and that the host file it refers to is within the
+// directory of the drive - even if that file is a symbolic link.
+
+// errInvalidName is returned when a program uses a filename which isn't
+// valid for CP/M.
+var errInvalidName = errors.New("invalid filename")
+
+// errEscape is returned when a filename refers to a host file which is
+// outside the directory of its drive.
+var errEscape = errors.New("file is outside the drive")
+
+// hostPath returns the path of the host file which the given CP/M
+// filename refers to, upon the given drive.
+//
+// Filenames which aren't valid, or which refer to symbolic links that
+// point outside the drive, are refused.
+func (cpm *CPM) hostPath(drive uint8, name string) (string, error) {
+	if !fcb.IsValidName(name) {
+		slog.Warn("Refusing to use invalid filename",
+			slog.String("drive", string(drive)),
+			slog.String("name", name))
+		return "", errInvalidName
+	}
+
+	root := cpm.drives[string(drive)]
+	path := fcb.HostPath(root, name)
+
+	err := checkWithin(root, path)
+	if err != nil {
+		slog.Warn("Refusing to use file outside the drive",
+			slog.String("drive", string(drive)),
+			slog.String("name", name),
+			slog.String("path", path))
+		return "", err
+	}
+	return path, nil
+}
+
+// checkWithin returns an error if the given path, which is an entry in
+// the given directory, is a symbolic link to something outside it.
+//
+// Links which can't be resolved are refused, as creating a file through
+// them could write anywhere.
+func checkWithin(dir string, path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		return nil
+	}
+
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return errEscape
+	}
+	target, err = filepath.Abs(target)
+	if err != nil {
+		return errEscape
+	}
+
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return errEscape
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return errEscape
+	}
+
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errEscape
+	}
+	return nil
+}
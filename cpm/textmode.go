@@ -0,0 +1,193 @@
+package cpm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CP/M text files use CR/LF line-endings, and the last record is padded
+// with ^Z characters.  Files on the host will usually have LF endings,
+// and no padding.
+//
+// When a file is opened in text mode we translate the contents into the
+// CP/M format, in a temporary file, and the CP/M program works with that.
+// When the file is closed we translate any changes back to the host format.
+
+// ctrlZ is the character which marks the end of a CP/M text file.
+const ctrlZ = 0x1A
+
+// textToCPM converts the contents of a host text file to the CP/M format,
+// adding a CR before each bare LF and padding the last record with ^Z.
+func textToCPM(data []byte) []byte {
+	var out bytes.Buffer
+
+	for i, c := range data {
+		if c == '\n' && (i == 0 || data[i-1] != '\r') {
+			out.WriteByte('\r')
+		}
+		out.WriteByte(c)
+	}
+
+	for out.Len()%blkSize != 0 {
+		out.WriteByte(ctrlZ)
+	}
+	return out.Bytes()
+}
+
+// textToHost converts the contents of a CP/M text file to the host format,
+// truncating it at the first ^Z and removing the CR of each CR/LF pair.
+func textToHost(data []byte) []byte {
+	if i := bytes.IndexByte(data, ctrlZ); i >= 0 {
+		data = data[:i]
+	}
+	return bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+}
+
+// binaryExtensions contains the extensions of files which are never
+// opened in text mode because of the drive they're upon, as translating
+// programs, libraries, and archives would corrupt them.
+var binaryExtensions = []string{"ARC", "ARK", "BIN", "COM", "CRL", "IRL", "LBR", "OVL", "OVR", "PRL", "REL", "RSX", "SPR", "ZIP"}
+
+// isTextFile returns true if the named file, upon the given drive, should
+// be opened in text mode.
+//
+// Files with one of the configured extensions always are, and other files
+// upon a text drive are too, unless they look like binary files.
+func (cpm *CPM) isTextFile(drive uint8, name string) bool {
+	ext := strings.ToUpper(strings.TrimPrefix(filepath.Ext(name), "."))
+	for _, e := range cpm.textExtensions {
+		if ext == e {
+			return true
+		}
+	}
+
+	if !strings.ContainsRune(cpm.textDrives, rune(drive)) {
+		return false
+	}
+
+	// Squeezed, crunched, and LZH-compressed files have a Q, Z, or Y
+	// as the middle letter of their extension.
+	if len(ext) == 3 && strings.ContainsRune("QZY", rune(ext[1])) {
+		return false
+	}
+	for _, e := range binaryExtensions {
+		if ext == e {
+			return false
+		}
+	}
+	return !isBinary(name)
+}
+
+// isBinary returns true if the named host file looks like it contains
+// binary data, rather than text, because there is a NUL byte near the
+// start of it.
+func isBinary(name string) bool {
+	file, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	data := make([]byte, 4096)
+	n, _ := io.ReadFull(file, data)
+	return bytes.IndexByte(data[:n], 0x00) >= 0
+}
+
+// textSize returns the size of the given host file, as a program sees it
+// upon the given drive.
+//
+// Text files are larger once translated, and if the file is open then
+// the program may have changed it since.
+func (cpm *CPM) textSize(drive uint8, name string, size int64) int64 {
+	for _, obj := range cpm.files {
+		if obj.text && obj.name == name {
+			fi, err := obj.handle.Stat()
+			if err == nil {
+				return fi.Size()
+			}
+		}
+	}
+
+	if !cpm.isTextFile(drive, name) {
+		return size
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return size
+	}
+	return int64(len(textToCPM(data)))
+}
+
+// openTextFile reads the contents of the given host file, and returns a
+// temporary file containing them in the CP/M format, along with the
+// translated contents so that we can tell if they were changed.
+//
+// The host file is closed.
+func (cpm *CPM) openTextFile(file *os.File) (*os.File, []byte, error) {
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %s", file.Name(), err)
+	}
+	data = textToCPM(data)
+
+	tmp, err := os.CreateTemp("", "cpm-text-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temporary file for %s: %s", file.Name(), err)
+	}
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, nil, fmt.Errorf("failed to write temporary file for %s: %s", file.Name(), err)
+	}
+
+	return tmp, data, nil
+}
+
+// closeFile closes the handle of the given open file.
+//
+// For files opened in text mode any changes are translated and written
+// back to the host file, and the temporary file is removed.
+func (cpm *CPM) closeFile(obj *FileCache) error {
+	if obj.handle == nil {
+		return nil
+	}
+	if !obj.text {
+		return obj.handle.Close()
+	}
+
+	defer os.Remove(obj.handle.Name())
+	defer obj.handle.Close()
+
+	_, err := obj.handle.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("failed to rewind %s: %s", obj.name, err)
+	}
+	data, err := io.ReadAll(obj.handle)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", obj.name, err)
+	}
+
+	// Leave the host file alone, unless it was changed.
+	if bytes.Equal(data, obj.original) {
+		return nil
+	}
+
+	// Programs may create binary files upon text drives, which we
+	// write back untranslated.
+	if bytes.IndexByte(data, 0x00) < 0 {
+		data = textToHost(data)
+	}
+	err = os.WriteFile(obj.name, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %s", obj.name, err)
+	}
+	return nil
+}
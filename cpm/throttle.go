@@ -0,0 +1,191 @@
+package cpm
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/koron-go/z80"
+	"github.com/skx/cpmulator/memory"
+)
+
+// By default we run as fast as the host allows, but programs which use
+// delay loops for timing will then run far too quickly.  If a clock rate
+// is configured we count the T-states of each instruction we execute, and
+// sleep whenever we get ahead of the time those T-states would have taken
+// upon a real processor.
+
+// turboKey is the key which toggles between the configured clock rate and
+// running as fast as possible, when the speed is limited.
+const turboKey = 0x1C // Ctrl-\
+
+// maxLag is the furthest we allow ourselves to fall behind real time.
+//
+// If we're further behind, perhaps because we were waiting for input,
+// we don't run quickly to catch up.
+const maxLag = 100 * time.Millisecond
+
+// throttle holds the state we use to limit our speed.
+type throttle struct {
+	// mhz is the clock rate to emulate, zero for no limit.
+	mhz float64
+
+	// turbo is true if the limit has been disabled via the hotkey.
+	turbo bool
+
+	// start is the time at which we started counting.
+	start time.Time
+
+	// cycles is the number of T-states executed since start.
+	cycles int64
+
+	// checked is the value of cycles when we last compared our speed.
+	checked int64
+}
+
+// toggleTurbo switches between the configured clock rate and running at
+// full speed.
+func (cpm *CPM) toggleTurbo() {
+	cpm.clock.turbo = !cpm.clock.turbo
+	cpm.clock.start = time.Time{}
+
+	slog.Info("Turbo mode toggled",
+		slog.Bool("turbo", cpm.clock.turbo),
+		slog.Float64("mhz", cpm.clock.mhz))
+}
+
+// add records that the given number of T-states have been executed, and
+// sleeps if that was quicker than a real processor would have been.
+func (t *throttle) add(cycles int) {
+	t.cycles += int64(cycles)
+
+	// Only compare our speed every millisecond of emulated time.
+	if t.cycles-t.checked < int64(t.mhz*1000) {
+		return
+	}
+	t.checked = t.cycles
+
+	now := time.Now()
+	expected := time.Duration(float64(t.cycles) / t.mhz * float64(time.Microsecond))
+	elapsed := now.Sub(t.start)
+
+	switch {
+	case t.start.IsZero() || elapsed-expected > maxLag:
+		t.start = now
+		t.cycles = 0
+		t.checked = 0
+	case expected > elapsed:
+		time.Sleep(expected - elapsed)
+	}
+}
+
+// errSlowPath is returned by runFast when we must continue in our own
+// run-loop.
+var errSlowPath = errors.New("continue in our own run-loop")
+
+// run executes instructions until a HALT, a breakpoint, or an error, as
+// z80.CPU.Run does, limiting our speed if configured to, passing any
+// interrupts which are raised to the processor, and emulating an 8080
+// if configured to.
+//
+// When none of those are needed we use z80.CPU.Run itself, which is
+// quicker than stepping through the instructions ourselves.
+func (cpm *CPM) run(ctx context.Context) error {
+
+	// A BDOS function might have failed, after it returned, such as by
+	// writing to protected memory.
+	if cpm.biosErr != nil {
+		return nil
+	}
+
+	fast := cpm.clock.mhz == 0 && !cpm.cpu8080 && !cpm.protectMemory &&
+		!cpm.irq.active.Load() && !cpm.Memory.Watching(memory.Exec)
+	if fast {
+		err := cpm.runFast(ctx)
+		if err != errSlowPath {
+			return err
+		}
+	}
+
+	cpm.CPU.HALT = false
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		cpm.deliverInterrupt()
+
+		// Record the instruction we're about to execute, for
+		// diagnostics and Exec watchpoints.
+		cpm.instructionPC = cpm.CPU.PC
+		cpm.Memory.Execute(cpm.instructionPC)
+
+		throttled := cpm.clock.mhz > 0 && !cpm.clock.turbo
+		if !throttled && !cpm.cpu8080 {
+			cpm.CPU.Step()
+		} else {
+			// Save the instruction, before it is executed.
+			pc := cpm.CPU.PC
+			code := [4]uint8{cpm.Memory.Get(pc), cpm.Memory.Get(pc + 1), cpm.Memory.Get(pc + 2), cpm.Memory.Get(pc + 3)}
+
+			// An interrupt is taken instead of the instruction.
+			irq := cpm.CPU.Interrupt
+			interrupting := irq != nil && (irq.Type == z80.NMIType || cpm.CPU.IFF1)
+
+			switch {
+			case cpm.cpu8080 && !interrupting:
+				if err := check8080(code, pc); err != nil {
+					return err
+				}
+				cpm.step8080(code)
+			default:
+				cpm.CPU.Step()
+			}
+
+			if throttled {
+				cpm.clock.add(tstates(code, pc, cpm.CPU.PC))
+			}
+		}
+
+		if _, ok := cpm.CPU.BreakPoints[cpm.CPU.PC]; ok {
+			return z80.ErrBreakPoint
+		}
+		if cpm.CPU.HALT {
+			resume, err := cpm.halted(ctx)
+			if !resume {
+				return err
+			}
+		}
+	}
+}
+
+// runFast executes instructions via z80.CPU.Run, until a HALT, a
+// breakpoint, or an error.
+//
+// If an interrupt is raised meanwhile we return errSlowPath, and the
+// caller continues in its own loop, which delivers it.
+func (cpm *CPM) runFast(ctx context.Context) error {
+	fast, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// An interrupt might have been raised before we could be stopped.
+	cpm.irq.stopRun.Store(&cancel)
+	defer cpm.irq.stopRun.Store(nil)
+	if cpm.irq.active.Load() {
+		return errSlowPath
+	}
+
+	err := cpm.CPU.Run(fast)
+	switch {
+	case err == context.Canceled && ctx.Err() == nil:
+		return errSlowPath
+	case err == nil && cpm.CPU.HALT:
+		resume, err := cpm.halted(ctx)
+		if resume {
+			return errSlowPath
+		}
+		return err
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package cpm
+
+// The Z80 emulator we use doesn't count the T-states each instruction
+// takes, so we do that ourselves when we need to limit our speed.
+//
+// Conditional instructions take longer when their condition is true,
+// which we determine by looking at where the program counter went.
+
+// baseTimes contains the T-states of the unprefixed instructions.
+//
+// Conditional instructions have the time taken when the condition is
+// false, and condTimes contains the time taken when it is true.
+var baseTimes = [256]uint8{
+	4, 10, 7, 6, 4, 4, 7, 4, 4, 11, 7, 6, 4, 4, 7, 4, // 0x00
+	8, 10, 7, 6, 4, 4, 7, 4, 12, 11, 7, 6, 4, 4, 7, 4, // 0x10
+	7, 10, 16, 6, 4, 4, 7, 4, 7, 11, 16, 6, 4, 4, 7, 4, // 0x20
+	7, 10, 13, 6, 11, 11, 10, 4, 7, 11, 13, 6, 4, 4, 7, 4, // 0x30
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 0x40
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 0x50
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 0x60
+	7, 7, 7, 7, 7, 7, 4, 7, 4, 4, 4, 4, 4, 4, 7, 4, // 0x70
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 0x80
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 0x90
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 0xA0
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 0xB0
+	5, 10, 10, 10, 10, 11, 7, 11, 5, 10, 10, 0, 10, 17, 7, 11, // 0xC0
+	5, 10, 10, 11, 10, 11, 7, 11, 5, 4, 10, 11, 10, 0, 7, 11, // 0xD0
+	5, 10, 10, 19, 10, 11, 7, 11, 5, 4, 10, 4, 10, 0, 7, 11, // 0xE0
+	5, 10, 10, 4, 10, 11, 7, 11, 5, 6, 10, 4, 10, 0, 7, 11, // 0xF0
+}
+
+// condTimes contains the T-states of conditional instructions when their
+// condition is true, along with their length in bytes.
+var condTimes = map[uint8][2]uint8{
+	0x10: {13, 2}, // DJNZ
+	0x20: {12, 2}, // JR NZ
+	0x28: {12, 2}, // JR Z
+	0x30: {12, 2}, // JR NC
+	0x38: {12, 2}, // JR C
+	0xC0: {11, 1}, // RET NZ
+	0xC8: {11, 1}, // RET Z
+	0xD0: {11, 1}, // RET NC
+	0xD8: {11, 1}, // RET C
+	0xE0: {11, 1}, // RET PO
+	0xE8: {11, 1}, // RET PE
+	0xF0: {11, 1}, // RET P
+	0xF8: {11, 1}, // RET M
+	0xC4: {17, 3}, // CALL NZ
+	0xCC: {17, 3}, // CALL Z
+	0xD4: {17, 3}, // CALL NC
+	0xDC: {17, 3}, // CALL C
+	0xE4: {17, 3}, // CALL PO
+	0xEC: {17, 3}, // CALL PE
+	0xF4: {17, 3}, // CALL P
+	0xFC: {17, 3}, // CALL M
+}
+
+// usesHL returns true if the given unprefixed instruction refers to (HL),
+// which becomes (IX+d) or (IY+d) when prefixed.
+func usesHL(op uint8) bool {
+	switch {
+	case op == 0x34 || op == 0x35:
+		return true
+	case op >= 0x40 && op <= 0xBF && op != 0x76:
+		return op&0x07 == 0x06 || (op >= 0x70 && op <= 0x77)
+	}
+	return false
+}
+
+// edTimes returns the T-states of the ED-prefixed instruction with the
+// given opcode, and whether it is a repeating block instruction.
+func edTimes(op uint8) (uint8, bool) {
+	switch {
+	case op >= 0x40 && op <= 0x7F:
+		switch op & 0x07 {
+		case 0, 1:
+			return 12, false // IN r,(C) / OUT (C),r
+		case 2:
+			return 15, false // SBC/ADC HL,rr
+		case 3:
+			return 20, false // LD (nn),rr / LD rr,(nn)
+		case 4, 6:
+			return 8, false // NEG / IM
+		case 5:
+			return 14, false // RETN / RETI
+		}
+		switch op {
+		case 0x67, 0x6F:
+			return 18, false // RRD / RLD
+		case 0x77, 0x7F:
+			return 8, false
+		}
+		return 9, false // LD I,A etc
+	case op >= 0xA0 && op <= 0xA3, op >= 0xA8 && op <= 0xAB:
+		return 16, false // LDI, CPI, INI, OUTI, and decrementing
+	case op >= 0xB0 && op <= 0xB3, op >= 0xB8 && op <= 0xBB:
+		return 16, true // LDIR, CPIR, INIR, OTIR, and decrementing
+	}
+	return 8, false
+}
+
+// tstates returns the number of T-states taken by the given instruction,
+// which was executed at the address pc, leaving the program counter at
+// next.
+func tstates(code [4]uint8, pc uint16, next uint16) int {
+	op := code[0]
+
+	switch op {
+	case 0xCB:
+		// Bit operations take longer with (HL), BIT less so.
+		if code[1]&0x07 == 0x06 {
+			if code[1] >= 0x40 && code[1] <= 0x7F {
+				return 12
+			}
+			return 15
+		}
+		return 8
+
+	case 0xED:
+		t, repeat := edTimes(code[1])
+		if repeat && next == pc {
+			return 21
+		}
+		return int(t)
+
+	case 0xDD, 0xFD:
+		sub := code[1]
+		switch sub {
+		case 0xCB:
+			// Indexed bit operations.
+			if code[3] >= 0x40 && code[3] <= 0x7F {
+				return 20
+			}
+			return 23
+		case 0xDD, 0xED, 0xFD:
+			// A redundant prefix, counted alone.
+			return 4
+		}
+
+		t := tstates([4]uint8{sub, code[2], code[3]}, pc+1, next)
+		switch {
+		case sub == 0x36:
+			return t + 9
+		case usesHL(sub):
+			return t + 12
+		}
+		return t + 4
+	}
+
+	// Was a conditional instruction's condition true?
+	if c, ok := condTimes[op]; ok && next != pc+uint16(c[1]) {
+		return int(c[0])
+	}
+	return int(baseTimes[op])
+}
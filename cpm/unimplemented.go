@@ -0,0 +1,120 @@
+package cpm
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// Programs which call a syscall we don't implement are normally stopped
+// with ErrUnimplemented.  When trying out new software it is often more
+// useful to carry on, returning an error value to the caller, and report
+// everything that was missing once the program has finished.
+
+// missingCall identifies an unimplemented syscall.
+type missingCall struct {
+	kind   string
+	number uint8
+}
+
+// missingCallers records the addresses an unimplemented syscall was called
+// from, and how many times it was called from each.
+type missingCallers map[uint16]int
+
+// unimplemented records a call to an unimplemented syscall, and logs a
+// warning about it.
+//
+// The address recorded is that of the CALL which invoked the syscall, if
+// we can find it, otherwise the return address upon the stack.
+func (cpm *CPM) unimplemented(kind string, number uint8) {
+	from := cpm.Memory.GetU16(cpm.CPU.SP)
+	if op := cpm.Memory.Get(from - 3); op == 0xCD || op&0xC7 == 0xC4 {
+		from -= 3
+	}
+
+	slog.Warn("Unimplemented syscall",
+		slog.String("type", kind),
+		slog.Int("syscall", int(number)),
+		slog.String("syscallHex", fmt.Sprintf("0x%02X", number)),
+		slog.String("caller", fmt.Sprintf("%04X", from)))
+
+	if cpm.missing == nil {
+		cpm.missing = make(map[missingCall]missingCallers)
+	}
+	key := missingCall{kind: kind, number: number}
+	if cpm.missing[key] == nil {
+		cpm.missing[key] = make(missingCallers)
+	}
+	cpm.missing[key][from]++
+}
+
+// BdosSysCallUnimplemented is used for BDOS functions we don't implement,
+// when we've been configured to continue rather than stopping.
+//
+// The configured error value is returned in A and HL.
+func BdosSysCallUnimplemented(cpm *CPM) error {
+	cpm.unimplemented("BDOS", cpm.CPU.BC.Lo)
+
+	cpm.CPU.AF.Hi = cpm.unimplementedValue
+	cpm.CPU.HL.Lo = cpm.unimplementedValue
+	cpm.CPU.HL.Hi = 0x00
+	cpm.CPU.BC.Hi = 0x00
+	return nil
+}
+
+// BiosSysCallUnimplemented is used for BIOS functions we don't implement,
+// when we've been configured to continue rather than stopping.
+//
+// The configured error value is returned in A.
+func BiosSysCallUnimplemented(cpm *CPM) error {
+	cpm.unimplemented("BIOS", cpm.CPU.AF.Hi)
+
+	cpm.CPU.AF.Hi = cpm.unimplementedValue
+	return nil
+}
+
+// UnimplementedSummary returns a description of each unimplemented syscall
+// which was called, and where from, or the empty string if there were none.
+func (cpm *CPM) UnimplementedSummary() string {
+	if len(cpm.missing) == 0 {
+		return ""
+	}
+
+	keys := make([]missingCall, 0, len(cpm.missing))
+	for key := range cpm.missing {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].kind != keys[j].kind {
+			return keys[i].kind < keys[j].kind
+		}
+		return keys[i].number < keys[j].number
+	})
+
+	var out strings.Builder
+	out.WriteString("Unimplemented syscalls:\n")
+	for _, key := range keys {
+		callers := cpm.missing[key]
+
+		addrs := make([]uint16, 0, len(callers))
+		total := 0
+		for addr, count := range callers {
+			addrs = append(addrs, addr)
+			total += count
+		}
+		sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+		from := make([]string, len(addrs))
+		for i, addr := range addrs {
+			from[i] = fmt.Sprintf("%04X", addr)
+			if callers[addr] > 1 {
+				from[i] += fmt.Sprintf(" (x%d)", callers[addr])
+			}
+		}
+
+		fmt.Fprintf(&out, "  %s %3d (0x%02X), called %d time(s), from %s\n",
+			key.kind, key.number, key.number, total, strings.Join(from, ", "))
+	}
+	return out.String()
+}
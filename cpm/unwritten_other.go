@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd)
+
+package cpm
+
+import (
+	"os"
+)
+
+// isUnwritten returns true if the given range of the file has never been
+// written to, i.e. it lies within a hole of a sparse file.
+//
+// We cannot find holes on this platform, so treat everything as written.
+func isUnwritten(f *os.File, offset int64, length int64) bool {
+	return false
+}
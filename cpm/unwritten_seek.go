@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd
+
+package cpm
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// isUnwritten returns true if the given range of the file has never been
+// written to, i.e. it lies within a hole of a sparse file.
+//
+// We use SEEK_DATA to find the next data after the offset, which fails
+// with ENXIO if there is no more data in the file.  If the filesystem
+// doesn't support holes we'll always find data.
+func isUnwritten(f *os.File, offset int64, length int64) bool {
+	next, err := unix.Seek(int(f.Fd()), offset, unix.SEEK_DATA)
+	if err != nil {
+		return errors.Is(err, unix.ENXIO)
+	}
+	return next >= offset+length
+}
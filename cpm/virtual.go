@@ -0,0 +1,94 @@
+package cpm
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/skx/cpmulator/archive"
+	"github.com/skx/cpmulator/fcb"
+)
+
+// Virtual files are those which don't exist upon the host filesystem.
+//
+// They are either embedded within our binary, beneath a directory named
+// for the drive they appear upon, or they come from an archive which has
+// been mounted as a drive.  Either way they are read-only.
+
+// MountArchive reads the archive described by the given string, and
+// makes its contents available as the given, read-only, drive.
+//
+// Files upon the host are not visible upon a drive with an archive
+// mounted.  Squeezed and crunched files within the archive are expanded
+// if WithExpandArchives was used.
+func (cpm *CPM) MountArchive(drive string, spec string) error {
+	fsys, err := archive.Open(spec, cpm.expandArchives)
+	if err != nil {
+		return err
+	}
+
+	if cpm.mounts == nil {
+		cpm.mounts = make(map[string]fs.FS)
+	}
+	cpm.mounts[drive] = fsys
+	return nil
+}
+
+// isMounted returns true if the given drive has an archive mounted.
+func (cpm *CPM) isMounted(drive uint8) bool {
+	_, ok := cpm.mounts[string(drive)]
+	return ok
+}
+
+// virtualFS returns the filesystem which contains the virtual files for
+// the given drive, along with the directory within it they live in.
+func (cpm *CPM) virtualFS(drive uint8) (fs.FS, string) {
+	if fsys, ok := cpm.mounts[string(drive)]; ok {
+		return fsys, "."
+	}
+	return cpm.static, string(drive)
+}
+
+// readVirtualFile returns the contents of the named virtual file, upon
+// the given drive.
+func (cpm *CPM) readVirtualFile(drive uint8, name string) ([]byte, error) {
+	fsys, dir := cpm.virtualFS(drive)
+	return fs.ReadFile(fsys, path.Join(dir, strings.ToUpper(name)))
+}
+
+// findVirtualFiles returns the virtual files, upon the given drive, which
+// match the pattern in the given FCB.
+func (cpm *CPM) findVirtualFiles(drive uint8, pattern fcb.FCB) []fcb.FCBFind {
+	var res []fcb.FCBFind
+
+	fsys, dir := cpm.virtualFS(drive)
+	_ = fs.WalkDir(fsys, dir,
+		func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				return nil
+			}
+
+			// Does the entry match the glob?
+			if pattern.DoesMatch(d.Name()) {
+
+				ent := fcb.FCBFind{
+					Host: p,
+					Name: d.Name()}
+
+				info, err := d.Info()
+				if err == nil {
+					ent.Size = info.Size()
+				}
+
+				// If so append
+				res = append(res, ent)
+			}
+
+			return nil
+		})
+
+	return res
+}
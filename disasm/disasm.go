@@ -0,0 +1,375 @@
+// Package disasm contains a disassembler for the Z80 processor, which is
+// used to show the code being executed when reporting problems.
+//
+// All the documented instructions are supported, along with the common
+// undocumented ones, such as those using the halves of the index
+// registers.  Bytes which don't form a valid instruction are shown as
+// data.
+package disasm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Reader returns the byte of memory at the given address.
+type Reader func(addr uint16) uint8
+
+var (
+	regs  = []string{"B", "C", "D", "E", "H", "L", "(HL)", "A"}
+	pairs = []string{"BC", "DE", "HL", "SP"}
+	push  = []string{"BC", "DE", "HL", "AF"}
+	conds = []string{"NZ", "Z", "NC", "C", "PO", "PE", "P", "M"}
+	alu   = []string{"ADD A,", "ADC A,", "SUB ", "SBC A,", "AND ", "XOR ", "OR ", "CP "}
+	rots  = []string{"RLC", "RRC", "RL", "RR", "SLA", "SRA", "SLL", "SRL"}
+	modes = []string{"0", "0", "1", "2", "0", "0", "1", "2"}
+	misc  = []string{"RLCA", "RRCA", "RLA", "RRA", "DAA", "CPL", "SCF", "CCF"}
+	block = [][]string{
+		{"LDI", "CPI", "INI", "OUTI"},
+		{"LDD", "CPD", "IND", "OUTD"},
+		{"LDIR", "CPIR", "INIR", "OTIR"},
+		{"LDDR", "CPDR", "INDR", "OTDR"},
+	}
+	edMisc = []string{"LD I,A", "LD R,A", "LD A,I", "LD A,R", "RRD", "RLD"}
+)
+
+// decoder holds the state of the instruction being decoded.
+type decoder struct {
+	read Reader
+	addr uint16
+	pc   uint16
+
+	// index is "HL", "IX", or "IY", depending on the prefix.
+	index string
+
+	// disp holds the displacement of an indexed instruction, once it
+	// has been read.
+	disp    int8
+	hasDisp bool
+}
+
+// byte returns the next byte of the instruction.
+func (d *decoder) byte() uint8 {
+	b := d.read(d.pc)
+	d.pc++
+	return b
+}
+
+// word returns the next two bytes of the instruction, as a word.
+func (d *decoder) word() uint16 {
+	l := d.byte()
+	h := d.byte()
+	return uint16(h)<<8 | uint16(l)
+}
+
+// n returns the next byte of the instruction, formatted.
+func (d *decoder) n() string {
+	return fmt.Sprintf("%02Xh", d.byte())
+}
+
+// nn returns the next word of the instruction, formatted.
+func (d *decoder) nn() string {
+	return fmt.Sprintf("%04Xh", d.word())
+}
+
+// rel returns the target of a relative jump.
+func (d *decoder) rel() string {
+	off := int8(d.byte())
+	return fmt.Sprintf("%04Xh", d.pc+uint16(off))
+}
+
+// hl returns the name of HL, or the index register which replaces it.
+func (d *decoder) hl() string {
+	return d.index
+}
+
+// mem returns the name of the memory operand (HL), or the indexed operand
+// which replaces it, reading the displacement if necessary.
+func (d *decoder) mem() string {
+	if d.index == "HL" {
+		return "(HL)"
+	}
+	if !d.hasDisp {
+		d.disp = int8(d.byte())
+		d.hasDisp = true
+	}
+	if d.disp < 0 {
+		return fmt.Sprintf("(%s-%02Xh)", d.index, -int(d.disp))
+	}
+	return fmt.Sprintf("(%s+%02Xh)", d.index, d.disp)
+}
+
+// reg returns the name of the given 8-bit register.
+//
+// With an index prefix H and L refer to its halves, unless the instruction
+// also uses memory, in which case they're unchanged.
+func (d *decoder) reg(r uint8, memory bool) string {
+	switch {
+	case r == 6:
+		return d.mem()
+	case d.index != "HL" && !memory && r == 4:
+		return d.index + "H"
+	case d.index != "HL" && !memory && r == 5:
+		return d.index + "L"
+	}
+	return regs[r]
+}
+
+// pair returns the name of the given register pair.
+func (d *decoder) pair(p uint8, table []string) string {
+	if p == 2 {
+		return d.hl()
+	}
+	return table[p]
+}
+
+// Disassemble returns the instruction at the given address, and its length
+// in bytes.
+func Disassemble(read Reader, addr uint16) (string, int) {
+	d := &decoder{read: read, addr: addr, pc: addr, index: "HL"}
+	text := d.decode()
+	return text, int(d.pc - addr)
+}
+
+// Bytes returns the bytes of the given length at the given address, as a
+// string of hex.
+func Bytes(read Reader, addr uint16, length int) string {
+	var out []string
+	for i := 0; i < length; i++ {
+		out = append(out, fmt.Sprintf("%02X", read(addr+uint16(i))))
+	}
+	return strings.Join(out, " ")
+}
+
+// decode decodes the instruction at our address.
+func (d *decoder) decode() string {
+	op := d.byte()
+
+	switch op {
+	case 0xCB:
+		if d.index != "HL" {
+			return d.indexedCB()
+		}
+		return d.cb(d.byte())
+	case 0xED:
+		if d.index != "HL" {
+			// The index prefix is ignored.
+			d.pc--
+			return fmt.Sprintf("DB %02Xh", d.read(d.addr))
+		}
+		return d.ed(d.byte())
+	case 0xDD, 0xFD:
+		if d.index != "HL" {
+			// Only the last prefix counts.
+			d.pc--
+			return fmt.Sprintf("DB %02Xh", d.read(d.addr))
+		}
+		d.index = "IX"
+		if op == 0xFD {
+			d.index = "IY"
+		}
+		return d.decode()
+	}
+
+	return d.main(op)
+}
+
+// main decodes an unprefixed instruction, or one with an index prefix.
+func (d *decoder) main(op uint8) string {
+	x, y, z := op>>6, (op>>3)&7, op&7
+	p, q := y>>1, y&1
+
+	switch x {
+	case 0:
+		switch z {
+		case 0:
+			switch y {
+			case 0:
+				return "NOP"
+			case 1:
+				return "EX AF,AF'"
+			case 2:
+				return "DJNZ " + d.rel()
+			case 3:
+				return "JR " + d.rel()
+			}
+			return "JR " + conds[y-4] + "," + d.rel()
+		case 1:
+			if q == 0 {
+				return "LD " + d.pair(p, pairs) + "," + d.nn()
+			}
+			return "ADD " + d.hl() + "," + d.pair(p, pairs)
+		case 2:
+			switch y {
+			case 0:
+				return "LD (BC),A"
+			case 1:
+				return "LD A,(BC)"
+			case 2:
+				return "LD (DE),A"
+			case 3:
+				return "LD A,(DE)"
+			case 4:
+				return "LD (" + d.nn() + ")," + d.hl()
+			case 5:
+				return "LD " + d.hl() + ",(" + d.nn() + ")"
+			case 6:
+				return "LD (" + d.nn() + "),A"
+			}
+			return "LD A,(" + d.nn() + ")"
+		case 3:
+			if q == 0 {
+				return "INC " + d.pair(p, pairs)
+			}
+			return "DEC " + d.pair(p, pairs)
+		case 4:
+			return "INC " + d.reg(y, false)
+		case 5:
+			return "DEC " + d.reg(y, false)
+		case 6:
+			r := d.reg(y, false)
+			return "LD " + r + "," + d.n()
+		}
+		return misc[y]
+
+	case 1:
+		if y == 6 && z == 6 {
+			return "HALT"
+		}
+		memory := y == 6 || z == 6
+		dst := d.reg(y, memory)
+		return "LD " + dst + "," + d.reg(z, memory)
+
+	case 2:
+		return alu[y] + d.reg(z, false)
+	}
+
+	switch z {
+	case 0:
+		return "RET " + conds[y]
+	case 1:
+		if q == 0 {
+			return "POP " + d.pair(p, push)
+		}
+		switch p {
+		case 0:
+			return "RET"
+		case 1:
+			return "EXX"
+		case 2:
+			return "JP (" + d.hl() + ")"
+		}
+		return "LD SP," + d.hl()
+	case 2:
+		return "JP " + conds[y] + "," + d.nn()
+	case 3:
+		switch y {
+		case 0:
+			return "JP " + d.nn()
+		case 2:
+			return "OUT (" + d.n() + "),A"
+		case 3:
+			return "IN A,(" + d.n() + ")"
+		case 4:
+			return "EX (SP)," + d.hl()
+		case 5:
+			return "EX DE,HL"
+		case 6:
+			return "DI"
+		}
+		return "EI"
+	case 4:
+		return "CALL " + conds[y] + "," + d.nn()
+	case 5:
+		if q == 0 {
+			return "PUSH " + d.pair(p, push)
+		}
+		return "CALL " + d.nn()
+	case 6:
+		return alu[y] + d.n()
+	}
+	return fmt.Sprintf("RST %02Xh", y*8)
+}
+
+// cb decodes an instruction with the CB prefix, whose operand is given.
+func (d *decoder) cb(op uint8) string {
+	x, y, z := op>>6, (op>>3)&7, op&7
+	r := d.reg(z, true)
+
+	switch x {
+	case 0:
+		return rots[y] + " " + r
+	case 1:
+		return fmt.Sprintf("BIT %d,%s", y, r)
+	case 2:
+		return fmt.Sprintf("RES %d,%s", y, r)
+	}
+	return fmt.Sprintf("SET %d,%s", y, r)
+}
+
+// indexedCB decodes an instruction with the DDCB or FDCB prefix, where the
+// displacement comes before the opcode.
+func (d *decoder) indexedCB() string {
+	m := d.mem()
+	op := d.byte()
+	x, y := op>>6, (op>>3)&7
+
+	switch x {
+	case 0:
+		return rots[y] + " " + m
+	case 1:
+		return fmt.Sprintf("BIT %d,%s", y, m)
+	case 2:
+		return fmt.Sprintf("RES %d,%s", y, m)
+	}
+	return fmt.Sprintf("SET %d,%s", y, m)
+}
+
+// ed decodes an instruction with the ED prefix.
+func (d *decoder) ed(op uint8) string {
+	x, y, z := op>>6, (op>>3)&7, op&7
+	p, q := y>>1, y&1
+
+	if x == 2 && z <= 3 && y >= 4 {
+		return block[y-4][z]
+	}
+	if x != 1 {
+		return fmt.Sprintf("DB EDh,%02Xh", op)
+	}
+
+	switch z {
+	case 0:
+		if y == 6 {
+			return "IN (C)"
+		}
+		return "IN " + regs[y] + ",(C)"
+	case 1:
+		if y == 6 {
+			return "OUT (C),0"
+		}
+		return "OUT (C)," + regs[y]
+	case 2:
+		if q == 0 {
+			return "SBC HL," + pairs[p]
+		}
+		return "ADC HL," + pairs[p]
+	case 3:
+		if q == 0 {
+			return "LD (" + d.nn() + ")," + pairs[p]
+		}
+		return "LD " + pairs[p] + ",(" + d.nn() + ")"
+	case 4:
+		return "NEG"
+	case 5:
+		if y == 1 {
+			return "RETI"
+		}
+		return "RETN"
+	case 6:
+		return "IM " + modes[y]
+	}
+	if y >= 6 {
+		return fmt.Sprintf("DB EDh,%02Xh", op)
+	}
+	return edMisc[y]
+}
@@ -0,0 +1,84 @@
+package disasm
+
+import (
+	"testing"
+)
+
+// TestDisassemble tests a selection of instructions.
+func TestDisassemble(t *testing.T) {
+
+	type TestCase struct {
+		code   []uint8
+		text   string
+		length int
+	}
+
+	tests := []TestCase{
+		{[]uint8{0x00}, "NOP", 1},
+		{[]uint8{0x01, 0x34, 0x12}, "LD BC,1234h", 3},
+		{[]uint8{0x18, 0xFE}, "JR 0100h", 2},
+		{[]uint8{0x20, 0x10}, "JR NZ,0112h", 2},
+		{[]uint8{0x22, 0x00, 0x80}, "LD (8000h),HL", 3},
+		{[]uint8{0x36, 0x41}, "LD (HL),41h", 2},
+		{[]uint8{0x76}, "HALT", 1},
+		{[]uint8{0x78}, "LD A,B", 1},
+		{[]uint8{0x96}, "SUB (HL)", 1},
+		{[]uint8{0xC3, 0x00, 0x01}, "JP 0100h", 3},
+		{[]uint8{0xCD, 0x05, 0x00}, "CALL 0005h", 3},
+		{[]uint8{0xD3, 0xFF}, "OUT (FFh),A", 2},
+		{[]uint8{0xEF}, "RST 28h", 1},
+		{[]uint8{0xCB, 0x47}, "BIT 0,A", 2},
+		{[]uint8{0xCB, 0xFE}, "SET 7,(HL)", 2},
+		{[]uint8{0xED, 0xB0}, "LDIR", 2},
+		{[]uint8{0xED, 0x56}, "IM 1", 2},
+		{[]uint8{0xED, 0x4B, 0x00, 0x90}, "LD BC,(9000h)", 4},
+		{[]uint8{0xED, 0x00}, "DB EDh,00h", 2},
+		{[]uint8{0xDD, 0x21, 0x00, 0x40}, "LD IX,4000h", 4},
+		{[]uint8{0xDD, 0x7E, 0x05}, "LD A,(IX+05h)", 3},
+		{[]uint8{0xFD, 0x36, 0xFE, 0x20}, "LD (IY-02h),20h", 4},
+		{[]uint8{0xDD, 0x66, 0x01}, "LD H,(IX+01h)", 3},
+		{[]uint8{0xDD, 0x7C}, "LD A,IXH", 2},
+		{[]uint8{0xFD, 0xE9}, "JP (IY)", 2},
+		{[]uint8{0xDD, 0xCB, 0x03, 0x46}, "BIT 0,(IX+03h)", 4},
+		{[]uint8{0xFD, 0xCB, 0xFF, 0x16}, "RL (IY-01h)", 4},
+		{[]uint8{0xDD, 0xDD, 0x00}, "DB DDh", 1},
+	}
+
+	for _, test := range tests {
+		read := func(addr uint16) uint8 {
+			i := int(addr) - 0x0100
+			if i < len(test.code) {
+				return test.code[i]
+			}
+			return 0
+		}
+
+		text, length := Disassemble(read, 0x0100)
+		if text != test.text || length != test.length {
+			t.Fatalf("% X: expected %q (%d), got %q (%d)", test.code, test.text, test.length, text, length)
+		}
+		if len(Bytes(read, 0x0100, length)) != length*3-1 {
+			t.Fatalf("% X: unexpected bytes", test.code)
+		}
+	}
+}
+
+// TestAll ensures every instruction decodes to something sensible.
+func TestAll(t *testing.T) {
+	for _, prefix := range []uint8{0x00, 0xCB, 0xDD, 0xED, 0xFD} {
+		for op := 0; op < 256; op++ {
+			code := []uint8{prefix, uint8(op), 0xCB, 0x00}
+			if prefix == 0x00 {
+				code = code[1:]
+			}
+			read := func(addr uint16) uint8 {
+				return code[int(addr)%len(code)]
+			}
+
+			text, length := Disassemble(read, 0x0000)
+			if text == "" || length < 1 || length > 4 {
+				t.Fatalf("%02X %02X: unexpected result %q (%d)", prefix, op, text, length)
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package fcb
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// illegal contains the characters which may not appear in a CP/M filename.
+const illegal = "<>.,;:=?*[]|/\\\" "
+
+// IsValidName returns true if the given host filename can be used, once
+// upper-cased, as a CP/M filename without any aliasing.
+//
+// That means it must be in 8.3 format, with no illegal characters.
+func IsValidName(name string) bool {
+	stem, ext, _ := strings.Cut(name, ".")
+
+	if len(stem) < 1 || len(stem) > 8 || len(ext) > 3 {
+		return false
+	}
+
+	for _, c := range stem + ext {
+		if c <= ' ' || c >= 0x7F || strings.ContainsRune(illegal, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// clean returns the given string, upper-cased, with spaces and dots
+// removed and any other illegal characters replaced by underscores.
+func clean(str string) string {
+	var out strings.Builder
+
+	for _, c := range strings.ToUpper(str) {
+		switch {
+		case c == ' ' || c == '.':
+			// dropped
+		case c < ' ' || c >= 0x7F || strings.ContainsRune(illegal, c):
+			out.WriteByte('_')
+		default:
+			out.WriteRune(c)
+		}
+	}
+	return out.String()
+}
+
+// Aliases returns a map of CP/M filenames to the host filenames they
+// refer to, for the given list of host filenames.
+//
+// Names which are already valid are upper-cased, and other names are
+// given a short alias in the style of VFAT, from the start of the name
+// and a hash of all of it, for example "notes-2024.txt" might become
+// "NO416E~1.TXT".  As the aliases depend upon the names themselves,
+// rather than upon the other files present, they remain the same when
+// files are added or removed.
+//
+// Names which differ only in case from another valid name are aliased
+// too, rather than being hidden.
+func Aliases(names []string) map[string]string {
+	ret := make(map[string]string)
+
+	// Sort the names, so that we're deterministic.
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+
+	// Valid names first, so that they keep their own names even if an
+	// alias would otherwise clash with them.  Names which are already
+	// upper-case are preferred, as they're what CP/M would have written.
+	var long []string
+	for _, name := range sorted {
+		if IsValidName(name) && name == strings.ToUpper(name) {
+			ret[name] = name
+		}
+	}
+	for _, name := range sorted {
+		if !IsValidName(name) {
+			long = append(long, name)
+			continue
+		}
+		upper := strings.ToUpper(name)
+		if host, ok := ret[upper]; ok {
+			if host != name {
+				long = append(long, name)
+			}
+			continue
+		}
+		ret[upper] = name
+	}
+
+	for _, name := range long {
+
+		// Split on the last period, ignoring any leading ones.
+		stem := strings.TrimLeft(name, ".")
+		ext := ""
+		if i := strings.LastIndex(stem, "."); i > 0 {
+			ext = stem[i+1:]
+			stem = stem[:i]
+		}
+
+		stem = clean(stem)
+		if stem == "" {
+			stem = "_"
+		}
+		if len(stem) > 2 {
+			stem = stem[:2]
+		}
+		ext = clean(ext)
+		if len(ext) > 3 {
+			ext = ext[:3]
+		}
+
+		// The hash of the whole name makes the alias unique, almost
+		// always, so the numeric tail only changes upon a collision.
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		sum := h.Sum32()
+		base := fmt.Sprintf("%s%04X", stem, uint16(sum^sum>>16))
+
+		// Find the first free numeric tail.
+		for n := 1; ; n++ {
+			tail := fmt.Sprintf("~%d", n)
+
+			alias := base + tail
+			if len(alias) > 8 {
+				alias = base[:8-len(tail)] + tail
+			}
+			if ext != "" {
+				alias += "." + ext
+			}
+
+			if _, ok := ret[alias]; !ok {
+				ret[alias] = name
+				break
+			}
+		}
+	}
+
+	return ret
+}
+
+// HostPath returns the path of the host file which the given CP/M filename
+// refers to, within the given directory.
+//
+// If there is no matching file we return the name within the directory,
+// which is suitable for creating a new file.
+func HostPath(dir string, name string) string {
+
+	files, err := os.ReadDir(dir)
+	if err == nil {
+		var names []string
+		for _, f := range files {
+			if !f.IsDir() {
+				names = append(names, f.Name())
+			}
+		}
+
+		if host, ok := Aliases(names)[strings.ToUpper(name)]; ok {
+			return filepath.Join(dir, host)
+		}
+	}
+
+	return filepath.Join(dir, name)
+}
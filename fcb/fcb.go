@@ -4,6 +4,7 @@ package fcb
 import (
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"unicode"
 )
@@ -70,15 +71,21 @@ type FCBFind struct {
 	// Name is the name as CP/M would see it.
 	// This will be upper-cased and in 8.3 format.
 	Name string
+
+	// Size is the size of the file, in bytes.
+	Size int64
 }
 
 // GetName returns the name component of an FCB entry.
+//
+// Bit 7 of each character is an attribute, rather than part of the name,
+// so it is ignored.
 func (f *FCB) GetName() string {
 	t := ""
 
 	for _, c := range f.Name {
-		if c != 0x00 {
-			t += string(c)
+		if c&0x7F != 0x00 {
+			t += string(c & 0x7F)
 		}
 	}
 	return strings.TrimSpace(t)
@@ -86,11 +93,13 @@ func (f *FCB) GetName() string {
 
 // GetType returns the type/extension component of an FCB entry.
 //
-// If the extension is null, or empty, we return the empty string.
+// If the extension is null, or empty, we return the empty string.  As with
+// the name, bit 7 of each character is an attribute and is ignored.
 func (f *FCB) GetType() string {
 	t := ""
 
 	for _, c := range f.Type {
+		c &= 0x7F
 		if unicode.IsPrint(rune(c)) {
 			t += string(c)
 		} else {
@@ -136,42 +145,91 @@ func (f *FCB) AsBytes() []uint8 {
 	return r
 }
 
+// RecordsPerExtent is the number of 128-byte records in each extent.
+const RecordsPerExtent = 128
+
+// ExtentsPerModule is the number of extents in each module, the module
+// number being stored in S2.
+const ExtentsPerModule = 32
+
+// MaxRecords is the number of records in the largest file we support.
+//
+// CP/M 2.2 only allows 8MB files, but CP/M 3 raised that to 32MB with
+// 64 modules, and we allow the larger size.
+const MaxRecords = 64 * ExtentsPerModule * RecordsPerExtent
+
+// GetSequentialRecord returns the record the FCB contains for the
+// sequential read/write calls - as used by the BDOS functions F_READ
+// and F_WRITE.
+//
+// The record is made up of the module number (S2), the extent (Ex),
+// and the current record within that extent (Cr).
+func (f *FCB) GetSequentialRecord() int {
+	return (int(f.S2&0x3F)*ExtentsPerModule+int(f.Ex&0x1F))*RecordsPerExtent + int(f.Cr)
+}
+
+// SetSequentialRecord updates the module, extent, and current record of
+// the FCB to point to the given record.
+func (f *FCB) SetSequentialRecord(record int) {
+	f.Cr = uint8(record % RecordsPerExtent)
+	f.Ex = uint8((record / RecordsPerExtent) % ExtentsPerModule)
+	f.S2 = uint8(record / (RecordsPerExtent * ExtentsPerModule))
+}
+
 // GetSequentialOffset returns the offset the FCB contains for
 // the sequential read/write calls - as used by the BDOS functions
 // F_READ and F_WRITE.
 //
 // IncreaseSequentialOffset updates the value.
 func (f *FCB) GetSequentialOffset() int64 {
-
-	// Helpers
-	BlkS2 := 4096
-	BlkEx := 128
-	MaxS2 := 15
-	blkSize := 128
-
-	offset := int64((int(f.S2)&MaxS2)*BlkS2*blkSize +
-		int(f.Ex)*BlkEx*blkSize +
-		int(f.Cr)*blkSize)
-	return offset
+	return int64(f.GetSequentialRecord()) * 128
 }
 
 // IncreaseSequentialOffset updates the read/write offset which
 // would be used for the sequential read functions.
+//
+// As with CP/M the current record is left at 128 once the final record
+// of an extent has been used, and we move to the next extent when the
+// following record is used.
 func (f *FCB) IncreaseSequentialOffset() {
 
-	MaxCR := 128
-	MaxEX := 31
-
 	f.S2 &= 0x7F // reset unmodified flag
+
+	// Move to the next extent, if this one was used up.
+	if f.Cr >= RecordsPerExtent {
+		f.SetSequentialRecord(f.GetSequentialRecord())
+	}
 	f.Cr++
-	if int(f.Cr) > MaxCR {
-		f.Cr = 1
-		f.Ex++
+}
+
+// GetExtentRecords returns the number of records in the current extent,
+// for a file of the given number of records.
+//
+// This is the value which belongs in the RC field.
+func (f *FCB) GetExtentRecords(records int) uint8 {
+	start := (int(f.S2&0x3F)*ExtentsPerModule + int(f.Ex&0x1F)) * RecordsPerExtent
+
+	n := records - start
+	if n < 0 {
+		n = 0
 	}
-	if int(f.Ex) > MaxEX {
-		f.Ex = 0
-		f.S2++
+	if n > RecordsPerExtent {
+		n = RecordsPerExtent
 	}
+	return uint8(n)
+}
+
+// GetRandomRecord returns the record the FCB contains for the random
+// read/write calls, as stored in R0, R1, and R2.
+func (f *FCB) GetRandomRecord() int {
+	return int(f.R2)<<16 | int(f.R1)<<8 | int(f.R0)
+}
+
+// SetRandomRecord updates R0, R1, and R2 to contain the given record.
+func (f *FCB) SetRandomRecord(record int) {
+	f.R0 = uint8(record & 0xFF)
+	f.R1 = uint8(record >> 8)
+	f.R2 = uint8(record >> 16)
 }
 
 // FromString returns an FCB entry from the given string.
@@ -335,8 +393,8 @@ func (f *FCB) DoesMatch(name string) bool {
 
 // GetMatches returns the files matching the pattern in the given FCB record.
 //
-// We try to do this by converting the entries of the named directory into FCBs
-// after ignoring those with impossible formats - i.e. not FILENAME.EXT length.
+// We try to do this by converting the entries of the named directory into FCBs,
+// using short aliases for those files which don't have names in 8.3 format.
 func (f *FCB) GetMatches(prefix string) ([]FCBFind, error) {
 	var ret []FCBFind
 
@@ -346,30 +404,45 @@ func (f *FCB) GetMatches(prefix string) ([]FCBFind, error) {
 		return ret, err
 	}
 
-	// For each file
+	// Ignore directories, we only care about files.
+	entries := make(map[string]os.DirEntry)
+	var names []string
 	for _, file := range files {
-
-		// Ignore directories, we only care about files.
-		if file.IsDir() {
-			continue
+		if !file.IsDir() {
+			entries[file.Name()] = file
+			names = append(names, file.Name())
 		}
+	}
+
+	// For each file, as CP/M will see it.
+	for name, host := range Aliases(names) {
 
-		name := strings.ToUpper(file.Name())
 		if f.DoesMatch(name) {
 
 			var ent FCBFind
 
 			// Populate the host-path before we do anything else.
-			ent.Host = filepath.Join(prefix, file.Name())
+			ent.Host = filepath.Join(prefix, host)
 
-			// populate the name, but note it needs to be upper-cased
+			// populate the name, which is already upper-cased
 			ent.Name = name
 
+			// populate the size, if we can.
+			info, err := entries[host].Info()
+			if err == nil {
+				ent.Size = info.Size()
+			}
+
 			// append
 			ret = append(ret, ent)
 		}
 	}
 
+	// Sort the entries, since our aliases are unordered.
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+
 	// Return the entries we found, if any.
 	return ret, nil
 }
@@ -2,6 +2,8 @@ package fcb
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -174,3 +176,136 @@ func TestDoesMatch(t *testing.T) {
 		}
 	}
 }
+
+// TestAliases tests that long host names are given stable short aliases.
+func TestAliases(t *testing.T) {
+
+	names := []string{
+		"notes-2024.txt",
+		"notes-2025.txt",
+		"My Program.com",
+		"foo.txt",
+		"Foo.txt",
+		"README",
+		"readme",
+		"NOTES-~1.TXT",
+		".bashrc",
+		"archive.tar.gz",
+	}
+
+	expected := map[string]string{
+		"FOO.TXT":      "Foo.txt",
+		"FO4345~1.TXT": "foo.txt",
+		"README":       "README",
+		"REEAA0~1":     "readme",
+		"NOTES-~1.TXT": "NOTES-~1.TXT",
+		"NO416E~1.TXT": "notes-2024.txt",
+		"NOEB7C~1.TXT": "notes-2025.txt",
+		"MYC593~1.COM": "My Program.com",
+		"BA68CA~1":     ".bashrc",
+		"ARB129~1.GZ":  "archive.tar.gz",
+	}
+
+	out := Aliases(names)
+	if len(out) != len(expected) {
+		t.Fatalf("wrong number of aliases: %v", out)
+	}
+	for alias, host := range expected {
+		if out[alias] != host {
+			t.Fatalf("alias %s should be %s, got %s", alias, host, out[alias])
+		}
+	}
+
+	// The order of the names shouldn't matter.
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	for alias, host := range Aliases(names) {
+		if expected[alias] != host {
+			t.Fatalf("alias %s changed to %s", alias, host)
+		}
+	}
+
+	// Nor should adding and removing other files.
+	for alias, host := range Aliases([]string{"notes-2023.txt", "notes-2025.txt", "Notes-2025.TXT"}) {
+		if host == "notes-2025.txt" && alias != "NOEB7C~1.TXT" {
+			t.Fatalf("alias of %s changed to %s", host, alias)
+		}
+	}
+
+	// Names with the same hash are told apart by their tail.
+	out = Aliases([]string{"long name 426.txt", "long name 2.txt"})
+	if out["LO7B3E~1.TXT"] != "long name 2.txt" || out["LO7B3E~2.TXT"] != "long name 426.txt" {
+		t.Fatalf("colliding names were not told apart: %v", out)
+	}
+
+	// Now test we can find them on disk.
+	dir := t.TempDir()
+	for _, name := range []string{"notes-2024.txt", "foo.txt"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte("hello"), 0644)
+		if err != nil {
+			t.Fatalf("failed to write file")
+		}
+	}
+
+	f := FromString("*.TXT")
+	res, err := f.GetMatches(dir)
+	if err != nil {
+		t.Fatalf("failed to find files: %s", err)
+	}
+	if len(res) != 2 || res[0].Name != "FOO.TXT" || res[1].Name != "NO416E~1.TXT" {
+		t.Fatalf("unexpected matches %v", res)
+	}
+	if res[1].Size != 5 {
+		t.Fatalf("wrong size for %s", res[1].Name)
+	}
+
+	if HostPath(dir, "no416e~1.txt") != filepath.Join(dir, "notes-2024.txt") {
+		t.Fatalf("failed to resolve alias")
+	}
+	if HostPath(dir, "NEW.TXT") != filepath.Join(dir, "NEW.TXT") {
+		t.Fatalf("failed to resolve new file")
+	}
+}
+
+// TestRecords tests the sequential and random record helpers.
+func TestRecords(t *testing.T) {
+
+	f := FromString("test.dat")
+
+	// Sequential access moves through the extents.
+	for i := 0; i < 130; i++ {
+		if f.GetSequentialRecord() != i {
+			t.Fatalf("wrong record %d != %d", f.GetSequentialRecord(), i)
+		}
+		f.IncreaseSequentialOffset()
+
+		// At the end of an extent we stay there
+		if i == 127 && (f.Ex != 0 || f.Cr != 128) {
+			t.Fatalf("moved to the next extent too soon")
+		}
+	}
+	if f.Ex != 1 || f.Cr != 2 {
+		t.Fatalf("wrong position Ex:%d Cr:%d", f.Ex, f.Cr)
+	}
+
+	// Modules are in S2
+	f.SetSequentialRecord(9000)
+	if f.S2 != 2 || f.Ex != 6 || f.Cr != 40 || f.GetSequentialOffset() != 9000*128 {
+		t.Fatalf("wrong position S2:%d Ex:%d Cr:%d", f.S2, f.Ex, f.Cr)
+	}
+
+	// Records in the current extent
+	if f.GetExtentRecords(9000) != 40 {
+		t.Fatalf("wrong extent records %d", f.GetExtentRecords(9000))
+	}
+	if f.GetExtentRecords(20000) != 128 || f.GetExtentRecords(10) != 0 {
+		t.Fatalf("wrong extent records")
+	}
+
+	// Random records span three bytes
+	f.SetRandomRecord(MaxRecords)
+	if f.R0 != 0 || f.R1 != 0 || f.R2 != 4 || f.GetRandomRecord() != MaxRecords {
+		t.Fatalf("wrong random record")
+	}
+}
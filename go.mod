@@ -7,4 +7,4 @@ require (
 	golang.org/x/term v0.21.0
 )
 
-require golang.org/x/sys v0.21.0 // indirect
+require golang.org/x/sys v0.21.0
@@ -10,9 +10,12 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/skx/cpmulator/archive"
 	cpmccp "github.com/skx/cpmulator/ccp"
+	"github.com/skx/cpmulator/config"
 	"github.com/skx/cpmulator/consoleout"
 	"github.com/skx/cpmulator/cpm"
+	"github.com/skx/cpmulator/ports"
 	"github.com/skx/cpmulator/static"
 	cpmver "github.com/skx/cpmulator/version"
 )
@@ -23,52 +26,123 @@ var (
 	log *slog.Logger
 )
 
+// reportCrash writes a crash report, if configured to, after the emulator
+// stopped with the given error, and tells the user where it is.
+func reportCrash(obj *cpm.CPM, err error) {
+	path, rerr := obj.WriteCrashReport(err)
+	if rerr != nil {
+		fmt.Printf("Error writing crash report: %s\n", rerr)
+		return
+	}
+	if path != "" {
+		fmt.Printf("A crash report has been written to %s\n", path)
+	}
+}
+
 func main() {
 
 	//
 	// Parse the command-line flags for this driver-application
 	//
+	auxIn := flag.String("aux-in", "", "The endpoint to use for auxiliary (reader) input, the console is used by default.")
+	auxOut := flag.String("aux-out", "", "The endpoint to use for auxiliary (punch) output, the console is used by default.")
+	banks := flag.Int("banks", 1, "The number of 64K memory banks, for programs which use the BIOS SELMEM, MOVE, and XMOVE functions.")
+	bdos := flag.Uint("bdos", 0xF000, "The address of the BDOS, which marks the top of the TPA available to programs.")
+	bios := flag.Uint("bios", 0xFE00, "The address of the BIOS, which must be above the BDOS.")
 	cd := flag.String("cd", "", "Change to this directory before launching")
+	continueUnimplemented := flag.Bool("continue-unimplemented", false, "Continue when programs call unimplemented BDOS or BIOS functions, returning -unimplemented-value, and summarize the calls at exit.")
 	createDirectories := flag.Bool("create", false, "Create subdirectories on the host computer for each CP/M drive.")
 	console := flag.String("console", "adm-3a", "The name of the console output driver to use (adm-3a or ansi).")
+	charset := flag.String("charset", "none", "The translation to apply to output characters with bit 7 set (none, strip, reverse, cp437, or kaypro).")
 	ccp := flag.String("ccp", "ccp", "The name of the CCP that we should run (ccp vs. ccpz).")
+	common := flag.Uint("common", 0xC000, "The address at which memory shared by all banks starts, when there is more than one bank.")
+	crashReport := flag.String("crash-report", "cpmulator-crash.log", "The file to write a report to, if the emulator stops with an error.  Set to an empty string to disable.")
+	crashMemory := flag.Bool("crash-memory", false, "Include the contents of memory in crash reports.")
+	configPath := flag.String("config", "", "The configuration file to load, by default cpmulator.json is loaded from the -cd directory if present.")
+	cpu := flag.String("cpu", "z80", "The processor to emulate, z80 or 8080.  In 8080 mode Z80-only instructions are refused.")
 	useDirectories := flag.Bool("directories", false, "Use subdirectories on the host computer for CP/M drives.")
+	expand := flag.Bool("expand", false, "Expand squeezed and crunched files within archives mounted as drives.")
+	idle := flag.Bool("idle", true, "Wait for input when programs are polling the console in a tight loop, rather than using 100% of a host CPU.")
+	interruptHz := flag.Float64("interrupt-hz", 0, "Raise a maskable interrupt the given number of times a second, for programs which install their own interrupt handler.")
+	interruptVector := flag.Uint("interrupt-vector", 0xFF, "The value placed upon the data bus by the interrupt timer, an instruction in IM 0 or the vector in IM 2.")
 	logPath := flag.String("log-path", "", "Specify the file to write debug logs to.")
 	logAll := flag.Bool("log-all", false, "Log the output of all functions, including the noisy Console I/O ones.")
+	maxOpenFiles := flag.Int("max-open-files", 64, "The number of host files which CP/M programs may have open at the same time.")
+	mhz := flag.Float64("mhz", 0, "Limit the speed of the emulated processor to the given clock rate in MHz, such as 4, rather than running as fast as possible.")
+	portDevices := flag.String("ports", "", "A comma-separated list of devices to attach to I/O ports, as name@port, such as rtc@0x80.")
+	protect := flag.Bool("protect", false, "Stop programs which write to the memory reserved for our BIOS and BDOS.")
 	prnPath := flag.String("prn-path", "print.log", "Specify the file to write printer-output to.")
+	prnCommand := flag.String("prn-command", "", "Specify a command to pipe printer-output to, instead of writing to a file.")
+	prnSplit := flag.Bool("prn-split", false, "Split printer-output into a numbered file, or command invocation, for each page.")
 	showVersion := flag.Bool("version", false, "Report our version, and exit.")
+	textDrives := flag.String("text-drives", "", "A comma-separated list of drives upon which files are opened in text mode.")
+	textExt := flag.String("text-ext", "", "A comma-separated list of file extensions which are opened in text mode.")
+	unimplementedValue := flag.Uint("unimplemented-value", 0xFF, "The value returned, in A and HL, by unimplemented functions when -continue-unimplemented is used.")
+	transcript := flag.String("transcript", "", "Specify the file to write a transcript of all console output to.")
+	transcriptRaw := flag.Bool("transcript-raw", false, "Write the raw console output to the transcript, rather than plain text.")
 
 	// listing
 	listCcps := flag.Bool("list-ccp", false, "Dump the list of embedded CCPs.")
+	listCharsets := flag.Bool("list-charsets", false, "Dump the list of valid output character translations.")
 	listConsole := flag.Bool("list-console-drivers", false, "Dump the list of valid console drivers.")
+	listPorts := flag.Bool("list-port-devices", false, "Dump the list of devices which may be attached to I/O ports.")
 	listSyscalls := flag.Bool("list-syscalls", false, "Dump the list of implemented BIOS/BDOS syscall functions.")
 
 	// drives
 	drive := make(map[string]*string)
-	drive["A"] = flag.String("drive-a", "", "The path to the directory for A:")
-	drive["B"] = flag.String("drive-b", "", "The path to the directory for B:")
-	drive["C"] = flag.String("drive-c", "", "The path to the directory for C:")
-	drive["D"] = flag.String("drive-d", "", "The path to the directory for D:")
-	drive["E"] = flag.String("drive-e", "", "The path to the directory for E:")
-	drive["F"] = flag.String("drive-f", "", "The path to the directory for F:")
-	drive["G"] = flag.String("drive-g", "", "The path to the directory for G:")
-	drive["H"] = flag.String("drive-h", "", "The path to the directory for H:")
-	drive["I"] = flag.String("drive-i", "", "The path to the directory for I:")
-	drive["J"] = flag.String("drive-j", "", "The path to the directory for J:")
-	drive["K"] = flag.String("drive-k", "", "The path to the directory for K:")
-	drive["L"] = flag.String("drive-l", "", "The path to the directory for L:")
-	drive["M"] = flag.String("drive-m", "", "The path to the directory for M:")
-	drive["N"] = flag.String("drive-n", "", "The path to the directory for N:")
-	drive["O"] = flag.String("drive-o", "", "The path to the directory for O:")
-	drive["P"] = flag.String("drive-p", "", "The path to the directory for P:")
+	drive["A"] = flag.String("drive-a", "", "The path to the directory, or archive, for A:")
+	drive["B"] = flag.String("drive-b", "", "The path to the directory, or archive, for B:")
+	drive["C"] = flag.String("drive-c", "", "The path to the directory, or archive, for C:")
+	drive["D"] = flag.String("drive-d", "", "The path to the directory, or archive, for D:")
+	drive["E"] = flag.String("drive-e", "", "The path to the directory, or archive, for E:")
+	drive["F"] = flag.String("drive-f", "", "The path to the directory, or archive, for F:")
+	drive["G"] = flag.String("drive-g", "", "The path to the directory, or archive, for G:")
+	drive["H"] = flag.String("drive-h", "", "The path to the directory, or archive, for H:")
+	drive["I"] = flag.String("drive-i", "", "The path to the directory, or archive, for I:")
+	drive["J"] = flag.String("drive-j", "", "The path to the directory, or archive, for J:")
+	drive["K"] = flag.String("drive-k", "", "The path to the directory, or archive, for K:")
+	drive["L"] = flag.String("drive-l", "", "The path to the directory, or archive, for L:")
+	drive["M"] = flag.String("drive-m", "", "The path to the directory, or archive, for M:")
+	drive["N"] = flag.String("drive-n", "", "The path to the directory, or archive, for N:")
+	drive["O"] = flag.String("drive-o", "", "The path to the directory, or archive, for O:")
+	drive["P"] = flag.String("drive-p", "", "The path to the directory, or archive, for P:")
 
 	flag.Parse()
 
+	// Load the configuration file, if there is one, which provides
+	// the values of any flags which weren't given.
+	cfg := &config.Config{}
+	if *configPath == "" {
+		*configPath = config.Find(*cd)
+	}
+	if *configPath != "" {
+		var err error
+		cfg, err = config.Load(*configPath)
+		if err != nil {
+			fmt.Printf("error loading configuration: %s\n", err)
+			return
+		}
+		err = cfg.Apply(flag.CommandLine)
+		if err != nil {
+			fmt.Printf("error applying configuration %s: %s\n", *configPath, err)
+			return
+		}
+	}
+
 	// Are we dumping CCPs?
 	if *listCcps {
 		x := cpmccp.GetAll()
 		for _, x := range x {
-			fmt.Printf("%5s %-10s %04X bytes, entry-point %04X\n", x.Name, x.Description, len(x.Bytes), x.Start)
+			fmt.Printf("%5s %-10s %04X bytes, assembled for %04X\n", x.Name, x.Description, len(x.Bytes), x.Start)
+		}
+		return
+	}
+
+	// Are we dumping character translations?
+	if *listCharsets {
+		for _, name := range consoleout.GetCharsets() {
+			cs, _ := consoleout.GetCharset(name)
+			fmt.Printf("%-8s %s\n", cs.Name, cs.Description)
 		}
 		return
 	}
@@ -83,6 +157,15 @@ func main() {
 		}
 		return
 	}
+
+	// Are we dumping port devices?
+	if *listPorts {
+		for _, name := range ports.Names() {
+			fmt.Printf("%-8s %s\n", name, ports.Description(name))
+		}
+		return
+	}
+
 	// Are we dumping syscalls?
 	if *listSyscalls {
 
@@ -173,11 +256,53 @@ func main() {
 	// Set the logger now we've updated as appropriate.
 	slog.SetDefault(log)
 
+	// Addresses must fit in 16 bits.
+	for name, addr := range map[string]uint{"BDOS": *bdos, "BIOS": *bios, "common memory": *common} {
+		if addr > 0xFFFF {
+			fmt.Printf("invalid %s address 0x%X\n", name, addr)
+			return
+		}
+	}
+
+	// The interrupt vector is a single byte.
+	if *interruptVector > 0xFF {
+		fmt.Printf("invalid interrupt vector 0x%X\n", *interruptVector)
+		return
+	}
+
+	// The value returned by unimplemented functions is a single byte.
+	if *unimplementedValue > 0xFF {
+		fmt.Printf("invalid unimplemented value 0x%X\n", *unimplementedValue)
+		return
+	}
+
 	// Create a new emulator.
 	obj, err := cpm.New(
 		cpm.WithPrinterPath(*prnPath),
+		cpm.WithPrinterCommand(*prnCommand),
+		cpm.WithPrinterPageSplit(*prnSplit),
 		cpm.WithConsoleDriver(*console),
+		cpm.WithCharset(*charset),
+		cpm.WithAuxInput(*auxIn),
+		cpm.WithAuxOutput(*auxOut),
 		cpm.WithCCP(*ccp),
+		cpm.WithCPU(*cpu),
+		cpm.WithMemoryLayout(uint16(*bdos), uint16(*bios)),
+		cpm.WithBanks(*banks, uint16(*common)),
+		cpm.WithMemoryProtection(*protect),
+		cpm.WithCrashReport(*crashReport, *crashMemory),
+		cpm.WithContinueUnimplemented(*continueUnimplemented, uint8(*unimplementedValue)),
+		cpm.WithTranscript(*transcript, !*transcriptRaw),
+		cpm.WithTextDrives(*textDrives),
+		cpm.WithTextExtensions(*textExt),
+		cpm.WithMaxOpenFiles(*maxOpenFiles),
+		cpm.WithExpandArchives(*expand),
+		cpm.WithMHz(*mhz),
+		cpm.WithInterruptTimer(*interruptHz, uint8(*interruptVector)),
+		cpm.WithIdle(*idle),
+		cpm.WithPorts(*portDevices),
+		cpm.WithAutoExec(cfg.Autoexec),
+		cpm.WithKeymap(cfg.Keymap),
 	)
 	if err != nil {
 		fmt.Printf("error creating CPM object: %s\n", err)
@@ -189,6 +314,14 @@ func main() {
 		obj.LogNoisy()
 	}
 
+	// When we're finishing we'll list any unimplemented functions which
+	// were called, after the console state has been reset below.
+	defer func() {
+		if summary := obj.UnimplementedSummary(); summary != "" {
+			fmt.Print(summary)
+		}
+	}()
+
 	// When we're finishing we'll reset some (console) state.
 	defer obj.Cleanup()
 
@@ -254,10 +387,21 @@ func main() {
 	}
 
 	// Do we have custom paths?  If so set them.
+	//
+	// These might be archives, rather than directories.
 	for d, pth := range drive {
-		if pth != nil && *pth != "" {
-			obj.SetDrivePath(d, *pth)
+		if pth == nil || *pth == "" {
+			continue
+		}
+		if archive.IsArchive(*pth) {
+			err := obj.MountArchive(d, *pth)
+			if err != nil {
+				fmt.Printf("Error mounting archive for %s: %s\n", d, err)
+				return
+			}
+			continue
 		}
+		obj.SetDrivePath(d, *pth)
 	}
 
 	// Load the binary, if we were given one.
@@ -292,6 +436,7 @@ func main() {
 
 			fmt.Printf("Error running %s [%s]: %s\n",
 				program, strings.Join(args, ","), err)
+			reportCrash(obj, err)
 		}
 
 		fmt.Printf("\n")
@@ -301,6 +446,16 @@ func main() {
 	// Show a startup-banner.
 	fmt.Printf("\ncpmulator %s loaded CCP %s, with %s output driver\n", cpmver.GetVersionString(), obj.GetCCPName(), obj.GetOutputDriver())
 
+	// Show the auxiliary devices, if any, since the user might need
+	// to know which pseudo-terminal, or port, to connect to.
+	in, out := obj.GetAuxDevices()
+	if in != "" {
+		fmt.Printf("auxiliary input from %s\n", in)
+	}
+	if out != "" {
+		fmt.Printf("auxiliary output to %s\n", out)
+	}
+
 	// We will load AUTOEXEC.SUB, once, if it exists (*)
 	//
 	// * - Terms and conditions apply.
@@ -341,6 +496,7 @@ func main() {
 			}
 
 			fmt.Printf("\nError running CCP: %s\n", err)
+			reportCrash(obj, err)
 			return
 		}
 	}
@@ -1,21 +1,133 @@
 // Package memory is a package that provides the 64k of RAM
 // within which the emulator executes its programs.
+//
+// The memory may optionally be split into several banks, as used by
+// banked CP/M 3 and MP/M systems.  In that case the addresses below the
+// start of the common area are banked, and only one bank is visible to
+// the processor at a time, while those above are shared by all banks.
 package memory
 
 import (
+	"fmt"
 	"os"
 )
 
 // Memory is our structure for representing the 64k of RAM
 // that we run our programs within.
 type Memory struct {
+	// buf holds the memory which is visible to the processor.
 	buf [65536]uint8
+
+	// banks holds the banked memory of each bank, other than the one
+	// which is selected, whose contents are in buf.
+	banks [][]uint8
+
+	// bank is the number of the selected bank.
+	bank int
+
+	// common is the address at which the common area starts.
+	common uint16
+
+	// watches contains our watchpoints.
+	watches []watch
+
+	// nextWatch is the ID of the last watchpoint created.
+	nextWatch int
+
+	// watched holds the kinds of access watched for at each address,
+	// or nil if there are no watchpoints.
+	watched *[65536]Access
+
+	// reads is the number of bytes read via Get.
+	reads uint64
+}
+
+// SetBanks splits the memory into the given number of banks, with the
+// memory from the common address upwards shared between them.
+//
+// The first bank is selected, and the contents of the other banks are
+// cleared.  A single bank is the default, and is the same as having no
+// banked memory.
+func (m *Memory) SetBanks(count int, common uint16) error {
+	if count < 1 || count > 256 {
+		return fmt.Errorf("invalid number of memory banks %d", count)
+	}
+	if count > 1 && common == 0 {
+		return fmt.Errorf("banked memory requires a common area")
+	}
+
+	m.bank = 0
+	m.common = common
+	m.banks = nil
+	if count > 1 {
+		m.banks = make([][]uint8, count)
+		for i := range m.banks {
+			m.banks[i] = make([]uint8, common)
+		}
+	}
+	return nil
+}
+
+// Banks returns the number of memory banks.
+func (m *Memory) Banks() int {
+	if len(m.banks) == 0 {
+		return 1
+	}
+	return len(m.banks)
+}
+
+// Bank returns the number of the selected memory bank.
+func (m *Memory) Bank() int {
+	return m.bank
+}
+
+// Common returns the address at which the common area starts, which is
+// zero if the memory isn't banked.
+func (m *Memory) Common() uint16 {
+	return m.common
+}
+
+// SelectBank makes the given bank visible to the processor.
+func (m *Memory) SelectBank(bank int) error {
+	if bank < 0 || bank >= m.Banks() {
+		return fmt.Errorf("invalid memory bank %d", bank)
+	}
+	if bank == m.bank {
+		return nil
+	}
+
+	// Save the banked memory of the current bank, and load
+	// that of the new one.
+	copy(m.banks[m.bank], m.buf[:m.common])
+	copy(m.buf[:m.common], m.banks[bank])
+	m.bank = bank
+	return nil
+}
+
+// GetBank returns a byte at addr of the given bank, which need not be
+// the one selected.
+func (m *Memory) GetBank(bank int, addr uint16) uint8 {
+	if bank != m.bank && addr < m.common {
+		return m.banks[bank][addr]
+	}
+	return m.Get(addr)
+}
+
+// SetBank sets a byte at addr of the given bank, which need not be the
+// one selected.
+func (m *Memory) SetBank(bank int, addr uint16, value uint8) {
+	if bank != m.bank && addr < m.common {
+		m.banks[bank][addr] = value
+		return
+	}
+	m.Set(addr, value)
 }
 
 // FillRange fills an area of memory with the given byte
 func (m *Memory) FillRange(addr uint16, size int, char uint8) {
 	for size > 0 {
 		m.buf[addr] = char
+		m.touched(Write, addr, char)
 		addr++
 		size--
 	}
@@ -23,14 +135,24 @@ func (m *Memory) FillRange(addr uint16, size int, char uint8) {
 
 // Get returns a byte at addr of memory.
 func (m *Memory) Get(addr uint16) uint8 {
+	m.reads++
+	m.touched(Read, addr, m.buf[addr])
 	return m.buf[addr]
 }
 
+// Reads returns the number of bytes which have been read via Get.
+//
+// The processor fetches its instructions via Get, so this gives a measure
+// of how much work it has done.
+func (m *Memory) Reads() uint64 {
+	return m.reads
+}
+
 // GetRange returns the contents of a given range
 func (m *Memory) GetRange(addr uint16, size int) []uint8 {
 	var ret []uint8
 	for size > 0 {
-		ret = append(ret, m.buf[addr])
+		ret = append(ret, m.Get(addr))
 		addr++
 		size--
 	}
@@ -69,10 +191,17 @@ func (m *Memory) LoadFile(offset uint16, name string) error {
 // Set sets a byte at addr of memory.
 func (m *Memory) Set(addr uint16, value uint8) {
 	m.buf[addr] = value
+	m.touched(Write, addr, value)
 }
 
 // SetRange copies bytes from the given data to the specified
 // starting address in RAM.
 func (m *Memory) SetRange(addr uint16, data ...uint8) {
 	copy(m.buf[int(addr):int(addr)+len(data)], data)
+
+	if m.watched != nil {
+		for i, c := range data {
+			m.touched(Write, addr+uint16(i), c)
+		}
+	}
 }
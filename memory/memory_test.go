@@ -26,6 +26,11 @@ func TestMemoryTrivial(t *testing.T) {
 		t.Fatalf("failed to get expected result")
 	}
 
+	// Reads are counted
+	if mem.Reads() != 4 {
+		t.Fatalf("unexpected read count %d", mem.Reads())
+	}
+
 	// Fill with 0xCD
 	mem.FillRange(0x00, 0xFFFF, 0xCD)
 
@@ -107,3 +112,115 @@ func TestLoadFile(t *testing.T) {
 		}
 	}
 }
+
+// TestBanks tests our banked memory.
+func TestBanks(t *testing.T) {
+
+	mem := new(Memory)
+	if mem.Banks() != 1 {
+		t.Fatalf("expected a single bank by default")
+	}
+	if mem.SelectBank(1) == nil {
+		t.Fatalf("expected error selecting a missing bank")
+	}
+	if mem.SetBanks(0, 0xC000) == nil || mem.SetBanks(2, 0) == nil {
+		t.Fatalf("expected error with invalid banks")
+	}
+
+	err := mem.SetBanks(3, 0xC000)
+	if err != nil {
+		t.Fatalf("failed to setup banks: %s", err)
+	}
+	if mem.Banks() != 3 || mem.Common() != 0xC000 {
+		t.Fatalf("unexpected bank setup")
+	}
+
+	// Write to the same addresses in each bank.
+	for b := 0; b < 3; b++ {
+		err = mem.SelectBank(b)
+		if err != nil {
+			t.Fatalf("failed to select bank: %s", err)
+		}
+		mem.Set(0x1000, uint8(b))
+		mem.Set(0xC000, uint8(b))
+	}
+	if mem.Bank() != 2 {
+		t.Fatalf("unexpected bank selected")
+	}
+
+	// The banked memory differs, the common memory doesn't.
+	for b := 0; b < 3; b++ {
+		if mem.GetBank(b, 0x1000) != uint8(b) {
+			t.Fatalf("bank %d has the wrong contents", b)
+		}
+		if mem.GetBank(b, 0xC000) != 2 {
+			t.Fatalf("bank %d has the wrong common contents", b)
+		}
+	}
+
+	// Write to a bank which isn't selected.
+	mem.SetBank(0, 0x2000, 0x42)
+	if mem.Get(0x2000) != 0x00 {
+		t.Fatalf("wrote to the wrong bank")
+	}
+	err = mem.SelectBank(0)
+	if err != nil {
+		t.Fatalf("failed to select bank: %s", err)
+	}
+	if mem.Get(0x2000) != 0x42 || mem.Get(0x1000) != 0x00 {
+		t.Fatalf("bank 0 has the wrong contents")
+	}
+}
+
+// TestWatch tests our watchpoints.
+func TestWatch(t *testing.T) {
+
+	mem := new(Memory)
+
+	type hit struct {
+		access Access
+		addr   uint16
+		value  uint8
+	}
+	var hits []hit
+	record := func(access Access, addr uint16, value uint8) {
+		hits = append(hits, hit{access, addr, value})
+	}
+
+	id := mem.Watch(0x1000, 0x10FF, Write, record)
+	mem.Watch(0x2000, 0x2000, Read|Exec, record)
+
+	mem.Set(0x0FFF, 0x01)
+	mem.Set(0x1000, 0x02)
+	mem.SetRange(0x10FE, 0x03, 0x04, 0x05)
+	mem.FillRange(0x1080, 1, 0x06)
+	mem.Get(0x1000)
+	mem.Get(0x2000)
+	mem.Execute(0x2000)
+	mem.Execute(0x2001)
+
+	expected := []hit{
+		{Write, 0x1000, 0x02},
+		{Write, 0x10FE, 0x03},
+		{Write, 0x10FF, 0x04},
+		{Write, 0x1080, 0x06},
+		{Read, 0x2000, 0x00},
+		{Exec, 0x2000, 0x00},
+	}
+	if len(hits) != len(expected) {
+		t.Fatalf("unexpected watchpoint hits %v", hits)
+	}
+	for i := range hits {
+		if hits[i] != expected[i] {
+			t.Fatalf("unexpected watchpoint hit %d: %v", i, hits[i])
+		}
+	}
+
+	// Once removed we're not triggered.
+	hits = nil
+	mem.Unwatch(id)
+	mem.Set(0x1000, 0x02)
+	if len(hits) != 0 {
+		t.Fatalf("unexpected watchpoint hits %v", hits)
+	}
+}
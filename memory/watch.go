@@ -0,0 +1,107 @@
+package memory
+
+// Access describes the kinds of memory access which a watchpoint is
+// triggered by.
+type Access uint8
+
+const (
+	// Read watches for memory being read, which includes the fetching
+	// of instructions.
+	Read Access = 1 << iota
+
+	// Write watches for memory being written to.
+	Write
+
+	// Exec watches for instructions being executed.  The emulator must
+	// call Execute before each instruction for these to be triggered.
+	Exec
+)
+
+// WatchFunc is the type of a function which is invoked when a watched
+// address is accessed, with the value read or written.
+//
+// For Exec accesses the value is the first byte of the instruction.
+type WatchFunc func(access Access, addr uint16, value uint8)
+
+// watch is a single watchpoint.
+type watch struct {
+	id     int
+	start  uint16
+	end    uint16
+	access Access
+	fn     WatchFunc
+}
+
+// Watch causes the given function to be invoked whenever an address from
+// start to end, inclusive, is accessed in one of the given ways.
+//
+// Watchpoints apply to the addresses visible to the processor, whichever
+// bank is selected.  The returned ID may be given to Unwatch to remove it.
+func (m *Memory) Watch(start, end uint16, access Access, fn WatchFunc) int {
+	m.nextWatch++
+	m.watches = append(m.watches, watch{id: m.nextWatch, start: start, end: end, access: access, fn: fn})
+	m.updateWatched()
+	return m.nextWatch
+}
+
+// Unwatch removes the watchpoint with the given ID.
+func (m *Memory) Unwatch(id int) {
+	for i, w := range m.watches {
+		if w.id == id {
+			m.watches = append(m.watches[:i], m.watches[i+1:]...)
+			break
+		}
+	}
+	m.updateWatched()
+}
+
+// Execute is called by the emulator before it executes the instruction at
+// the given address, so that Exec watchpoints may be triggered.
+func (m *Memory) Execute(addr uint16) {
+	if m.watched != nil && m.watched[addr]&Exec != 0 {
+		m.trigger(Exec, addr, m.buf[addr])
+	}
+}
+
+// Watching returns true if there are watchpoints which are triggered by
+// the given kind of access.
+func (m *Memory) Watching(access Access) bool {
+	for _, w := range m.watches {
+		if w.access&access != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// updateWatched records the kinds of access watched for at each address,
+// so that accessing memory which isn't watched remains cheap.
+func (m *Memory) updateWatched() {
+	if len(m.watches) == 0 {
+		m.watched = nil
+		return
+	}
+
+	m.watched = new([65536]Access)
+	for _, w := range m.watches {
+		for addr := int(w.start); addr <= int(w.end); addr++ {
+			m.watched[addr] |= w.access
+		}
+	}
+}
+
+// trigger invokes the watchpoints for the given access.
+func (m *Memory) trigger(access Access, addr uint16, value uint8) {
+	for _, w := range m.watches {
+		if w.access&access != 0 && addr >= w.start && addr <= w.end {
+			w.fn(access, addr, value)
+		}
+	}
+}
+
+// touched triggers any watchpoints for the given access.
+func (m *Memory) touched(access Access, addr uint16, value uint8) {
+	if m.watched != nil && m.watched[addr]&access != 0 {
+		m.trigger(access, addr, value)
+	}
+}
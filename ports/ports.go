@@ -0,0 +1,141 @@
+// Package ports contains the devices which may be attached to the I/O
+// ports of the Z80 processor.
+//
+// CP/M programs are supposed to access hardware via the BIOS, but many
+// which were written for a specific machine read and write the ports of
+// its peripherals directly.  A Bus allows Go devices to claim ranges of
+// ports, so that such hardware can be emulated.
+//
+// A small number of devices are built in, and may be attached by name,
+// with a string such as "rtc@0x80".
+package ports
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Device is the interface which must be implemented by anything attached
+// to the bus.
+//
+// The port given to each method is relative to the first port the device
+// was registered with, so a device doesn't need to know where it lives.
+type Device interface {
+	// In returns the value read from the given port.
+	In(port uint8) uint8
+
+	// Out writes the given value to the given port.
+	Out(port uint8, val uint8)
+}
+
+// Bus maps the I/O ports of the processor to the devices which have
+// claimed them.
+type Bus struct {
+	// devices holds the device which has claimed each port, if any.
+	devices [256]Device
+
+	// first holds the first port of the range each device claimed.
+	first [256]uint8
+}
+
+// Register attaches the device to the ports from first to last, inclusive.
+//
+// It is an error to claim a port which has already been claimed.
+func (b *Bus) Register(first, last uint8, dev Device) error {
+	if last < first {
+		return fmt.Errorf("invalid port range 0x%02X-0x%02X", first, last)
+	}
+	for p := int(first); p <= int(last); p++ {
+		if b.devices[p] != nil {
+			return fmt.Errorf("port 0x%02X is already in use", p)
+		}
+	}
+	for p := int(first); p <= int(last); p++ {
+		b.devices[p] = dev
+		b.first[p] = first
+	}
+	return nil
+}
+
+// In reads from the given port, returning false if no device has
+// claimed it.
+func (b *Bus) In(port uint8) (uint8, bool) {
+	dev := b.devices[port]
+	if dev == nil {
+		return 0, false
+	}
+	return dev.In(port - b.first[port]), true
+}
+
+// Out writes to the given port, returning false if no device has
+// claimed it.
+func (b *Bus) Out(port uint8, val uint8) bool {
+	dev := b.devices[port]
+	if dev == nil {
+		return false
+	}
+	dev.Out(port-b.first[port], val)
+	return true
+}
+
+// builtin describes a device which may be attached by name.
+type builtin struct {
+	// size is the number of ports the device uses.
+	size int
+
+	// create returns a new instance of the device.
+	create func() Device
+
+	// desc is a human-readable description of the device.
+	desc string
+}
+
+// builtins contains the devices which may be attached by name.
+var builtins = map[string]builtin{
+	"random": {size: 1, create: func() Device { return NewRandom() }, desc: "Returns a random value when read."},
+	"rtc":    {size: 7, create: func() Device { return NewRTC() }, desc: "A real-time clock, returning the date and time."},
+}
+
+// Names returns the sorted names of the devices which may be attached by
+// name.
+func Names() []string {
+	var names []string
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Description returns a human-readable description of the named device.
+func Description(name string) string {
+	return builtins[name].desc
+}
+
+// Parse creates the built-in device described by the given string, which
+// is of the form "name@port", and returns it along with the range of ports
+// it should be registered upon.
+func Parse(spec string) (uint8, uint8, Device, error) {
+	name, port, ok := strings.Cut(strings.TrimSpace(spec), "@")
+	if !ok {
+		return 0, 0, nil, fmt.Errorf("device %q has no port, expected name@port", spec)
+	}
+
+	b, ok := builtins[strings.ToLower(name)]
+	if !ok {
+		return 0, 0, nil, fmt.Errorf("unknown device %q, valid devices are %s", name, strings.Join(Names(), ", "))
+	}
+
+	first, err := strconv.ParseUint(port, 0, 8)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("invalid port %q for device %s", port, name)
+	}
+	last := int(first) + b.size - 1
+	if last > 0xFF {
+		return 0, 0, nil, fmt.Errorf("device %s needs %d ports, which don't fit at 0x%02X", name, b.size, first)
+	}
+
+	return uint8(first), uint8(last), b.create(), nil
+}
@@ -0,0 +1,126 @@
+package ports
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// counter is a device which records what was written to it.
+type counter struct {
+	last [2]uint8
+}
+
+func (c *counter) In(port uint8) uint8 {
+	return c.last[port] + 1
+}
+
+func (c *counter) Out(port uint8, val uint8) {
+	c.last[port] = val
+}
+
+// TestBus tests registering devices, and that they see relative ports.
+func TestBus(t *testing.T) {
+
+	b := &Bus{}
+	c := &counter{}
+
+	err := b.Register(0x10, 0x11, c)
+	if err != nil {
+		t.Fatalf("failed to register: %s", err)
+	}
+	err = b.Register(0x11, 0x12, &counter{})
+	if err == nil {
+		t.Fatalf("expected error claiming a port twice")
+	}
+	err = b.Register(0x12, 0x11, &counter{})
+	if err == nil {
+		t.Fatalf("expected error with an invalid range")
+	}
+
+	if !b.Out(0x11, 0x41) {
+		t.Fatalf("expected the port to be claimed")
+	}
+	if c.last[1] != 0x41 {
+		t.Fatalf("device saw the wrong port")
+	}
+	v, ok := b.In(0x11)
+	if !ok || v != 0x42 {
+		t.Fatalf("unexpected read %02X %v", v, ok)
+	}
+
+	// The failed registrations claimed nothing.
+	_, ok = b.In(0x12)
+	if ok || b.Out(0x12, 0x00) {
+		t.Fatalf("expected port to be unclaimed")
+	}
+}
+
+// TestParse tests creating our built-in devices.
+func TestParse(t *testing.T) {
+
+	type TestCase struct {
+		spec  string
+		first uint8
+		last  uint8
+		err   string
+	}
+
+	tests := []TestCase{
+		{spec: "rtc@0x80", first: 0x80, last: 0x86},
+		{spec: "RANDOM@16", first: 0x10, last: 0x10},
+		{spec: "rtc", err: "no port"},
+		{spec: "disk@0x10", err: "unknown device"},
+		{spec: "rtc@0x100", err: "invalid port"},
+		{spec: "rtc@0xFC", err: "don't fit"},
+	}
+
+	for _, test := range tests {
+		first, last, dev, err := Parse(test.spec)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("%s: expected error %q, got %v", test.spec, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", test.spec, err)
+		}
+		if first != test.first || last != test.last || dev == nil {
+			t.Fatalf("%s: unexpected result %02X-%02X", test.spec, first, last)
+		}
+	}
+
+	names := Names()
+	if len(names) != len(builtins) || names[0] != "random" {
+		t.Fatalf("unexpected names %v", names)
+	}
+	if Description("rtc") == "" {
+		t.Fatalf("expected a description")
+	}
+}
+
+// TestRTC tests our clock latches the time.
+func TestRTC(t *testing.T) {
+
+	now := time.Date(2024, time.March, 9, 13, 45, 30, 0, time.Local)
+	r := NewRTC()
+	r.now = func() time.Time { return now }
+
+	expected := []uint8{30, 45, 13, 9, 3, 24, 6}
+	for i, e := range expected {
+		if v := r.In(uint8(i)); v != e {
+			t.Fatalf("port %d: expected %d, got %d", i, e, v)
+		}
+	}
+
+	// The time changes, but we don't see it until the seconds are read.
+	now = now.Add(time.Hour)
+	if r.In(2) != 13 {
+		t.Fatalf("expected the latched time")
+	}
+	r.In(0)
+	if r.In(2) != 14 {
+		t.Fatalf("expected the new time")
+	}
+}
@@ -0,0 +1,25 @@
+package ports
+
+import (
+	"math/rand"
+)
+
+// Random is a device which returns a random value whenever it is read.
+//
+// Writes are ignored.
+type Random struct {
+}
+
+// NewRandom creates a new random-number device.
+func NewRandom() *Random {
+	return &Random{}
+}
+
+// In returns a random value.
+func (r *Random) In(port uint8) uint8 {
+	return uint8(rand.Intn(256))
+}
+
+// Out is ignored.
+func (r *Random) Out(port uint8, val uint8) {
+}
@@ -0,0 +1,61 @@
+package ports
+
+import (
+	"time"
+)
+
+// RTC is a real-time clock, which uses seven ports to return the host's
+// local date and time, in binary:
+//
+//	+0 seconds
+//	+1 minutes
+//	+2 hours
+//	+3 day of the month
+//	+4 month
+//	+5 year, within the century
+//	+6 day of the week, with Sunday as zero
+//
+// Reading the seconds latches the time, so reading the other ports after
+// it returns a consistent value.  Writes are ignored.
+type RTC struct {
+	// now returns the current time, it is replaced in our tests.
+	now func() time.Time
+
+	// latched is the time the seconds were last read.
+	latched time.Time
+}
+
+// NewRTC creates a new real-time clock device.
+func NewRTC() *RTC {
+	return &RTC{now: time.Now}
+}
+
+// In returns the value of the given field of the time.
+func (r *RTC) In(port uint8) uint8 {
+	if port == 0 || r.latched.IsZero() {
+		r.latched = r.now()
+	}
+	t := r.latched
+
+	switch port {
+	case 0:
+		return uint8(t.Second())
+	case 1:
+		return uint8(t.Minute())
+	case 2:
+		return uint8(t.Hour())
+	case 3:
+		return uint8(t.Day())
+	case 4:
+		return uint8(t.Month())
+	case 5:
+		return uint8(t.Year() % 100)
+	case 6:
+		return uint8(t.Weekday())
+	}
+	return 0
+}
+
+// Out is ignored.
+func (r *RTC) Out(port uint8, val uint8) {
+}
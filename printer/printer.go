@@ -0,0 +1,196 @@
+// Package printer contains the printer device which is used for the
+// output of the CP/M list device.
+//
+// Printer output is written to a file, via a buffered and persistent
+// handle, or piped to an external command such as `lpr`.  Optionally
+// each page, as delimited by form-feed characters, may be written to
+// a distinct numbered file, or command invocation.
+package printer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// formFeed is the character which separates pages.
+const formFeed = 0x0C
+
+// Printer holds our state.
+type Printer struct {
+
+	// path contains the filename to write printer-output to.
+	path string
+
+	// command contains a command to pipe printer-output to, if set this
+	// takes precedence over path.
+	command string
+
+	// split is true if we should start a new file, or command, for
+	// each page of output.
+	split bool
+
+	// page contains the number of the current page, when splitting.
+	page int
+
+	// writer is the buffered writer for our output, if a job is in
+	// progress.
+	writer *bufio.Writer
+
+	// out is the thing which writer is writing to.
+	out io.WriteCloser
+
+	// cmd is the command we're piping output to, if any.
+	cmd *exec.Cmd
+
+	// err contains the last error we encountered, if any.
+	err error
+}
+
+// New returns a printer which will write to the given file.
+func New(path string) *Printer {
+	return &Printer{
+		path: path,
+		page: 1,
+	}
+}
+
+// SetCommand causes printer output to be piped to the given command,
+// which is executed via the shell, rather than written to a file.
+func (p *Printer) SetCommand(command string) {
+	p.command = command
+}
+
+// SetPageSplit enables, or disables, the splitting of output into a
+// distinct file, or command invocation, for each page.
+func (p *Printer) SetPageSplit(split bool) {
+	p.split = split
+}
+
+// GetPath returns the path of the file the next character will be
+// written to, which will include the page number when splitting.
+func (p *Printer) GetPath() string {
+	if !p.split {
+		return p.path
+	}
+
+	ext := filepath.Ext(p.path)
+	return fmt.Sprintf("%s-%03d%s", strings.TrimSuffix(p.path, ext), p.page, ext)
+}
+
+// Ready returns true if the printer is able to accept output.
+//
+// We're not ready if there is nowhere to send output, or if writing to
+// the output previously failed.
+func (p *Printer) Ready() bool {
+	if p.path == "" && p.command == "" {
+		return false
+	}
+	return p.err == nil
+}
+
+// open starts a new print job, by opening our file, or launching our command.
+func (p *Printer) open() error {
+
+	if p.command != "" {
+		cmd := exec.Command("/bin/sh", "-c", p.command)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		// When splitting pages let the command know which page it has.
+		cmd.Env = append(os.Environ(), fmt.Sprintf("CPM_PRINTER_PAGE=%d", p.page))
+
+		in, err := cmd.StdinPipe()
+		if err != nil {
+			return fmt.Errorf("failed to create pipe for printer command %s: %s", p.command, err)
+		}
+		err = cmd.Start()
+		if err != nil {
+			return fmt.Errorf("failed to launch printer command %s: %s", p.command, err)
+		}
+		p.cmd = cmd
+		p.out = in
+	} else {
+		path := p.GetPath()
+
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open printer file %s: %s", path, err)
+		}
+		p.out = f
+	}
+
+	p.writer = bufio.NewWriter(p.out)
+	return nil
+}
+
+// PutCharacter sends a single character to the printer.
+func (p *Printer) PutCharacter(c uint8) error {
+
+	// Start a job if we don't have one in progress.
+	if p.writer == nil {
+		p.err = p.open()
+		if p.err != nil {
+			return p.err
+		}
+	}
+
+	p.err = p.writer.WriteByte(c)
+	if p.err != nil {
+		return fmt.Errorf("failed to write to printer: %s", p.err)
+	}
+
+	// End of the page?  Then we finish this job and move on.
+	if c == formFeed && p.split {
+		err := p.Close()
+		p.page++
+		return err
+	}
+
+	return nil
+}
+
+// Flush ensures any buffered output has been written.
+func (p *Printer) Flush() error {
+	if p.writer == nil {
+		return nil
+	}
+
+	p.err = p.writer.Flush()
+	return p.err
+}
+
+// Close flushes our output, and finishes the current print job.
+//
+// For a file that means closing it, and for a command it means closing
+// the command's input and waiting for it to terminate.  Printing again
+// afterwards will start a new job.
+func (p *Printer) Close() error {
+	if p.writer == nil {
+		return nil
+	}
+
+	err := p.Flush()
+
+	cerr := p.out.Close()
+	if err == nil {
+		err = cerr
+	}
+
+	if p.cmd != nil {
+		werr := p.cmd.Wait()
+		if err == nil && werr != nil {
+			err = fmt.Errorf("printer command %s failed: %s", p.command, werr)
+		}
+		p.cmd = nil
+	}
+
+	p.writer = nil
+	p.out = nil
+	p.err = err
+	return err
+}
@@ -0,0 +1,137 @@
+package printer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPrinterFile ensures that output goes to the file we expect.
+func TestPrinterFile(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "print.log")
+
+	p := New(path)
+	if !p.Ready() {
+		t.Fatalf("printer should be ready")
+	}
+
+	for _, c := range "Steve" {
+		err := p.PutCharacter(uint8(c))
+		if err != nil {
+			t.Fatalf("failed to print: %s", err)
+		}
+	}
+
+	// Close the job, and start another.
+	err := p.Close()
+	if err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+	for _, c := range " Kemp" {
+		err = p.PutCharacter(uint8(c))
+		if err != nil {
+			t.Fatalf("failed to print: %s", err)
+		}
+	}
+	err = p.Flush()
+	if err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read output: %s", err)
+	}
+	if string(data) != "Steve Kemp" {
+		t.Fatalf("wrong output '%s'", data)
+	}
+
+	p.Close()
+}
+
+// TestPrinterSplit ensures that pages are split into distinct files.
+func TestPrinterSplit(t *testing.T) {
+
+	dir := t.TempDir()
+
+	p := New(filepath.Join(dir, "print.log"))
+	p.SetPageSplit(true)
+
+	if p.GetPath() != filepath.Join(dir, "print-001.log") {
+		t.Fatalf("unexpected path %s", p.GetPath())
+	}
+
+	for _, c := range "one\ftwo\fthree" {
+		err := p.PutCharacter(uint8(c))
+		if err != nil {
+			t.Fatalf("failed to print: %s", err)
+		}
+	}
+	p.Close()
+
+	expected := map[string]string{
+		"print-001.log": "one\f",
+		"print-002.log": "two\f",
+		"print-003.log": "three",
+	}
+	for name, content := range expected {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("failed to read page %s: %s", name, err)
+		}
+		if string(data) != content {
+			t.Fatalf("page %s had content '%s'", name, data)
+		}
+	}
+}
+
+// TestPrinterCommand ensures that output can be piped to a command.
+func TestPrinterCommand(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.txt")
+
+	p := New("")
+	p.SetCommand("tr a-z A-Z > " + path)
+
+	for _, c := range "steve" {
+		err := p.PutCharacter(uint8(c))
+		if err != nil {
+			t.Fatalf("failed to print: %s", err)
+		}
+	}
+
+	err := p.Close()
+	if err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read output: %s", err)
+	}
+	if string(data) != "STEVE" {
+		t.Fatalf("wrong output '%s'", data)
+	}
+
+	// A failing command makes us not-ready
+	p.SetCommand("exit 3")
+	_ = p.PutCharacter('x')
+	err = p.Close()
+	if err == nil {
+		t.Fatalf("expected an error from a failing command")
+	}
+	if p.Ready() {
+		t.Fatalf("printer should not be ready after a failure")
+	}
+}
+
+// TestPrinterNotReady ensures a printer with no output isn't ready.
+func TestPrinterNotReady(t *testing.T) {
+	p := New("")
+	if p.Ready() {
+		t.Fatalf("printer with no destination should not be ready")
+	}
+}